@@ -9,8 +9,10 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"net/url"
+	"ovirt/imageio/backend"
 	"strings"
 	"sync"
 	"time"
@@ -21,9 +23,13 @@ type Auth struct {
 	ticket  *Ticket
 	expires time.Time
 	url     *url.URL
-}
 
-var supportedSchemes = map[string]bool{"file": true}
+	// Tasks authorized by this ticket, protected by mutex.
+	canceled    bool
+	tasks       map[*Task]bool
+	transferred int64
+	lastActive  time.Time
+}
 
 // newAuth creates new Auth from ticket, valid for t.Timeout seconds.
 func newAuth(t *Ticket) (*Auth, error) {
@@ -31,19 +37,32 @@ func newAuth(t *Ticket) (*Auth, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Invalid url: %v: %v", t.Url, err)
 	}
-	if !supportedSchemes[u.Scheme] {
+	if !backend.Supported(u.Scheme) {
 		return nil, fmt.Errorf("Unsupported scheme: %v", u.Scheme)
 	}
-	expires := time.Now().Add(time.Duration(t.Timeout) * time.Second)
-	return &Auth{t, expires, u}, nil
+	now := time.Now()
+	a := &Auth{
+		ticket:     t,
+		expires:    now.Add(time.Duration(t.Timeout) * time.Second),
+		url:        u,
+		tasks:      map[*Task]bool{},
+		lastActive: now,
+	}
+	return a, nil
 }
 
-func (a *Auth) check(mode string, size int64) (*url.URL, error) {
+// check checks that mode is allowed for length bytes at offset. The range is
+// checked without computing offset + length, which may overflow.
+func (a *Auth) check(mode string, offset int64, length int64) (*url.URL, error) {
+	if a.canceled {
+		return nil, fmt.Errorf("Ticket canceled")
+	}
 	if !strings.Contains(a.ticket.Mode, mode) {
 		return nil, fmt.Errorf("Operation not allowed: %v", mode)
 	}
-	if size > int64(a.ticket.Size) {
-		return nil, fmt.Errorf("Size out of range: %v", size)
+	size := int64(a.ticket.Size)
+	if offset < 0 || length < 0 || offset > size || length > size-offset {
+		return nil, fmt.Errorf("Range out of ticket size: offset=%v length=%v", offset, length)
 	}
 	if time.Now().After(a.expires) {
 		return nil, fmt.Errorf("Ticket expired at %s", a.expires)
@@ -60,7 +79,12 @@ var (
 	mutex         = sync.Mutex{}
 )
 
-// Add adds Auth for ticket
+// ErrExists is returned when adding a ticket with the uuid of an existing
+// ticket.
+var ErrExists = errors.New("Ticket exists")
+
+// Add adds Auth for ticket. Replacing an existing ticket would orphan tasks
+// authorized by the old ticket, so the ticket must be removed first.
 func Add(t *Ticket) (err error) {
 	a, err := newAuth(t)
 	if err != nil {
@@ -68,36 +92,121 @@ func Add(t *Ticket) (err error) {
 	}
 	mutex.Lock()
 	defer mutex.Unlock()
+	if _, ok := authorization[t.Uuid]; ok {
+		return ErrExists
+	}
 	authorization[t.Uuid] = a
+	backend.Retain(a.url)
 	return
 }
 
-// Remove removes Auth for u
+// Extend extends Auth for u, so it expires timeout seconds from now.
+//
+// Extending is done while holding the lock, so ongoing requests are not
+// affected.
+func Extend(u string, timeout Seconds) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	a := authorization[u]
+	if a == nil {
+		return fmt.Errorf("No auth for %v", u)
+	}
+	a.expires = time.Now().Add(time.Duration(timeout) * time.Second)
+	return nil
+}
+
+// Remove removes Auth for u, canceling tasks authorized by u. Canceled tasks
+// may still be running when Remove returns.
 func Remove(u string) {
 	mutex.Lock()
 	defer mutex.Unlock()
+	a := authorization[u]
+	if a == nil {
+		return
+	}
+	a.cancel()
 	delete(authorization, u)
-	// TODO: cancel tasks authorized by u
+	backend.Release(a.url)
+}
+
+// RemoveWait removes Auth for u, canceling tasks authorized by u, and waits
+// until the tasks are finished.
+//
+// If the tasks did not finish within timeout, Auth for u is kept in canceled
+// state, preventing new tasks, and an error is returned. The caller may retry
+// later.
+func RemoveWait(u string, timeout time.Duration) error {
+	mutex.Lock()
+	a := authorization[u]
+	if a == nil {
+		mutex.Unlock()
+		return nil
+	}
+	tasks := a.cancel()
+	mutex.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for _, t := range tasks {
+		select {
+		case <-t.done:
+		case <-timer.C:
+			return fmt.Errorf("Timeout waiting for tasks authorized by %v", u)
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if authorization[u] == a {
+		delete(authorization, u)
+		backend.Release(a.url)
+	}
+	return nil
+}
+
+// MayRead checks if caller may read length bytes at offset, and return a url
+// that the caller may read from, or an error describing why the operation is
+// forbidden.
+func MayRead(u string, offset int64, length int64) (*url.URL, error) {
+	return check(u, "r", offset, length)
 }
 
-// MayRead checks if caller may read up to size bytes, and return a url that the
-// caller may read from, or an error describing why the operation is forbidden.
-func MayRead(u string, size int64) (*url.URL, error) {
-	return check(u, "r", size)
+// MayWrite checks if caller may write length bytes at offset, and return a url
+// that the caller may write to, or an error describing why the operation is
+// forbidden.
+func MayWrite(u string, offset int64, length int64) (*url.URL, error) {
+	return check(u, "w", offset, length)
 }
 
-// MayWrite checks if caller may write up to size bytes, and return a url that the
-// caller may write to, or an error describing why the operation is forbidden.
-func MayWrite(u string, size int64) (*url.URL, error) {
-	return check(u, "w", size)
+// Get returns a copy of the ticket for u.
+func Get(u string) (*Ticket, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	a := authorization[u]
+	if a == nil {
+		return nil, fmt.Errorf("No auth for %v", u)
+	}
+	t := *a.ticket
+	return &t, nil
+}
+
+// Size returns the size of the image authorized by ticket u.
+func Size(u string) (int64, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	a := authorization[u]
+	if a == nil {
+		return 0, fmt.Errorf("No auth for %v", u)
+	}
+	return int64(a.ticket.Size), nil
 }
 
-func check(u string, mode string, size int64) (*url.URL, error) {
+func check(u string, mode string, offset int64, length int64) (*url.URL, error) {
 	mutex.Lock()
 	defer mutex.Unlock()
 	a := authorization[u]
 	if a == nil {
 		return nil, fmt.Errorf("No auth for %v", u)
 	}
-	return a.check(mode, size)
+	return a.check(mode, offset, length)
 }
@@ -9,18 +9,22 @@
 package auth
 
 import (
+	"bytes"
+	"math"
+	"net/url"
+	"ovirt/imageio/backend"
 	"testing"
 )
 
 func TestMayReadNoAuth(t *testing.T) {
-	u, _ := MayRead("3facfbc1", 1024)
+	u, _ := MayRead("3facfbc1", 0, 1024)
 	if u != nil {
 		t.Fatalf("Read allowed without a tikcet: %v", u)
 	}
 }
 
 func TestMayWriteNoAuth(t *testing.T) {
-	u, _ := MayWrite("3facfbc1", 1024)
+	u, _ := MayWrite("3facfbc1", 0, 1024)
 	if u != nil {
 		t.Fatalf("Write allowed without a tikcet: %v", u)
 	}
@@ -40,18 +44,208 @@ func TestAddRemove(t *testing.T) {
 	}
 	defer Remove(ticket.Uuid)
 
-	u, err := MayRead(ticket.Uuid, 1024)
+	u, err := MayRead(ticket.Uuid, 0, 1024)
 	if u == nil {
 		t.Fatalf("Auth not added: %v", err)
 	}
 
 	Remove(ticket.Uuid)
-	u, err = MayRead(ticket.Uuid, 1024)
+	u, err = MayRead(ticket.Uuid, 0, 1024)
 	if u != nil {
 		t.Fatalf("Auth not removed: %v", u)
 	}
 }
 
+func TestAddExisting(t *testing.T) {
+	ticket := &Ticket{Mode: "r", Size: 1024, Timeout: 1, Url: "file:///path", Uuid: "3facfbc1"}
+	if err := Add(ticket); err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(ticket.Uuid)
+
+	other := &Ticket{Mode: "rw", Size: 2048, Timeout: 1, Url: "file:///other", Uuid: "3facfbc1"}
+	if err := Add(other); err != ErrExists {
+		t.Fatalf("Expected %v, got %v", ErrExists, err)
+	}
+	if _, err := MayWrite(ticket.Uuid, 0, 1024); err == nil {
+		t.Fatal("Existing ticket was replaced")
+	}
+}
+
+func TestAddSupportedSchemes(t *testing.T) {
+	for _, u := range []string{
+		"file:///path",
+		"nbd:unix:/run/nbd.sock",
+		"nbd://example.com:10809/sda",
+		"nbd+unix:///sda?socket=/run/nbd.sock",
+		"https://example.com:54322/images/3facfbc1",
+		"memory://scratch?size=1024",
+	} {
+		ticket := &Ticket{Mode: "r", Size: 1024, Timeout: 1, Url: u, Uuid: "3facfbc1"}
+		if err := Add(ticket); err != nil {
+			t.Fatalf("%v: %v", u, err)
+		}
+		Remove(ticket.Uuid)
+	}
+}
+
+func TestAddUnsupportedScheme(t *testing.T) {
+	ticket := &Ticket{Mode: "r", Size: 1024, Timeout: 1, Url: "ftp://host/path", Uuid: "3facfbc1"}
+	if err := Add(ticket); err == nil {
+		Remove(ticket.Uuid)
+		t.Fatal("Adding ticket with unsupported scheme did not fail")
+	}
+}
+
+func TestRemoveMemory(t *testing.T) {
+	const rawurl = "memory://remove-memory?size=1024"
+	first := &Ticket{Mode: "rw", Size: 1024, Timeout: 1, Url: rawurl, Uuid: "3facfbc1"}
+	second := &Ticket{Mode: "r", Size: 1024, Timeout: 1, Url: rawurl, Uuid: "3facfbc2"}
+	for _, ticket := range []*Ticket{first, second} {
+		if err := Add(ticket); err != nil {
+			t.Fatal(err)
+		}
+		defer Remove(ticket.Uuid)
+	}
+
+	u, _ := url.Parse(rawurl)
+	defer backend.RemoveMemory(u)
+	b, err := backend.Open(u, backend.OpenOptions{Writable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	read := func() []byte {
+		b, err := backend.Open(u, backend.OpenOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		buf := make([]byte, 4)
+		if _, err := b.ReadAt(buf, 0); err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+
+	// The image is still used by the second ticket.
+	Remove(first.Uuid)
+	if buf := read(); !bytes.Equal(buf, []byte("data")) {
+		t.Fatalf("Image removed while used by a ticket: %q", buf)
+	}
+
+	// Removing the last ticket removes the image.
+	Remove(second.Uuid)
+	if buf := read(); !bytes.Equal(buf, make([]byte, 4)) {
+		t.Fatalf("Image was not removed: %q", buf)
+	}
+}
+
+func TestExtend(t *testing.T) {
+	ticket := &Ticket{
+		Mode:    "r",
+		Size:    1024,
+		Timeout: 0,
+		Url:     "file:///path",
+		Uuid:    "3facfbc1",
+	}
+	err := Add(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(ticket.Uuid)
+
+	if _, err = MayRead(ticket.Uuid, 0, 1024); err == nil {
+		t.Fatal("Read allowed with expired ticket")
+	}
+
+	if err = Extend(ticket.Uuid, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = MayRead(ticket.Uuid, 0, 1024); err != nil {
+		t.Fatalf("Read not allowed after extending ticket: %v", err)
+	}
+}
+
+func TestExtendNoAuth(t *testing.T) {
+	err := Extend("3facfbc1", 10)
+	if err == nil {
+		t.Fatal("Extend did not fail without a ticket")
+	}
+}
+
+func TestGet(t *testing.T) {
+	ticket := &Ticket{
+		Mode:    "r",
+		Size:    1024,
+		Timeout: 1,
+		Url:     "file:///path",
+		Uuid:    "3facfbc1",
+	}
+	err := Add(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(ticket.Uuid)
+
+	got, err := Get(ticket.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *ticket {
+		t.Fatalf("Expected %+v, got %+v", ticket, got)
+	}
+
+	// Modifying the returned ticket must not modify the authorization.
+	got.Mode = "rw"
+	_, err = MayWrite(ticket.Uuid, 0, 1024)
+	if err == nil {
+		t.Fatal("Modifying returned ticket allowed write")
+	}
+}
+
+func TestGetNoAuth(t *testing.T) {
+	_, err := Get("3facfbc1")
+	if err == nil {
+		t.Fatal("Get did not fail without a ticket")
+	}
+}
+
+func TestSize(t *testing.T) {
+	ticket := &Ticket{
+		Mode:    "r",
+		Size:    1024,
+		Timeout: 1,
+		Url:     "file:///path",
+		Uuid:    "3facfbc1",
+	}
+	err := Add(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(ticket.Uuid)
+
+	size, err := Size(ticket.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 1024 {
+		t.Fatalf("Expected size 1024, got %v", size)
+	}
+}
+
+func TestSizeNoAuth(t *testing.T) {
+	_, err := Size("3facfbc1")
+	if err == nil {
+		t.Fatal("Size did not fail without a ticket")
+	}
+}
+
 var mayRead = []*Ticket{
 	{Mode: "rw", Size: 1024, Timeout: 1, Url: "file:///path", Uuid: "3facfbc1"},
 	{Mode: "r", Size: 1024, Timeout: 1, Url: "file:///path", Uuid: "3facfbc1"},
@@ -82,9 +276,8 @@ func TestMayRead(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer Remove(ticket.Uuid)
-
-		u, err := MayRead(ticket.Uuid, 1024)
+		u, err := MayRead(ticket.Uuid, 0, 1024)
+		Remove(ticket.Uuid)
 		if err != nil {
 			t.Errorf("Should allow read for %+v: %v", ticket, err)
 			continue
@@ -101,24 +294,45 @@ func TestMayNotRead(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer Remove(ticket.Uuid)
-
-		_, err = MayRead(ticket.Uuid, 1024)
+		_, err = MayRead(ticket.Uuid, 0, 1024)
+		Remove(ticket.Uuid)
 		if err == nil {
 			t.Errorf("Should not allow read for %+v", ticket)
 		}
 	}
 }
 
+func TestMayWriteOverflow(t *testing.T) {
+	ticket := &Ticket{Mode: "w", Size: 1024, Timeout: 1, Url: "file:///path", Uuid: "3facfbc1"}
+	err := Add(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(ticket.Uuid)
+
+	ranges := [][2]int64{
+		{math.MaxInt64 - 99, 100},
+		{100, math.MaxInt64},
+		{-1, 1},
+		{0, -1},
+		{1025, 0},
+	}
+	for _, r := range ranges {
+		_, err = MayWrite(ticket.Uuid, r[0], r[1])
+		if err == nil {
+			t.Errorf("Should not allow write offset=%v length=%v", r[0], r[1])
+		}
+	}
+}
+
 func TestMayWrite(t *testing.T) {
 	for _, ticket := range mayWrite {
 		err := Add(ticket)
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer Remove(ticket.Uuid)
-
-		u, err := MayWrite(ticket.Uuid, 1024)
+		u, err := MayWrite(ticket.Uuid, 0, 1024)
+		Remove(ticket.Uuid)
 		if err != nil {
 			t.Errorf("Should allow write for %+v: %v", ticket, err)
 			continue
@@ -135,9 +349,8 @@ func TestMayNotWrite(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer Remove(ticket.Uuid)
-
-		_, err = MayWrite(ticket.Uuid, 1024)
+		_, err = MayWrite(ticket.Uuid, 0, 1024)
+		Remove(ticket.Uuid)
 		if err == nil {
 			t.Errorf("Should not allow write for %+v", ticket)
 		}
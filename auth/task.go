@@ -0,0 +1,123 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package auth
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Task tracks an operation authorized by a ticket.
+//
+// Task implements the fileio.Progress interface, so it can be passed to
+// fileio functions to report the number of bytes transferred. When the ticket
+// is removed, the task context is canceled.
+type Task struct {
+	value  int64 // Must be aligned to 8 byte to use atomic
+	auth   *Auth
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Begin starts tracking a task authorized by ticket u. The task context is
+// derived from ctx, so canceling ctx also cancels the task. The caller must
+// call Done when the task is finished.
+func Begin(ctx context.Context, u string) (*Task, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	a := authorization[u]
+	if a == nil {
+		return nil, fmt.Errorf("No auth for %v", u)
+	}
+	if a.canceled {
+		return nil, fmt.Errorf("Ticket canceled")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	t := &Task{auth: a, ctx: ctx, cancel: cancel, done: make(chan struct{})}
+	a.tasks[t] = true
+	return t, nil
+}
+
+// Context returns the task context, canceled when the ticket is removed or
+// when the parent context is canceled.
+func (t *Task) Context() context.Context {
+	return t.ctx
+}
+
+// Set sets the number of bytes transferred by the task.
+func (t *Task) Set(value int64) {
+	atomic.StoreInt64(&t.value, value)
+}
+
+// Done ends tracking the task, adding the bytes transferred to the ticket.
+func (t *Task) Done() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	a := t.auth
+	if !a.tasks[t] {
+		return
+	}
+	delete(a.tasks, t)
+	a.transferred += atomic.LoadInt64(&t.value)
+	a.lastActive = time.Now()
+	t.cancel()
+	close(t.done)
+}
+
+// cancel cancels Auth and all its tasks, returning the canceled tasks.
+// Must be called while holding mutex.
+func (a *Auth) cancel() []*Task {
+	a.canceled = true
+	tasks := make([]*Task, 0, len(a.tasks))
+	for t := range a.tasks {
+		t.cancel()
+		tasks = append(tasks, t)
+	}
+	return tasks
+}
+
+// Status describes a ticket and the tasks authorized by it.
+type Status struct {
+	Ticket
+	Transferred int64     `json:"transferred"`
+	Active      bool      `json:"active"`
+	Ongoing     int       `json:"ongoing"`
+	Expires     time.Time `json:"expires"`
+	IdleTime    Seconds   `json:"idle_time"`
+}
+
+// GetStatus returns the status of ticket u.
+//
+// Transferred includes bytes transferred by ongoing tasks. IdleTime is the
+// time since the last task has finished, or zero if the ticket is active.
+func GetStatus(u string) (*Status, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	a := authorization[u]
+	if a == nil {
+		return nil, fmt.Errorf("No auth for %v", u)
+	}
+	s := &Status{
+		Ticket:      *a.ticket,
+		Transferred: a.transferred,
+		Active:      len(a.tasks) > 0,
+		Ongoing:     len(a.tasks),
+		Expires:     a.expires,
+	}
+	for t := range a.tasks {
+		s.Transferred += atomic.LoadInt64(&t.value)
+	}
+	if !s.Active {
+		s.IdleTime = Seconds(time.Since(a.lastActive) / time.Second)
+	}
+	return s, nil
+}
@@ -0,0 +1,201 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBeginNoAuth(t *testing.T) {
+	_, err := Begin(context.Background(), "3facfbc1")
+	if err == nil {
+		t.Fatal("Begin did not fail without a ticket")
+	}
+}
+
+func TestStatusNoAuth(t *testing.T) {
+	_, err := GetStatus("3facfbc1")
+	if err == nil {
+		t.Fatal("GetStatus did not fail without a ticket")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	ticket := &Ticket{
+		Mode:    "rw",
+		Size:    4096,
+		Timeout: 10,
+		Url:     "file:///path",
+		Uuid:    "3facfbc1",
+	}
+	err := Add(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(ticket.Uuid)
+
+	checkStatus(t, ticket.Uuid, 0, 0)
+
+	t1, err := Begin(context.Background(), ticket.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t2, err := Begin(context.Background(), ticket.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, ticket.Uuid, 0, 2)
+
+	t1.Set(1024)
+	t2.Set(512)
+	checkStatus(t, ticket.Uuid, 1536, 2)
+
+	t1.Done()
+	checkStatus(t, ticket.Uuid, 1536, 1)
+
+	// Calling Done twice must not count the task twice.
+	t1.Done()
+	checkStatus(t, ticket.Uuid, 1536, 1)
+
+	t2.Set(1024)
+	t2.Done()
+	checkStatus(t, ticket.Uuid, 2048, 0)
+}
+
+func TestRemoveCancelsTasks(t *testing.T) {
+	ticket := &Ticket{
+		Mode:    "rw",
+		Size:    4096,
+		Timeout: 10,
+		Url:     "file:///path",
+		Uuid:    "3facfbc1",
+	}
+	err := Add(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(ticket.Uuid)
+
+	task, err := Begin(context.Background(), ticket.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer task.Done()
+
+	Remove(ticket.Uuid)
+
+	select {
+	case <-task.Context().Done():
+	default:
+		t.Fatal("Task was not canceled")
+	}
+}
+
+func TestRemoveWait(t *testing.T) {
+	ticket := &Ticket{
+		Mode:    "rw",
+		Size:    4096,
+		Timeout: 10,
+		Url:     "file:///path",
+		Uuid:    "3facfbc1",
+	}
+	err := Add(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(ticket.Uuid)
+
+	task, err := Begin(context.Background(), ticket.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a task noticing the cancellation and finishing.
+	go func() {
+		<-task.Context().Done()
+		task.Done()
+	}()
+
+	if err = RemoveWait(ticket.Uuid, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Get(ticket.Uuid); err == nil {
+		t.Fatal("Ticket was not removed")
+	}
+}
+
+func TestRemoveWaitTimeout(t *testing.T) {
+	ticket := &Ticket{
+		Mode:    "rw",
+		Size:    4096,
+		Timeout: 10,
+		Url:     "file:///path",
+		Uuid:    "3facfbc1",
+	}
+	err := Add(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(ticket.Uuid)
+
+	task, err := Begin(context.Background(), ticket.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = RemoveWait(ticket.Uuid, 10*time.Millisecond); err == nil {
+		t.Fatal("RemoveWait did not time out")
+	}
+
+	// The ticket is kept in canceled state.
+	if _, err = Get(ticket.Uuid); err != nil {
+		t.Fatal("Ticket was removed")
+	}
+	if _, err = MayRead(ticket.Uuid, 0, 1024); err == nil {
+		t.Fatal("Read allowed with canceled ticket")
+	}
+	if _, err = Begin(context.Background(), ticket.Uuid); err == nil {
+		t.Fatal("Task started with canceled ticket")
+	}
+
+	task.Done()
+	if err = RemoveWait(ticket.Uuid, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoveWaitNoAuth(t *testing.T) {
+	if err := RemoveWait("3facfbc1", 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkStatus(t *testing.T, u string, transferred int64, ongoing int) {
+	s, err := GetStatus(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Uuid != u {
+		t.Errorf("Unexpected ticket: %+v", s.Ticket)
+	}
+	if s.Transferred != transferred {
+		t.Errorf("Expected transferred=%v, got %v", transferred, s.Transferred)
+	}
+	if s.Ongoing != ongoing {
+		t.Errorf("Expected ongoing=%v, got %v", ongoing, s.Ongoing)
+	}
+	if s.Active != (ongoing > 0) {
+		t.Errorf("Expected active=%v, got %v", ongoing > 0, s.Active)
+	}
+	if s.Active && s.IdleTime != 0 {
+		t.Errorf("Expected no idle time for active ticket, got %v", s.IdleTime)
+	}
+}
@@ -11,17 +11,30 @@ package auth
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 )
 
 type Bytes int64
 type Seconds uint
 
 type Ticket struct {
-	Mode    string
-	Size    Bytes
-	Url     string
-	Uuid    string
-	Timeout Seconds
+	Mode    string  `json:"mode"`
+	Size    Bytes   `json:"size"`
+	Url     string  `json:"url"`
+	Uuid    string  `json:"uuid"`
+	Timeout Seconds `json:"timeout"`
+
+	// Sparse enables zero detection when uploading to a file, keeping thin
+	// images thin when the client sends zeros.
+	Sparse bool `json:"sparse"`
+
+	// DirtyBitmap is the name of the qemu dirty bitmap reporting the blocks
+	// modified since the last backup, for incremental backup over NBD.
+	DirtyBitmap string `json:"dirty_bitmap"`
+
+	// Format is the image format, "raw" (default) or "qcow2". Transfers
+	// always use raw guest data; qcow2 images are converted by the daemon.
+	Format string `json:"format"`
 }
 
 func ParseTicket(buf []byte) (t *Ticket, err error) {
@@ -44,5 +57,20 @@ func ParseTicket(buf []byte) (t *Ticket, err error) {
 	if t.Timeout == 0 {
 		return nil, fmt.Errorf("Timeout is required")
 	}
+	if !(t.Format == "" || t.Format == "raw" || t.Format == "qcow2") {
+		return nil, fmt.Errorf("Invalid format: %v", t.Format)
+	}
 	return
 }
+
+// Ops returns the operations allowed by the ticket mode.
+func (t *Ticket) Ops() []string {
+	ops := []string{}
+	if strings.Contains(t.Mode, "r") {
+		ops = append(ops, "read")
+	}
+	if strings.Contains(t.Mode, "w") {
+		ops = append(ops, "write")
+	}
+	return ops
+}
@@ -9,6 +9,7 @@
 package auth
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -39,6 +40,66 @@ func TestParseTicket(t *testing.T) {
 	if ticket.Uuid != "3facfbc1-68e0-4b77-b0c6-87e66fcabcc2" {
 		t.Fatalf("Unexpected uuid: %+v", ticket)
 	}
+	if ticket.Sparse {
+		t.Fatalf("Unexpected sparse: %+v", ticket)
+	}
+	if ticket.DirtyBitmap != "" {
+		t.Fatalf("Unexpected dirty bitmap: %+v", ticket)
+	}
+}
+
+func TestParseTicketSparse(t *testing.T) {
+	text := `{
+		"mode": "w",
+		"size": 1024,
+		"timeout": 300,
+		"url": "file:///path",
+		"uuid": "3facfbc1-68e0-4b77-b0c6-87e66fcabcc2",
+		"sparse": true
+	}`
+	ticket, err := ParseTicket([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ticket.Sparse {
+		t.Fatalf("Unexpected sparse: %+v", ticket)
+	}
+}
+
+func TestParseTicketDirtyBitmap(t *testing.T) {
+	text := `{
+		"mode": "r",
+		"size": 1024,
+		"timeout": 300,
+		"url": "nbd:unix:/run/nbd.sock",
+		"uuid": "3facfbc1-68e0-4b77-b0c6-87e66fcabcc2",
+		"dirty_bitmap": "backup-1"
+	}`
+	ticket, err := ParseTicket([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticket.DirtyBitmap != "backup-1" {
+		t.Fatalf("Unexpected dirty bitmap: %+v", ticket)
+	}
+}
+
+func TestParseTicketFormat(t *testing.T) {
+	text := `{
+		"mode": "r",
+		"size": 1024,
+		"timeout": 300,
+		"url": "file:///path",
+		"uuid": "3facfbc1-68e0-4b77-b0c6-87e66fcabcc2",
+		"format": "qcow2"
+	}`
+	ticket, err := ParseTicket([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticket.Format != "qcow2" {
+		t.Fatalf("Unexpected format: %+v", ticket)
+	}
 }
 
 var invalidTickets = []struct {
@@ -80,6 +141,11 @@ var invalidTickets = []struct {
 		`{"mode": "rw", "size": 1024, "timeout": 300,
 		  "uuid": "3facfbc1-68e0-4b77-b0c6-87e66fcabcc2"}`,
 	},
+	{
+		"Invalid format",
+		`{"mode": "rw", "size": 1024, "timeout": 300, "url": "file:///path",
+		  "uuid": "3facfbc1-68e0-4b77-b0c6-87e66fcabcc2", "format": "vmdk"}`,
+	},
 	{
 		"Missing uuid",
 		`{"mode": "rw", "size": 1024, "timeout": 300, "url": "file:///path"}`,
@@ -94,3 +160,22 @@ func TestInvalidTicket(t *testing.T) {
 		}
 	}
 }
+
+var ticketOps = []struct {
+	mode string
+	ops  []string
+}{
+	{"r", []string{"read"}},
+	{"w", []string{"write"}},
+	{"rw", []string{"read", "write"}},
+}
+
+func TestTicketOps(t *testing.T) {
+	for _, test := range ticketOps {
+		ticket := &Ticket{Mode: test.mode}
+		ops := ticket.Ops()
+		if !reflect.DeepEqual(ops, test.ops) {
+			t.Errorf("Mode %q: expected %v, got %v", test.mode, test.ops, ops)
+		}
+	}
+}
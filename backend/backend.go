@@ -0,0 +1,277 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+// Package backend provides access to image data using a storage independent
+// interface. Backends are selected by the scheme of the ticket url, using a
+// registry of openers.
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"ovirt/imageio/fileio"
+)
+
+const (
+	bufsize = 8 * 1024 * 1024
+)
+
+// Backend provides access to an image.
+//
+// ReadAt and WriteAt follow the semantics of io.ReaderAt and io.WriterAt;
+// offset and size do not need to be aligned.
+type Backend interface {
+	io.ReaderAt
+	io.WriterAt
+
+	// Zero zeroes size bytes starting at offset.
+	Zero(ctx context.Context, offset int64, size int64) error
+
+	// Flush flushes data written to the backend to storage.
+	Flush(ctx context.Context) error
+
+	// Extents returns the extents of length bytes at offset. The first
+	// extent starts at offset.
+	Extents(ctx context.Context, offset int64, length int64) ([]Extent, error)
+
+	// Size returns the size of the image.
+	Size() (int64, error)
+
+	// Close releases the resources used by the backend.
+	Close() error
+}
+
+// Extent describes a range in an image.
+//
+// Zero is true if the range reads as zeros, and Hole is true if the range is
+// not allocated.
+type Extent struct {
+	Start  int64 `json:"start"`
+	Length int64 `json:"length"`
+	Zero   bool  `json:"zero"`
+	Hole   bool  `json:"hole"`
+}
+
+// DirtyExtent describes a range in an image that was modified, or not
+// modified, since a dirty bitmap was created.
+type DirtyExtent struct {
+	Start  int64 `json:"start"`
+	Length int64 `json:"length"`
+	Dirty  bool  `json:"dirty"`
+}
+
+// DirtyBackend is implemented by backends that can report dirty extents for
+// incremental backup.
+type DirtyBackend interface {
+	// DirtyExtents returns the dirty extents of length bytes at offset, using
+	// the dirty bitmap specified when opening the backend. The first extent
+	// starts at offset.
+	DirtyExtents(ctx context.Context, offset int64, length int64) ([]DirtyExtent, error)
+}
+
+// FeaturesBackend is implemented by backends supporting only some of the
+// images server features, like a backend proxying to a remote server.
+type FeaturesBackend interface {
+	// Features returns the names of the supported features.
+	Features(ctx context.Context) ([]string, error)
+}
+
+// OpenOptions control how a backend is opened.
+type OpenOptions struct {
+	// Writable is true if the backend is opened for writing.
+	Writable bool
+
+	// DirtyBitmap is the name of a dirty bitmap to use for DirtyExtents.
+	DirtyBitmap string
+
+	// Format is the image format, "raw" (default) or "qcow2". Only file
+	// backends support qcow2 images; other backends are always raw.
+	Format string
+}
+
+// Opener opens a backend for url u.
+type Opener func(u *url.URL, opts OpenOptions) (Backend, error)
+
+var openers = map[string]Opener{}
+
+// Register makes a backend available for urls with scheme. Register should
+// be called from init functions; it panics if scheme is already registered.
+func Register(scheme string, open Opener) {
+	if _, ok := openers[scheme]; ok {
+		panic("backend: Register called twice for scheme " + scheme)
+	}
+	openers[scheme] = open
+}
+
+// Supported returns true if a backend is registered for scheme.
+func Supported(scheme string) bool {
+	_, ok := openers[scheme]
+	return ok
+}
+
+// Keeper keeps resources for urls used by tickets, like images kept in
+// memory. Retain is called when a ticket using url u is added, and Release
+// when the ticket is removed.
+type Keeper interface {
+	Retain(u *url.URL)
+	Release(u *url.URL)
+}
+
+var keepers = map[string]Keeper{}
+
+// RegisterKeeper registers a keeper for urls with scheme. RegisterKeeper
+// should be called from init functions; it panics if scheme already has a
+// keeper.
+func RegisterKeeper(scheme string, k Keeper) {
+	if _, ok := keepers[scheme]; ok {
+		panic("backend: RegisterKeeper called twice for scheme " + scheme)
+	}
+	keepers[scheme] = k
+}
+
+// Retain tells the keeper for the url scheme that a ticket is using url u.
+// Does nothing for schemes without a keeper.
+func Retain(u *url.URL) {
+	if k, ok := keepers[u.Scheme]; ok {
+		k.Retain(u)
+	}
+}
+
+// Release tells the keeper for the url scheme that a ticket using url u was
+// removed. Does nothing for schemes without a keeper.
+func Release(u *url.URL) {
+	if k, ok := keepers[u.Scheme]; ok {
+		k.Release(u)
+	}
+}
+
+// Open opens a backend for url u, using the opener registered for the url
+// scheme.
+func Open(u *url.URL, opts OpenOptions) (Backend, error) {
+	open, ok := openers[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported scheme: %v", u.Scheme)
+	}
+	if opts.Format != "" && opts.Format != "raw" && u.Scheme != "file" {
+		return nil, fmt.Errorf("Unsupported format for %v urls: %v", u.Scheme, opts.Format)
+	}
+	return open(u, opts)
+}
+
+// Options describe a range to copy between a backend and a stream.
+type Options struct {
+	Offset int64
+	Size   int64
+
+	// Flush data to storage after receiving.
+	Flush bool
+
+	// Sparse allows backends supporting it to deallocate zero ranges when
+	// receiving. Backends not supporting it write zeros.
+	Sparse bool
+
+	// Progress is updated with the number of bytes copied.
+	Progress fileio.Progress
+}
+
+// Receiver is implemented by backends that can receive data from a reader
+// more efficiently than by calling WriteAt.
+type Receiver interface {
+	Receive(ctx context.Context, reader io.Reader, opts Options) error
+}
+
+// Sender is implemented by backends that can send data to a writer more
+// efficiently than by calling ReadAt.
+type Sender interface {
+	Send(ctx context.Context, writer io.Writer, opts Options) error
+}
+
+// Receive copies opts.Size bytes from reader to b, starting at opts.Offset.
+// Returns fileio.ErrCanceled if ctx is canceled before all the data was
+// copied. Cancellation is checked before each chunk is copied.
+func Receive(ctx context.Context, b Backend, reader io.Reader, opts Options) error {
+	if r, ok := b.(Receiver); ok {
+		return r.Receive(ctx, reader, opts)
+	}
+
+	buf := make([]byte, chunkSize(opts.Size))
+	var done int64
+
+	for done < opts.Size {
+		if ctx.Err() != nil {
+			return fileio.ErrCanceled
+		}
+		n := len(buf)
+		if opts.Size-done < int64(n) {
+			n = int(opts.Size - done)
+		}
+		if _, err := io.ReadFull(reader, buf[:n]); err != nil {
+			return err
+		}
+		if _, err := b.WriteAt(buf[:n], opts.Offset+done); err != nil {
+			return err
+		}
+		done += int64(n)
+		if opts.Progress != nil {
+			opts.Progress.Set(done)
+		}
+	}
+
+	if opts.Flush {
+		return b.Flush(ctx)
+	}
+	return nil
+}
+
+// Send copies opts.Size bytes from b to writer, starting at opts.Offset.
+// Returns io.ErrUnexpectedEOF if the backend is too short, and
+// fileio.ErrCanceled if ctx is canceled before all the data was copied.
+func Send(ctx context.Context, b Backend, writer io.Writer, opts Options) error {
+	if s, ok := b.(Sender); ok {
+		return s.Send(ctx, writer, opts)
+	}
+
+	buf := make([]byte, chunkSize(opts.Size))
+	var done int64
+
+	for done < opts.Size {
+		if ctx.Err() != nil {
+			return fileio.ErrCanceled
+		}
+		n := len(buf)
+		if opts.Size-done < int64(n) {
+			n = int(opts.Size - done)
+		}
+		got, err := b.ReadAt(buf[:n], opts.Offset+done)
+		if got < n {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if _, err = writer.Write(buf[:n]); err != nil {
+			return err
+		}
+		done += int64(n)
+		if opts.Progress != nil {
+			opts.Progress.Set(done)
+		}
+	}
+
+	return nil
+}
+
+// chunkSize returns the size of the buffer for copying size bytes.
+func chunkSize(size int64) int {
+	if size < bufsize {
+		return int(size)
+	}
+	return bufsize
+}
@@ -0,0 +1,190 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"ovirt/imageio/fileio"
+	"ovirt/imageio/testutil"
+	"testing"
+)
+
+// sliceBackend is a minimal backend using only the Backend interface, for
+// testing the generic copy functions.
+type sliceBackend struct {
+	data    []byte
+	flushed bool
+}
+
+func (b *sliceBackend) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(b.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (b *sliceBackend) WriteAt(p []byte, off int64) (int, error) {
+	return copy(b.data[off:], p), nil
+}
+
+func (b *sliceBackend) Zero(ctx context.Context, offset int64, size int64) error {
+	for i := offset; i < offset+size; i++ {
+		b.data[i] = 0
+	}
+	return nil
+}
+
+func (b *sliceBackend) Flush(ctx context.Context) error {
+	b.flushed = true
+	return nil
+}
+
+func (b *sliceBackend) Extents(ctx context.Context, offset int64, length int64) ([]Extent, error) {
+	return []Extent{{Start: offset, Length: length}}, nil
+}
+
+func (b *sliceBackend) Size() (int64, error) {
+	return int64(len(b.data)), nil
+}
+
+func (b *sliceBackend) Close() error {
+	return nil
+}
+
+type recordingProgress struct {
+	values []int64
+}
+
+func (p *recordingProgress) Set(value int64) {
+	p.values = append(p.values, value)
+}
+
+func TestRegister(t *testing.T) {
+	if Supported("test") {
+		t.Fatal("Scheme test supported before registering")
+	}
+	b := &sliceBackend{}
+	Register("test", func(u *url.URL, opts OpenOptions) (Backend, error) {
+		return b, nil
+	})
+	defer delete(openers, "test")
+
+	if !Supported("test") {
+		t.Fatal("Scheme test not supported after registering")
+	}
+	u, _ := url.Parse("test:image")
+	opened, err := Open(u, OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened != b {
+		t.Fatalf("Opened %v, expected %v", opened, b)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Registering file scheme twice did not panic")
+		}
+	}()
+	Register("file", OpenFile)
+}
+
+func TestOpenUnsupported(t *testing.T) {
+	u, _ := url.Parse("unknown:///image")
+	if _, err := Open(u, OpenOptions{}); err == nil {
+		t.Fatal("Opening unsupported scheme did not fail")
+	}
+}
+
+func TestReceiveGeneric(t *testing.T) {
+	b := &sliceBackend{data: make([]byte, 1000)}
+	buf := testutil.Buffer(500)
+	progress := &recordingProgress{}
+
+	err := Receive(context.Background(), b, bytes.NewReader(buf), Options{
+		Offset:   100,
+		Size:     500,
+		Flush:    true,
+		Progress: progress,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make([]byte, 1000)
+	copy(expected[100:], buf)
+	if !bytes.Equal(b.data, expected) {
+		t.Fatalf("Expected %v, got %v", expected, b.data)
+	}
+	if !b.flushed {
+		t.Fatal("Backend was not flushed")
+	}
+	if len(progress.values) == 0 || progress.values[len(progress.values)-1] != 500 {
+		t.Fatalf("Unexpected progress: %v", progress.values)
+	}
+}
+
+func TestReceiveGenericShortReader(t *testing.T) {
+	b := &sliceBackend{data: make([]byte, 1000)}
+	err := Receive(context.Background(), b, bytes.NewReader(make([]byte, 10)), Options{
+		Size: 500,
+	})
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestReceiveGenericCanceled(t *testing.T) {
+	b := &sliceBackend{data: make([]byte, 1000)}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := Receive(ctx, b, bytes.NewReader(make([]byte, 500)), Options{Size: 500})
+	if err != fileio.ErrCanceled {
+		t.Fatalf("Expected ErrCanceled, got %v", err)
+	}
+}
+
+func TestSendGeneric(t *testing.T) {
+	b := &sliceBackend{data: testutil.Buffer(1000)}
+	var out bytes.Buffer
+	progress := &recordingProgress{}
+
+	err := Send(context.Background(), b, &out, Options{
+		Offset:   100,
+		Size:     500,
+		Progress: progress,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), b.data[100:600]) {
+		t.Fatalf("Expected %v, got %v", b.data[100:600], out.Bytes())
+	}
+	if len(progress.values) == 0 || progress.values[len(progress.values)-1] != 500 {
+		t.Fatalf("Unexpected progress: %v", progress.values)
+	}
+}
+
+func TestSendGenericShortBackend(t *testing.T) {
+	b := &sliceBackend{data: make([]byte, 1000)}
+	var out bytes.Buffer
+	err := Send(context.Background(), b, &out, Options{Offset: 900, Size: 200})
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
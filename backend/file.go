@@ -0,0 +1,107 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"ovirt/imageio/fileio"
+)
+
+func init() {
+	Register("file", OpenFile)
+}
+
+// File is a backend for files and block devices, using the fileio package.
+type File struct {
+	path string
+	file *fileio.File
+}
+
+// OpenFile opens a file backend for url u, using u.Path. If opts.Format is
+// "qcow2", the file is opened as a qcow2 image.
+func OpenFile(u *url.URL, opts OpenOptions) (Backend, error) {
+	switch opts.Format {
+	case "", "raw":
+	case "qcow2":
+		return OpenQcow2(u.Path, opts)
+	default:
+		return nil, fmt.Errorf("Unsupported format: %v", opts.Format)
+	}
+	flag := os.O_RDONLY
+	if opts.Writable {
+		flag = os.O_RDWR
+	}
+	file, err := fileio.Open(u.Path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &File{path: u.Path, file: file}, nil
+}
+
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	return fileio.ReadAt(f.file, p, off)
+}
+
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	return fileio.WriteAt(f.file, p, off)
+}
+
+func (f *File) Zero(ctx context.Context, offset int64, size int64) error {
+	return fileio.ZeroContext(ctx, f.path, size, offset, false)
+}
+
+func (f *File) Flush(ctx context.Context) error {
+	return fileio.FlushContext(ctx, f.path)
+}
+
+func (f *File) Extents(ctx context.Context, offset int64, length int64) ([]Extent, error) {
+	extents, err := fileio.ExtentsAt(ctx, f.path, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Extent, len(extents))
+	for i, e := range extents {
+		res[i] = Extent{e.Start, e.Length, e.Zero, e.Hole}
+	}
+	return res, nil
+}
+
+func (f *File) Size() (int64, error) {
+	return f.file.Seek(0, os.SEEK_END)
+}
+
+func (f *File) Close() error {
+	return f.file.Close()
+}
+
+// Receive receives data using fileio, supporting sparse mode.
+func (f *File) Receive(ctx context.Context, reader io.Reader, opts Options) error {
+	return fileio.NewReceive(ctx, reader, fileio.Options{
+		Path:     f.path,
+		Offset:   opts.Offset,
+		Size:     opts.Size,
+		Flush:    opts.Flush,
+		Sparse:   opts.Sparse,
+		Progress: opts.Progress,
+	}).Run()
+}
+
+// Send sends data using fileio.
+func (f *File) Send(ctx context.Context, writer io.Writer, opts Options) error {
+	return fileio.NewSend(ctx, writer, fileio.Options{
+		Path:     f.path,
+		Offset:   opts.Offset,
+		Size:     opts.Size,
+		Progress: opts.Progress,
+	}).Run()
+}
@@ -0,0 +1,170 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"ovirt/imageio/testutil"
+	"testing"
+)
+
+func openTestFile(t *testing.T, path string, writable bool) Backend {
+	u := &url.URL{Scheme: "file", Path: path}
+	b, err := Open(u, OpenOptions{Writable: writable})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestFileReadWrite(t *testing.T) {
+	path, err := testutil.CreateFile(4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	b := openTestFile(t, path, true)
+	defer b.Close()
+
+	buf := testutil.Buffer(1000)
+	if _, err = b.WriteAt(buf, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	res := make([]byte, 1000)
+	if _, err = b.ReadAt(res, 100); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, buf) {
+		t.Fatalf("Expected %v, got %v", buf, res)
+	}
+
+	size, err := b.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 4096 {
+		t.Fatalf("Size %v, expected 4096", size)
+	}
+}
+
+func TestFileReadOnly(t *testing.T) {
+	path, err := testutil.CreateFile(4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	b := openTestFile(t, path, false)
+	defer b.Close()
+
+	if _, err = b.WriteAt(make([]byte, 512), 0); err == nil {
+		t.Fatal("Writing to read only backend did not fail")
+	}
+}
+
+func TestFileZero(t *testing.T) {
+	const size = 8192
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	content := bytes.Repeat([]byte{1}, size)
+	if err = ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	b := openTestFile(t, path, true)
+	defer b.Close()
+
+	ctx := context.Background()
+	if err = b.Zero(ctx, 100, 5000); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 100; i < 5100; i++ {
+		content[i] = 0
+	}
+	res, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, content) {
+		t.Fatalf("Expected %v, got %v", content, res)
+	}
+}
+
+func TestFileExtents(t *testing.T) {
+	const size = 1024 * 1024
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	b := openTestFile(t, path, false)
+	defer b.Close()
+
+	extents, err := b.Extents(context.Background(), 0, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := int64(0)
+	for _, e := range extents {
+		if e.Start != pos {
+			t.Fatalf("Extent %+v does not start at %v", e, pos)
+		}
+		pos += e.Length
+	}
+	if pos != size {
+		t.Fatalf("Extents cover %v bytes, expected %v: %+v", pos, size, extents)
+	}
+}
+
+func TestFileReceiveSend(t *testing.T) {
+	const size = 1024 * 1024
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	b := openTestFile(t, path, true)
+	defer b.Close()
+
+	ctx := context.Background()
+	buf := testutil.Buffer(size - 1000)
+	err = Receive(ctx, b, bytes.NewReader(buf), Options{
+		Offset: 500,
+		Size:   int64(len(buf)),
+		Flush:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	err = Send(ctx, b, &out, Options{Offset: 500, Size: int64(len(buf))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), buf) {
+		t.Fatal("Data sent does not match data received")
+	}
+}
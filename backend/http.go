@@ -0,0 +1,397 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"ovirt/imageio/fileio"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Connections kept alive to each remote server. This matches the number
+	// of connections the images server recommends to clients.
+	maxIdleConns = 8
+
+	// Error responses are small; no need to read more.
+	maxErrorSize = 4096
+)
+
+func init() {
+	Register("http", OpenHTTP)
+	Register("https", OpenHTTP)
+}
+
+// httpClient is shared by all HTTP backends, so connections to remote
+// servers are kept alive between requests.
+var httpClient = &http.Client{Transport: newTransport(nil)}
+
+func newTransport(config *tls.Config) *http.Transport {
+	return &http.Transport{
+		MaxIdleConnsPerHost: maxIdleConns,
+		IdleConnTimeout:     60 * time.Second,
+		TLSClientConfig:     config,
+	}
+}
+
+// SetCAFile configures HTTP backends to verify https remote servers using the
+// PEM encoded CA certificates in path, instead of the system CAs. If path is
+// empty, the system CAs are used. Must be called before opening HTTP
+// backends.
+func SetCAFile(path string) error {
+	var config *tls.Config
+	if path != "" {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return fmt.Errorf("No CA certificates in %q", path)
+		}
+		config = &tls.Config{RootCAs: pool}
+	}
+	old := httpClient.Transport.(*http.Transport)
+	httpClient.Transport = newTransport(config)
+	old.CloseIdleConnections()
+	return nil
+}
+
+// HTTP is a backend proxying requests to a remote images server. The url is
+// the remote image url, like https://host:54322/images/{ticket}.
+//
+// Data is streamed to and from the remote server without buffering.
+type HTTP struct {
+	url *url.URL
+}
+
+// OpenHTTP opens a HTTP backend for url u. No request is sent until the
+// backend is used.
+func OpenHTTP(u *url.URL, opts OpenOptions) (Backend, error) {
+	remote := *u
+	return &HTTP{url: &remote}, nil
+}
+
+func (b *HTTP) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	resp, err := b.get(context.Background(), off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	defer closeBody(resp)
+
+	n, err := io.ReadFull(resp.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (b *HTTP) WriteAt(p []byte, off int64) (int, error) {
+	err := b.put(context.Background(), bytes.NewReader(p), off, int64(len(p)), false)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (b *HTTP) Zero(ctx context.Context, offset int64, size int64) error {
+	req := map[string]interface{}{
+		"op":     "zero",
+		"offset": offset,
+		"size":   size,
+		"flush":  false,
+	}
+	return b.patch(ctx, req)
+}
+
+func (b *HTTP) Flush(ctx context.Context) error {
+	return b.patch(ctx, map[string]interface{}{"op": "flush"})
+}
+
+// Extents returns the extents reported by the remote server. The server
+// reports the extents of the entire image, so they are clipped to the
+// requested range.
+func (b *HTTP) Extents(ctx context.Context, offset int64, length int64) ([]Extent, error) {
+	var extents []Extent
+	if err := b.getExtents(ctx, "zero", &extents); err != nil {
+		return nil, err
+	}
+	res := []Extent{}
+	for _, e := range extents {
+		if start, stop := clip(e.Start, e.Length, offset, offset+length); start < stop {
+			res = append(res, Extent{start, stop - start, e.Zero, e.Hole})
+		}
+	}
+	return res, nil
+}
+
+// DirtyExtents returns the dirty extents reported by the remote server,
+// clipped to the requested range.
+func (b *HTTP) DirtyExtents(ctx context.Context, offset int64, length int64) ([]DirtyExtent, error) {
+	var extents []DirtyExtent
+	if err := b.getExtents(ctx, "dirty", &extents); err != nil {
+		return nil, err
+	}
+	res := []DirtyExtent{}
+	for _, e := range extents {
+		if start, stop := clip(e.Start, e.Length, offset, offset+length); start < stop {
+			res = append(res, DirtyExtent{start, stop - start, e.Dirty})
+		}
+	}
+	return res, nil
+}
+
+// Size returns the size of the remote image, using the total size reported
+// in the Content-Range header.
+func (b *HTTP) Size() (int64, error) {
+	resp, err := b.get(context.Background(), 0, 1)
+	if err != nil {
+		return 0, err
+	}
+	defer closeBody(resp)
+
+	s := resp.Header.Get("Content-Range")
+	i := strings.LastIndex(s, "/")
+	if i == -1 {
+		return 0, fmt.Errorf("Invalid Content-Range: %q", s)
+	}
+	size, err := strconv.ParseInt(s[i+1:], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid Content-Range: %q", s)
+	}
+	return size, nil
+}
+
+func (b *HTTP) Close() error {
+	return nil
+}
+
+// Features returns the features supported by the remote server for the
+// ticket.
+func (b *HTTP) Features(ctx context.Context) ([]string, error) {
+	resp, err := b.do(ctx, "OPTIONS", b.url, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(resp)
+
+	var options struct {
+		Features []string `json:"features"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&options); err != nil {
+		return nil, err
+	}
+	return options.Features, nil
+}
+
+// Receive streams data from reader to the remote server in a single PUT
+// request.
+func (b *HTTP) Receive(ctx context.Context, reader io.Reader, opts Options) error {
+	body := &progressReader{r: io.LimitReader(reader, opts.Size), progress: opts.Progress}
+	return b.put(ctx, body, opts.Offset, opts.Size, opts.Flush)
+}
+
+// Send streams data from the remote server to writer using a single GET
+// request. No more than opts.Size bytes are sent, even if the remote server
+// sends more data.
+func (b *HTTP) Send(ctx context.Context, writer io.Writer, opts Options) error {
+	if opts.Size == 0 {
+		return nil
+	}
+	resp, err := b.get(ctx, opts.Offset, opts.Size)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+
+	body := &progressReader{r: resp.Body, progress: opts.Progress}
+	_, err = io.CopyN(writer, body, opts.Size)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return canceled(ctx, err)
+	}
+	return nil
+}
+
+// get sends a GET request for length bytes at offset. If the range is after
+// the end of the remote image, io.EOF is returned. The remote server must
+// return a partial response; a server ignoring the Range header would send
+// the wrong data.
+func (b *HTTP) get(ctx context.Context, offset int64, length int64) (*http.Response, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := b.do(ctx, "GET", b.url, header, nil)
+	if err == errRangeNotSatisfiable {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		closeBody(resp)
+		return nil, fmt.Errorf("Remote server did not return a partial response: %v", resp.Status)
+	}
+	return resp, nil
+}
+
+func (b *HTTP) put(ctx context.Context, body io.Reader, offset int64, length int64, flush bool) error {
+	u := *b.url
+	q := u.Query()
+	if flush {
+		q.Set("flush", "y")
+	} else {
+		q.Set("flush", "n")
+	}
+	u.RawQuery = q.Encode()
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", offset, offset+length-1))
+
+	req, err := http.NewRequest("PUT", u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = length
+	if length == 0 {
+		// The remote server rejects an empty Content-Range.
+		header.Del("Content-Range")
+		req.Body = http.NoBody
+	}
+	req.Header = header
+
+	resp, err := b.send(ctx, req)
+	if err != nil {
+		return err
+	}
+	closeBody(resp)
+	return nil
+}
+
+func (b *HTTP) patch(ctx context.Context, msg interface{}) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	resp, err := b.do(ctx, "PATCH", b.url, header, buf)
+	if err != nil {
+		return err
+	}
+	closeBody(resp)
+	return nil
+}
+
+// clip returns the part of the range start, length inside offset, end.
+func clip(start int64, length int64, offset int64, end int64) (int64, int64) {
+	stop := start + length
+	if start < offset {
+		start = offset
+	}
+	if stop > end {
+		stop = end
+	}
+	return start, stop
+}
+
+func (b *HTTP) getExtents(ctx context.Context, name string, v interface{}) error {
+	u := *b.url
+	u.Path += "/extents"
+	u.RawQuery = "context=" + name
+	resp, err := b.do(ctx, "GET", &u, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (b *HTTP) do(ctx context.Context, method string, u *url.URL, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		req.Body = http.NoBody
+		req.ContentLength = 0
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return b.send(ctx, req)
+}
+
+var errRangeNotSatisfiable = errors.New("Requested range not satisfiable")
+
+// send sends req, returning an error if the remote server failed the
+// request.
+func (b *HTTP) send(ctx context.Context, req *http.Request) (*http.Response, error) {
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, canceled(ctx, err)
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer closeBody(resp)
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return nil, errRangeNotSatisfiable
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorSize))
+	return nil, fmt.Errorf("Remote server error: %v: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// closeBody drains and closes the response body, so the connection can be
+// reused.
+func closeBody(resp *http.Response) {
+	io.CopyN(ioutil.Discard, resp.Body, maxErrorSize)
+	resp.Body.Close()
+}
+
+// canceled returns fileio.ErrCanceled if err was caused by canceling ctx.
+func canceled(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return fileio.ErrCanceled
+	}
+	return err
+}
+
+// progressReader reports the number of bytes read.
+type progressReader struct {
+	r        io.Reader
+	progress fileio.Progress
+	done     int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.done += int64(n)
+	if r.progress != nil && n > 0 {
+		r.progress.Set(r.done)
+	}
+	return n, err
+}
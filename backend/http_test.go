@@ -0,0 +1,422 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"ovirt/imageio/testutil"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeImages serves a single image in memory using the images server
+// protocol.
+type fakeImages struct {
+	mutex   sync.Mutex
+	data    []byte
+	flushes int
+	status  int
+
+	// ignoreRange sends the entire image, like a server not supporting
+	// ranges.
+	ignoreRange bool
+}
+
+func (f *fakeImages) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.status != 0 {
+		http.Error(w, "Injected error", f.status)
+		return
+	}
+
+	size := int64(len(f.data))
+
+	switch {
+	case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/extents"):
+		var extents interface{}
+		if r.URL.Query().Get("context") == "dirty" {
+			extents = []DirtyExtent{{Start: 0, Length: size, Dirty: true}}
+		} else {
+			extents = []Extent{{Start: 0, Length: size}}
+		}
+		json.NewEncoder(w).Encode(extents)
+
+	case r.Method == "GET" && f.ignoreRange:
+		w.Write(f.data)
+
+	case r.Method == "GET":
+		var start, end int64
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if start >= size {
+			http.Error(w, "Out of range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if end >= size {
+			end = size - 1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		w.Header().Set("Content-Length", fmt.Sprint(end-start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(f.data[start : end+1])
+
+	case r.Method == "PUT":
+		start := int64(0)
+		if s := r.Header.Get("Content-Range"); s != "" {
+			var end int64
+			if _, err := fmt.Sscanf(s, "bytes %d-%d/*", &start, &end); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if _, err := io.ReadFull(r.Body, f.data[start:start+r.ContentLength]); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("flush") != "n" {
+			f.flushes++
+		}
+
+	case r.Method == "PATCH":
+		var req struct {
+			Op     string
+			Offset int64
+			Size   int64
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch req.Op {
+		case "zero":
+			copy(f.data[req.Offset:req.Offset+req.Size], make([]byte, req.Size))
+		case "flush":
+			f.flushes++
+		}
+
+	case r.Method == "OPTIONS":
+		w.Write([]byte(`{"features": ["zero", "flush"], "ops": ["read", "write"]}`))
+	}
+}
+
+func startFakeImages(t *testing.T, f *fakeImages) (*httptest.Server, Backend) {
+	server := httptest.NewServer(f)
+	u, err := url.Parse(server.URL + "/images/remote-ticket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Open(u, OpenOptions{Writable: true})
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return server, b
+}
+
+func TestHTTPReadWrite(t *testing.T) {
+	f := &fakeImages{data: make([]byte, 8192)}
+	server, b := startFakeImages(t, f)
+	defer server.Close()
+	defer b.Close()
+
+	buf := testutil.Buffer(1000)
+	if _, err := b.WriteAt(buf, 100); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(f.data[100:1100], buf) {
+		t.Fatal("Remote data does not match data written")
+	}
+
+	res := make([]byte, 1000)
+	if _, err := b.ReadAt(res, 100); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, buf) {
+		t.Fatal("Data read does not match data written")
+	}
+}
+
+func TestHTTPReadEOF(t *testing.T) {
+	f := &fakeImages{data: testutil.Buffer(1000)}
+	server, b := startFakeImages(t, f)
+	defer server.Close()
+	defer b.Close()
+
+	res := make([]byte, 100)
+	n, err := b.ReadAt(res, 950)
+	if err != io.EOF {
+		t.Fatalf("Expected io.EOF, got %v", err)
+	}
+	if n != 50 || !bytes.Equal(res[:n], f.data[950:]) {
+		t.Fatalf("Unexpected data read: %v", res[:n])
+	}
+
+	n, err = b.ReadAt(res, 1000)
+	if n != 0 || err != io.EOF {
+		t.Fatalf("Expected 0 bytes and io.EOF, got %v bytes and %v", n, err)
+	}
+}
+
+func TestHTTPSize(t *testing.T) {
+	server, b := startFakeImages(t, &fakeImages{data: make([]byte, 12345)})
+	defer server.Close()
+	defer b.Close()
+
+	size, err := b.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 12345 {
+		t.Fatalf("Size %v, expected 12345", size)
+	}
+}
+
+func TestHTTPZeroFlush(t *testing.T) {
+	f := &fakeImages{data: bytes.Repeat([]byte{1}, 8192)}
+	server, b := startFakeImages(t, f)
+	defer server.Close()
+	defer b.Close()
+
+	ctx := context.Background()
+	if err := b.Zero(ctx, 100, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := bytes.Repeat([]byte{1}, 8192)
+	copy(expected[100:1100], make([]byte, 1000))
+	if !bytes.Equal(f.data, expected) {
+		t.Fatal("Range was not zeroed")
+	}
+	if f.flushes != 1 {
+		t.Fatalf("Remote flushed %v times, expected 1", f.flushes)
+	}
+}
+
+func TestHTTPExtents(t *testing.T) {
+	server, b := startFakeImages(t, &fakeImages{data: make([]byte, 8192)})
+	defer server.Close()
+	defer b.Close()
+
+	ctx := context.Background()
+	extents, err := b.Extents(ctx, 0, 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(extents, []Extent{{Start: 0, Length: 8192}}) {
+		t.Fatalf("Unexpected extents: %+v", extents)
+	}
+
+	dirty, err := b.(DirtyBackend).DirtyExtents(ctx, 0, 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dirty, []DirtyExtent{{Start: 0, Length: 8192, Dirty: true}}) {
+		t.Fatalf("Unexpected dirty extents: %+v", dirty)
+	}
+}
+
+func TestHTTPFeatures(t *testing.T) {
+	server, b := startFakeImages(t, &fakeImages{data: make([]byte, 8192)})
+	defer server.Close()
+	defer b.Close()
+
+	features, err := b.(FeaturesBackend).Features(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(features, []string{"zero", "flush"}) {
+		t.Fatalf("Unexpected features: %v", features)
+	}
+}
+
+func TestHTTPReceiveSend(t *testing.T) {
+	f := &fakeImages{data: make([]byte, 1024*1024)}
+	server, b := startFakeImages(t, f)
+	defer server.Close()
+	defer b.Close()
+
+	ctx := context.Background()
+	buf := testutil.Buffer(500000)
+	progress := &recordingProgress{}
+	err := Receive(ctx, b, bytes.NewReader(buf), Options{
+		Offset:   1000,
+		Size:     int64(len(buf)),
+		Flush:    true,
+		Progress: progress,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(f.data[1000:501000], buf) {
+		t.Fatal("Remote data does not match data received")
+	}
+	if f.flushes != 1 {
+		t.Fatalf("Remote flushed %v times, expected 1", f.flushes)
+	}
+	if progress.values[len(progress.values)-1] != int64(len(buf)) {
+		t.Fatalf("Unexpected progress: %v", progress.values)
+	}
+
+	var out bytes.Buffer
+	err = Send(ctx, b, &out, Options{Offset: 1000, Size: int64(len(buf))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), buf) {
+		t.Fatal("Data sent does not match data received")
+	}
+}
+
+func TestHTTPSendShort(t *testing.T) {
+	server, b := startFakeImages(t, &fakeImages{data: make([]byte, 1000)})
+	defer server.Close()
+	defer b.Close()
+
+	var out bytes.Buffer
+	err := Send(context.Background(), b, &out, Options{Offset: 500, Size: 1000})
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestHTTPSendIgnoredRange(t *testing.T) {
+	f := &fakeImages{data: testutil.Buffer(8192), ignoreRange: true}
+	server, b := startFakeImages(t, f)
+	defer server.Close()
+	defer b.Close()
+
+	// Sending the entire image would send the wrong data, and more data than
+	// the client expects.
+	var out bytes.Buffer
+	err := Send(context.Background(), b, &out, Options{Offset: 1000, Size: 1000})
+	if err == nil {
+		t.Fatal("Ignoring the Range header was not detected")
+	}
+	if out.Len() != 0 {
+		t.Fatalf("Sent %v bytes", out.Len())
+	}
+	if _, err := b.ReadAt(make([]byte, 1000), 1000); err == nil {
+		t.Fatal("Ignoring the Range header was not detected")
+	}
+}
+
+func TestHTTPCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(&fakeImages{data: testutil.Buffer(8192)})
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL + "/images/remote-ticket")
+	b, err := Open(u, OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// The test server certificate is not signed by the system CAs.
+	if _, err := b.ReadAt(make([]byte, 512), 0); err == nil {
+		t.Fatal("Unknown server certificate was accepted")
+	}
+
+	f, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	f.Close()
+
+	if err := SetCAFile(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	defer SetCAFile("")
+
+	if _, err := b.ReadAt(make([]byte, 512), 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPCAFileInvalid(t *testing.T) {
+	if err := SetCAFile("/no/such/file"); err == nil {
+		t.Fatal("Missing CA file did not fail")
+	}
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	if err := SetCAFile(path); err == nil {
+		t.Fatal("CA file without certificates did not fail")
+	}
+}
+
+func TestHTTPRemoteError(t *testing.T) {
+	f := &fakeImages{data: make([]byte, 1000), status: http.StatusForbidden}
+	server, b := startFakeImages(t, f)
+	defer server.Close()
+	defer b.Close()
+
+	if _, err := b.WriteAt(make([]byte, 100), 0); err == nil {
+		t.Fatal("Remote error was not reported")
+	}
+	if err := b.Flush(context.Background()); err == nil {
+		t.Fatal("Remote error was not reported")
+	}
+}
+
+func TestHTTPKeepAlive(t *testing.T) {
+	f := &fakeImages{data: make([]byte, 8192)}
+	server := httptest.NewUnstartedServer(f)
+	var conns int32
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL + "/images/remote-ticket")
+	for i := 0; i < 5; i++ {
+		b, err := Open(u, OpenOptions{Writable: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = b.WriteAt(make([]byte, 512), int64(i*512)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = b.ReadAt(make([]byte, 512), int64(i*512)); err != nil {
+			t.Fatal(err)
+		}
+		b.Close()
+	}
+
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("Opened %v connections, expected 1", n)
+	}
+}
@@ -0,0 +1,302 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"ovirt/imageio/fileio"
+	"strconv"
+	"sync"
+)
+
+const (
+	// Memory images allocate chunks of this size when data is written.
+	// Chunks never written or zeroed are not allocated, and read as zeros.
+	memoryChunk = 64 * 1024
+)
+
+func init() {
+	Register("memory", OpenMemory)
+	RegisterKeeper("memory", memoryKeeper{})
+}
+
+// memoryImage keeps image data in a sparse map of chunks.
+type memoryImage struct {
+	mutex  sync.Mutex
+	size   int64
+	chunks map[int64][]byte
+}
+
+var (
+	memoryMutex  sync.Mutex
+	memoryImages = map[string]*memoryImage{}
+
+	// Number of tickets using an image name.
+	memoryRefs = map[string]int{}
+)
+
+// Memory is a backend keeping image data in memory, for testing and for
+// ephemeral scratch images.
+//
+// Images are named by the url, and live until removed by RemoveMemory, so
+// image data is available to all backends opened for the same url. Images
+// used by tickets are removed when the last ticket using the image is
+// removed.
+type Memory struct {
+	image *memoryImage
+}
+
+// OpenMemory opens a memory backend for url u, like memory://name?size=N.
+// The image is created on the first open, using the size query parameter.
+// If size is not specified, the image starts empty and grows when written.
+func OpenMemory(u *url.URL, opts OpenOptions) (Backend, error) {
+	name := memoryName(u)
+	if name == "" {
+		return nil, fmt.Errorf("Invalid memory url: %v", u)
+	}
+
+	var size int64
+	if s := u.Query().Get("size"); s != "" {
+		var err error
+		size, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("Invalid memory image size: %q", s)
+		}
+	}
+
+	memoryMutex.Lock()
+	defer memoryMutex.Unlock()
+	image := memoryImages[name]
+	if image == nil {
+		image = &memoryImage{size: size, chunks: map[int64][]byte{}}
+		memoryImages[name] = image
+	}
+	return &Memory{image: image}, nil
+}
+
+// RemoveMemory removes the memory image for url u, releasing its memory.
+func RemoveMemory(u *url.URL) {
+	memoryMutex.Lock()
+	defer memoryMutex.Unlock()
+	delete(memoryImages, memoryName(u))
+}
+
+// memoryKeeper removes memory images when the last ticket using the image
+// is removed.
+type memoryKeeper struct{}
+
+func (memoryKeeper) Retain(u *url.URL) {
+	memoryMutex.Lock()
+	defer memoryMutex.Unlock()
+	memoryRefs[memoryName(u)]++
+}
+
+func (memoryKeeper) Release(u *url.URL) {
+	memoryMutex.Lock()
+	defer memoryMutex.Unlock()
+	name := memoryName(u)
+	if memoryRefs[name]--; memoryRefs[name] > 0 {
+		return
+	}
+	delete(memoryRefs, name)
+	delete(memoryImages, name)
+}
+
+// memoryName returns the name of the memory image for url u. Urls with the
+// same name share the same image.
+func memoryName(u *url.URL) string {
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+	return u.Host + u.Path
+}
+
+func (m *Memory) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("Negative offset: %v", off)
+	}
+	img := m.image
+	img.mutex.Lock()
+	defer img.mutex.Unlock()
+
+	if off >= img.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > img.size {
+		end = img.size
+	}
+
+	for pos := off; pos < end; {
+		index, start, n := img.chunkRange(pos, end)
+		dst := p[pos-off : pos-off+n]
+		if chunk, ok := img.chunks[index]; ok {
+			copy(dst, chunk[start:start+n])
+		} else {
+			zeroBytes(dst)
+		}
+		pos += n
+	}
+
+	if n := int(end - off); n < len(p) {
+		return n, io.EOF
+	}
+	return len(p), nil
+}
+
+// WriteAt writes p at offset off, extending the image if needed. Writing
+// zeros to unallocated chunks does not allocate them.
+func (m *Memory) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || int64(len(p)) > math.MaxInt64-off {
+		return 0, fmt.Errorf("Invalid range: offset=%v size=%v", off, len(p))
+	}
+	img := m.image
+	img.mutex.Lock()
+	defer img.mutex.Unlock()
+
+	end := off + int64(len(p))
+	for pos := off; pos < end; {
+		index, start, n := img.chunkRange(pos, end)
+		src := p[pos-off : pos-off+n]
+		chunk, ok := img.chunks[index]
+		if !ok {
+			if allZero(src) {
+				pos += n
+				continue
+			}
+			chunk = make([]byte, memoryChunk)
+			img.chunks[index] = chunk
+		}
+		copy(chunk[start:], src)
+		pos += n
+	}
+
+	if end > img.size {
+		img.size = end
+	}
+	return len(p), nil
+}
+
+// Zero zeroes size bytes at offset, deallocating entire chunks, and
+// extending the image if needed.
+func (m *Memory) Zero(ctx context.Context, offset int64, size int64) error {
+	if offset < 0 || size < 0 || size > math.MaxInt64-offset {
+		return fmt.Errorf("Invalid range: offset=%v size=%v", offset, size)
+	}
+	if ctx.Err() != nil {
+		return fileio.ErrCanceled
+	}
+	img := m.image
+	img.mutex.Lock()
+	defer img.mutex.Unlock()
+
+	end := offset + size
+	for pos := offset; pos < end; {
+		index, start, n := img.chunkRange(pos, end)
+		if n == memoryChunk {
+			delete(img.chunks, index)
+		} else if chunk, ok := img.chunks[index]; ok {
+			zeroBytes(chunk[start : start+n])
+		}
+		pos += n
+	}
+
+	if end > img.size {
+		img.size = end
+	}
+	return nil
+}
+
+// Flush does nothing; memory images are not persistent.
+func (m *Memory) Flush(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return fileio.ErrCanceled
+	}
+	return nil
+}
+
+// Extents reports allocated chunks as data, and unallocated chunks, and the
+// range after the end of the image, as holes.
+func (m *Memory) Extents(ctx context.Context, offset int64, length int64) ([]Extent, error) {
+	if ctx.Err() != nil {
+		return nil, fileio.ErrCanceled
+	}
+	img := m.image
+	img.mutex.Lock()
+	defer img.mutex.Unlock()
+
+	extents := []Extent{}
+	add := func(start int64, end int64, hole bool) {
+		if n := len(extents); n > 0 && extents[n-1].Hole == hole {
+			extents[n-1].Length += end - start
+			return
+		}
+		extents = append(extents, Extent{start, end - start, hole, hole})
+	}
+
+	end := offset + length
+	for pos := offset; pos < end; {
+		index, _, n := img.chunkRange(pos, end)
+		next := pos + n
+		if _, ok := img.chunks[index]; ok && pos < img.size {
+			if next > img.size {
+				next = img.size
+			}
+			add(pos, next, false)
+		} else {
+			add(pos, next, true)
+		}
+		pos = next
+	}
+
+	return extents, nil
+}
+
+func (m *Memory) Size() (int64, error) {
+	img := m.image
+	img.mutex.Lock()
+	defer img.mutex.Unlock()
+	return img.size, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// chunkRange returns the index of the chunk containing pos, the offset of
+// pos in the chunk, and the number of bytes from pos to end or to the end of
+// the chunk.
+func (img *memoryImage) chunkRange(pos int64, end int64) (int64, int64, int64) {
+	index := pos / memoryChunk
+	start := pos % memoryChunk
+	n := memoryChunk - start
+	if end-pos < n {
+		n = end - pos
+	}
+	return index, start, n
+}
+
+func allZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
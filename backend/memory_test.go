@@ -0,0 +1,252 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"net/url"
+	"ovirt/imageio/testutil"
+	"reflect"
+	"testing"
+)
+
+func openTestMemory(t *testing.T, rawurl string) (*url.URL, Backend) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Open(u, OpenOptions{Writable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, b
+}
+
+func TestMemoryOpenInvalid(t *testing.T) {
+	for _, s := range []string{"memory://", "memory://name?size=-1", "memory://name?size=x"} {
+		u, _ := url.Parse(s)
+		if _, err := Open(u, OpenOptions{}); err == nil {
+			t.Fatalf("Opening %q did not fail", s)
+		}
+	}
+}
+
+func TestMemoryReadWrite(t *testing.T) {
+	u, b := openTestMemory(t, "memory://read-write?size=200000")
+	defer RemoveMemory(u)
+	defer b.Close()
+
+	if size, err := b.Size(); err != nil || size != 200000 {
+		t.Fatalf("Expected size 200000, got %v (err=%v)", size, err)
+	}
+
+	// Write crossing chunk boundaries.
+	buf := testutil.Buffer(100000)
+	if n, err := b.WriteAt(buf, 50000); err != nil || n != len(buf) {
+		t.Fatalf("Write failed: n=%v err=%v", n, err)
+	}
+
+	// Data is shared by all backends opened for the same url.
+	_, other := openTestMemory(t, "memory://read-write")
+	defer other.Close()
+
+	res := make([]byte, 200000)
+	if n, err := other.ReadAt(res, 0); err != nil || n != len(res) {
+		t.Fatalf("Read failed: n=%v err=%v", n, err)
+	}
+	if !bytes.Equal(res[:50000], make([]byte, 50000)) {
+		t.Fatal("Unwritten data is not zero")
+	}
+	if !bytes.Equal(res[50000:150000], buf) {
+		t.Fatal("Data read does not match data written")
+	}
+	if !bytes.Equal(res[150000:], make([]byte, 50000)) {
+		t.Fatal("Unwritten data is not zero")
+	}
+}
+
+func TestMemoryReadEOF(t *testing.T) {
+	u, b := openTestMemory(t, "memory://read-eof?size=1000")
+	defer RemoveMemory(u)
+	defer b.Close()
+
+	buf := make([]byte, 4096)
+	n, err := b.ReadAt(buf, 0)
+	if err != io.EOF || n != 1000 {
+		t.Fatalf("Expected 1000 bytes and EOF, got %v (err=%v)", n, err)
+	}
+	if _, err := b.ReadAt(buf, 1000); err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+}
+
+func TestMemoryInvalidRange(t *testing.T) {
+	u, b := openTestMemory(t, "memory://invalid-range?size=1000")
+	defer RemoveMemory(u)
+	defer b.Close()
+
+	buf := make([]byte, 256)
+	if _, err := b.ReadAt(buf, -256); err == nil {
+		t.Fatal("Reading at negative offset did not fail")
+	}
+	if _, err := b.WriteAt(buf, -256); err == nil {
+		t.Fatal("Writing at negative offset did not fail")
+	}
+	if _, err := b.WriteAt(buf, math.MaxInt64-100); err == nil {
+		t.Fatal("Writing after maximum size did not fail")
+	}
+	ctx := context.Background()
+	if err := b.Zero(ctx, -256, 256); err == nil {
+		t.Fatal("Zeroing at negative offset did not fail")
+	}
+	if err := b.Zero(ctx, 0, -1); err == nil {
+		t.Fatal("Zeroing negative size did not fail")
+	}
+	if size, _ := b.Size(); size != 1000 {
+		t.Fatalf("Expected size 1000, got %v", size)
+	}
+}
+
+func TestMemoryWriteExtend(t *testing.T) {
+	u, b := openTestMemory(t, "memory://write-extend")
+	defer RemoveMemory(u)
+	defer b.Close()
+
+	if _, err := b.WriteAt([]byte("data"), 1000); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := b.Size(); size != 1004 {
+		t.Fatalf("Expected size 1004, got %v", size)
+	}
+}
+
+func TestMemoryZero(t *testing.T) {
+	u, b := openTestMemory(t, "memory://zero?size=262144")
+	defer RemoveMemory(u)
+	defer b.Close()
+
+	buf := testutil.Buffer(262144)
+	if _, err := b.WriteAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Zero a partial chunk, and an entire chunk.
+	if err := b.Zero(context.Background(), 1000, 4096); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Zero(context.Background(), memoryChunk, memoryChunk); err != nil {
+		t.Fatal(err)
+	}
+
+	res := make([]byte, len(buf))
+	if _, err := b.ReadAt(res, 0); err != nil {
+		t.Fatal(err)
+	}
+	copy(buf[1000:5096], make([]byte, 4096))
+	copy(buf[memoryChunk:2*memoryChunk], make([]byte, memoryChunk))
+	if !bytes.Equal(res, buf) {
+		t.Fatal("Range was not zeroed")
+	}
+
+	if err := b.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryExtents(t *testing.T) {
+	const size = 4 * memoryChunk
+	u, b := openTestMemory(t, "memory://extents?size=262144")
+	defer RemoveMemory(u)
+	defer b.Close()
+
+	// Writing zeros does not allocate chunks.
+	if _, err := b.WriteAt(make([]byte, memoryChunk), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.WriteAt([]byte("data"), memoryChunk+100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.WriteAt([]byte("data"), 2*memoryChunk); err != nil {
+		t.Fatal(err)
+	}
+
+	extents, err := b.Extents(context.Background(), 0, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Extent{
+		{Start: 0, Length: memoryChunk, Zero: true, Hole: true},
+		{Start: memoryChunk, Length: 2 * memoryChunk},
+		{Start: 3 * memoryChunk, Length: memoryChunk, Zero: true, Hole: true},
+	}
+	if !reflect.DeepEqual(extents, expected) {
+		t.Fatalf("Expected extents %v, got %v", expected, extents)
+	}
+
+	// Partial range, starting inside a chunk.
+	extents, err = b.Extents(context.Background(), 2*memoryChunk+100, memoryChunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []Extent{
+		{Start: 2*memoryChunk + 100, Length: memoryChunk - 100},
+		{Start: 3 * memoryChunk, Length: 100, Zero: true, Hole: true},
+	}
+	if !reflect.DeepEqual(extents, expected) {
+		t.Fatalf("Expected extents %v, got %v", expected, extents)
+	}
+}
+
+func TestMemoryRemove(t *testing.T) {
+	u, b := openTestMemory(t, "memory://remove")
+	if _, err := b.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	RemoveMemory(u)
+
+	_, b = openTestMemory(t, "memory://remove")
+	defer RemoveMemory(u)
+	defer b.Close()
+	if size, _ := b.Size(); size != 0 {
+		t.Fatalf("Expected new empty image, got size %v", size)
+	}
+}
+
+func TestMemoryRetainRelease(t *testing.T) {
+	u, b := openTestMemory(t, "memory://retain")
+	defer RemoveMemory(u)
+	if _, err := b.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	other, _ := url.Parse("memory://retain?size=1024")
+	Retain(u)
+	Retain(other)
+
+	// The image is still retained by other url.
+	Release(u)
+	_, b = openTestMemory(t, "memory://retain")
+	if size, _ := b.Size(); size != 4 {
+		t.Fatalf("Image removed while retained, size %v", size)
+	}
+	b.Close()
+
+	// Releasing the last reference removes the image.
+	Release(other)
+	_, b = openTestMemory(t, "memory://retain")
+	defer b.Close()
+	if size, _ := b.Size(); size != 0 {
+		t.Fatalf("Expected new empty image, got size %v", size)
+	}
+}
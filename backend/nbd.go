@@ -0,0 +1,201 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"ovirt/imageio/fileio"
+	"ovirt/imageio/nbd"
+	"strings"
+)
+
+const (
+	nbdPort = "10809"
+
+	// Zero and block status requests are split to steps, so they can be
+	// canceled.
+	nbdStep = 1024 * 1024 * 1024
+)
+
+func init() {
+	Register("nbd", OpenNBD)
+	Register("nbd+unix", OpenNBD)
+}
+
+// NBD is a backend using a NBD server, like qemu-nbd.
+type NBD struct {
+	client *nbd.Client
+}
+
+// OpenNBD opens a NBD backend for url u. Supported urls:
+//
+//	nbd:unix:/path/to/socket[:exportname=name]
+//	nbd://host[:port][/export]
+//	nbd+unix:///[export]?socket=/path/to/socket
+func OpenNBD(u *url.URL, opts OpenOptions) (Backend, error) {
+	network, address, export, err := nbdAddress(u)
+	if err != nil {
+		return nil, err
+	}
+	client, err := nbd.Dial(network, address, nbd.DialOptions{
+		Export:      export,
+		DirtyBitmap: opts.DirtyBitmap,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if opts.Writable && client.ReadOnly() {
+		client.Close()
+		return nil, fmt.Errorf("NBD export is read only: %v", u)
+	}
+	if opts.DirtyBitmap != "" && !client.HasDirtyBitmap() {
+		client.Close()
+		return nil, fmt.Errorf("NBD export has no dirty bitmap %q: %v", opts.DirtyBitmap, u)
+	}
+	return &NBD{client: client}, nil
+}
+
+// nbdAddress returns the network, address and export name for url u.
+func nbdAddress(u *url.URL) (network, address, export string, err error) {
+	switch {
+	case u.Scheme == "nbd" && strings.HasPrefix(u.Opaque, "unix:"):
+		address = u.Opaque[len("unix:"):]
+		if i := strings.Index(address, ":exportname="); i != -1 {
+			export = address[i+len(":exportname="):]
+			address = address[:i]
+		}
+		network = "unix"
+	case u.Scheme == "nbd" && u.Host != "":
+		address = u.Host
+		if u.Port() == "" {
+			address = net.JoinHostPort(u.Host, nbdPort)
+		}
+		export = strings.TrimPrefix(u.Path, "/")
+		network = "tcp"
+	case u.Scheme == "nbd+unix":
+		address = u.Query().Get("socket")
+		export = strings.TrimPrefix(u.Path, "/")
+		network = "unix"
+	}
+	if address == "" {
+		err = fmt.Errorf("Invalid NBD url: %v", u)
+	}
+	return
+}
+
+func (b *NBD) ReadAt(p []byte, off int64) (int, error) {
+	return b.client.ReadAt(p, off)
+}
+
+func (b *NBD) WriteAt(p []byte, off int64) (int, error) {
+	return b.client.WriteAt(p, off)
+}
+
+func (b *NBD) Zero(ctx context.Context, offset int64, size int64) error {
+	for size > 0 {
+		if ctx.Err() != nil {
+			return fileio.ErrCanceled
+		}
+		step := int64(nbdStep)
+		if size < step {
+			step = size
+		}
+		if err := b.client.Zero(offset, step); err != nil {
+			return err
+		}
+		offset += step
+		size -= step
+	}
+	return nil
+}
+
+func (b *NBD) Flush(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return fileio.ErrCanceled
+	}
+	return b.client.Flush()
+}
+
+func (b *NBD) Extents(ctx context.Context, offset int64, length int64) ([]Extent, error) {
+	end := b.client.Size()
+	if length < end-offset {
+		end = offset + length
+	}
+	extents := []Extent{}
+	pos := offset
+	for pos < end {
+		if ctx.Err() != nil {
+			return nil, fileio.ErrCanceled
+		}
+		step := int64(nbdStep)
+		if end-pos < step {
+			step = end - pos
+		}
+		res, err := b.client.BlockStatus(pos, step)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range res {
+			hole := e.Flags&nbd.StateHole != 0
+			zero := e.Flags&nbd.StateZero != 0
+			if n := len(extents); n > 0 && extents[n-1].Hole == hole && extents[n-1].Zero == zero {
+				extents[n-1].Length += e.Length
+			} else {
+				extents = append(extents, Extent{e.Start, e.Length, zero, hole})
+			}
+			pos += e.Length
+		}
+	}
+	return extents, nil
+}
+
+// DirtyExtents returns the dirty extents using the qemu:dirty-bitmap meta
+// context.
+func (b *NBD) DirtyExtents(ctx context.Context, offset int64, length int64) ([]DirtyExtent, error) {
+	end := b.client.Size()
+	if length < end-offset {
+		end = offset + length
+	}
+	extents := []DirtyExtent{}
+	pos := offset
+	for pos < end {
+		if ctx.Err() != nil {
+			return nil, fileio.ErrCanceled
+		}
+		step := int64(nbdStep)
+		if end-pos < step {
+			step = end - pos
+		}
+		res, err := b.client.DirtyStatus(pos, step)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range res {
+			dirty := e.Flags&nbd.StateDirty != 0
+			if n := len(extents); n > 0 && extents[n-1].Dirty == dirty {
+				extents[n-1].Length += e.Length
+			} else {
+				extents = append(extents, DirtyExtent{e.Start, e.Length, dirty})
+			}
+			pos += e.Length
+		}
+	}
+	return extents, nil
+}
+
+func (b *NBD) Size() (int64, error) {
+	return b.client.Size(), nil
+}
+
+func (b *NBD) Close() error {
+	return b.client.Close()
+}
@@ -0,0 +1,265 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"ovirt/imageio/nbd"
+	"ovirt/imageio/testutil"
+	"testing"
+)
+
+// sliceExport exports a sliceBackend using NBD. The first half of the export
+// is reported as data, and the rest as a hole.
+type sliceExport struct {
+	*sliceBackend
+	readOnly bool
+}
+
+func (e *sliceExport) Zero(offset int64, length int64) error {
+	return e.sliceBackend.Zero(context.Background(), offset, length)
+}
+
+func (e *sliceExport) Flush() error {
+	return e.sliceBackend.Flush(context.Background())
+}
+
+func (e *sliceExport) Extents(offset int64, length int64) ([]nbd.Extent, error) {
+	half := int64(len(e.data) / 2)
+	if offset >= half {
+		return []nbd.Extent{{Start: offset, Length: length, Flags: nbd.StateHole | nbd.StateZero}}, nil
+	}
+	if offset+length <= half {
+		return []nbd.Extent{{Start: offset, Length: length}}, nil
+	}
+	return []nbd.Extent{
+		{Start: offset, Length: half - offset},
+		{Start: half, Length: offset + length - half, Flags: nbd.StateHole | nbd.StateZero},
+	}, nil
+}
+
+func (e *sliceExport) Bitmaps() []string {
+	return []string{"b1"}
+}
+
+// BitmapExtents reports the first half of the export as dirty.
+func (e *sliceExport) BitmapExtents(bitmap string, offset int64, length int64) ([]nbd.Extent, error) {
+	extents, err := e.Extents(offset, length)
+	for i := range extents {
+		if extents[i].Flags == 0 {
+			extents[i].Flags = nbd.StateDirty
+		} else {
+			extents[i].Flags = 0
+		}
+	}
+	return extents, err
+}
+
+func (e *sliceExport) Size() int64 {
+	return int64(len(e.data))
+}
+
+func (e *sliceExport) ReadOnly() bool {
+	return e.readOnly
+}
+
+func serveNBD(t *testing.T, e *sliceExport) (string, func()) {
+	f, err := ioutil.TempFile("/var/tmp", "nbd.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := f.Name()
+	f.Close()
+	os.Remove(path)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &nbd.Server{Open: func(name string) (nbd.Export, error) {
+		return e, nil
+	}}
+	go server.Serve(l)
+	return path, func() {
+		l.Close()
+		os.Remove(path)
+	}
+}
+
+func TestNBDAddress(t *testing.T) {
+	for _, c := range []struct {
+		url     string
+		network string
+		address string
+		export  string
+	}{
+		{"nbd:unix:/run/nbd.sock", "unix", "/run/nbd.sock", ""},
+		{"nbd:unix:/run/nbd.sock:exportname=sda", "unix", "/run/nbd.sock", "sda"},
+		{"nbd://example.com/sda", "tcp", "example.com:10809", "sda"},
+		{"nbd://example.com:2000", "tcp", "example.com:2000", ""},
+		{"nbd+unix:///sda?socket=/run/nbd.sock", "unix", "/run/nbd.sock", "sda"},
+	} {
+		u, err := url.Parse(c.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		network, address, export, err := nbdAddress(u)
+		if err != nil {
+			t.Fatalf("%v: %v", c.url, err)
+		}
+		if network != c.network || address != c.address || export != c.export {
+			t.Fatalf("%v: got %v %v %q, expected %v %v %q", c.url, network,
+				address, export, c.network, c.address, c.export)
+		}
+	}
+}
+
+func TestNBDAddressInvalid(t *testing.T) {
+	for _, s := range []string{"nbd:tcp:example.com", "nbd+unix:///sda"} {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err = nbdAddress(u); err == nil {
+			t.Fatalf("%v: invalid url did not fail", s)
+		}
+	}
+}
+
+func TestNBDReadWrite(t *testing.T) {
+	e := &sliceExport{sliceBackend: &sliceBackend{data: make([]byte, 8192)}}
+	path, stop := serveNBD(t, e)
+	defer stop()
+
+	u, _ := url.Parse("nbd:unix:" + path)
+	b, err := Open(u, OpenOptions{Writable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	size, err := b.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 8192 {
+		t.Fatalf("Size %v, expected 8192", size)
+	}
+
+	ctx := context.Background()
+	buf := testutil.Buffer(5000)
+	err = Receive(ctx, b, bytes.NewReader(buf), Options{Offset: 100, Size: 5000, Flush: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.flushed {
+		t.Fatal("Export was not flushed")
+	}
+
+	var out bytes.Buffer
+	if err = Send(ctx, b, &out, Options{Offset: 100, Size: 5000}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), buf) {
+		t.Fatal("Data sent does not match data received")
+	}
+
+	if err = b.Zero(ctx, 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	res := make([]byte, 1000)
+	if _, err = b.ReadAt(res, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, make([]byte, 1000)) {
+		t.Fatalf("Range was not zeroed: %v", res)
+	}
+}
+
+func TestNBDExtents(t *testing.T) {
+	e := &sliceExport{sliceBackend: &sliceBackend{data: make([]byte, 8192)}}
+	path, stop := serveNBD(t, e)
+	defer stop()
+
+	u, _ := url.Parse("nbd+unix:///?socket=" + path)
+	b, err := Open(u, OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	extents, err := b.Extents(context.Background(), 0, 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Extent{
+		{Start: 0, Length: 4096},
+		{Start: 4096, Length: 4096, Zero: true, Hole: true},
+	}
+	if len(extents) != len(expected) || extents[0] != expected[0] || extents[1] != expected[1] {
+		t.Fatalf("Expected %+v, got %+v", expected, extents)
+	}
+}
+
+func TestNBDReadOnly(t *testing.T) {
+	e := &sliceExport{sliceBackend: &sliceBackend{data: make([]byte, 8192)}, readOnly: true}
+	path, stop := serveNBD(t, e)
+	defer stop()
+
+	u, _ := url.Parse("nbd:unix:" + path)
+	if _, err := Open(u, OpenOptions{Writable: true}); err == nil {
+		t.Fatal("Opening read only export for writing did not fail")
+	}
+	b, err := Open(u, OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+}
+
+func TestNBDDirtyExtents(t *testing.T) {
+	e := &sliceExport{sliceBackend: &sliceBackend{data: make([]byte, 8192)}}
+	path, stop := serveNBD(t, e)
+	defer stop()
+
+	u, _ := url.Parse("nbd:unix:" + path)
+	b, err := Open(u, OpenOptions{DirtyBitmap: "b1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	extents, err := b.(DirtyBackend).DirtyExtents(context.Background(), 0, 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []DirtyExtent{
+		{Start: 0, Length: 4096, Dirty: true},
+		{Start: 4096, Length: 4096, Dirty: false},
+	}
+	if len(extents) != len(expected) || extents[0] != expected[0] || extents[1] != expected[1] {
+		t.Fatalf("Expected %+v, got %+v", expected, extents)
+	}
+}
+
+func TestNBDDirtyBitmapMissing(t *testing.T) {
+	e := &sliceExport{sliceBackend: &sliceBackend{data: make([]byte, 8192)}}
+	path, stop := serveNBD(t, e)
+	defer stop()
+
+	u, _ := url.Parse("nbd:unix:" + path)
+	if _, err := Open(u, OpenOptions{DirtyBitmap: "missing"}); err == nil {
+		t.Fatal("Opening backend with missing dirty bitmap did not fail")
+	}
+}
@@ -0,0 +1,151 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package backend
+
+import (
+	"context"
+	"ovirt/imageio/fileio"
+	"ovirt/imageio/qcow2"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// Zero requests are split to steps, so they can be canceled.
+	qcow2Step = 1024 * 1024 * 1024
+)
+
+// Qcow2 is a backend exposing the guest visible data of a qcow2 image file,
+// so qcow2 images are uploaded and downloaded as raw data.
+type Qcow2 struct {
+	shared   *sharedQcow2
+	image    *qcow2.Image
+	writable bool
+}
+
+// sharedQcow2 is a qcow2 image shared by all backends opened for the same
+// path. The allocation state of a writable image is kept in the qcow2.Image,
+// so separate images writing to the same file would allocate the same
+// clusters and overwrite each other's metadata.
+type sharedQcow2 struct {
+	path     string
+	image    *qcow2.Image
+	writable bool
+	refs     int
+}
+
+var (
+	qcow2Mutex  sync.Mutex
+	qcow2Images = map[string]*sharedQcow2{}
+)
+
+// OpenQcow2 opens the qcow2 image at path, and its backing chain.
+//
+// The image is shared with other backends using the same path. If the shared
+// image is read only and opts.Writable is set, the image is opened again for
+// writing, and the writable image is shared with backends opened later.
+func OpenQcow2(path string, opts OpenOptions) (Backend, error) {
+	path = filepath.Clean(path)
+
+	qcow2Mutex.Lock()
+	defer qcow2Mutex.Unlock()
+
+	s := qcow2Images[path]
+	if s == nil || opts.Writable && !s.writable {
+		image, err := qcow2.Open(path, opts.Writable)
+		if err != nil {
+			return nil, err
+		}
+		s = &sharedQcow2{path: path, image: image, writable: opts.Writable}
+		qcow2Images[path] = s
+	}
+	s.refs++
+	return &Qcow2{shared: s, image: s.image, writable: opts.Writable}, nil
+}
+
+func (q *Qcow2) ReadAt(p []byte, off int64) (int, error) {
+	return q.image.ReadAt(p, off)
+}
+
+func (q *Qcow2) WriteAt(p []byte, off int64) (int, error) {
+	if !q.writable {
+		return 0, qcow2.ErrReadOnly
+	}
+	return q.image.WriteAt(p, off)
+}
+
+func (q *Qcow2) Zero(ctx context.Context, offset int64, size int64) error {
+	if !q.writable {
+		return qcow2.ErrReadOnly
+	}
+	for size > 0 {
+		if ctx.Err() != nil {
+			return fileio.ErrCanceled
+		}
+		step := int64(qcow2Step)
+		if size < step {
+			step = size
+		}
+		if err := q.image.Zero(offset, step); err != nil {
+			return err
+		}
+		offset += step
+		size -= step
+	}
+	return nil
+}
+
+func (q *Qcow2) Flush(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return fileio.ErrCanceled
+	}
+	return q.image.Flush()
+}
+
+// Extents reports unallocated clusters as zero, and clusters allocated in the
+// image or in its backing chain as data.
+func (q *Qcow2) Extents(ctx context.Context, offset int64, length int64) ([]Extent, error) {
+	if ctx.Err() != nil {
+		return nil, fileio.ErrCanceled
+	}
+	extents, err := q.image.Extents(offset, length)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Extent, len(extents))
+	for i, e := range extents {
+		res[i] = Extent{e.Start, e.Length, e.Zero, e.Hole}
+	}
+	return res, nil
+}
+
+func (q *Qcow2) Size() (int64, error) {
+	return q.image.Size(), nil
+}
+
+// Close releases the shared image, closing it when the last backend using it
+// is closed.
+func (q *Qcow2) Close() error {
+	qcow2Mutex.Lock()
+	defer qcow2Mutex.Unlock()
+
+	s := q.shared
+	if s == nil {
+		return nil
+	}
+	q.shared = nil
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+	if qcow2Images[s.path] == s {
+		delete(qcow2Images, s.path)
+	}
+	return s.image.Close()
+}
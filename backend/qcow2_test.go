@@ -0,0 +1,226 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"os"
+	"ovirt/imageio/fileio"
+	"ovirt/imageio/qcow2"
+	"ovirt/imageio/testutil"
+	"reflect"
+	"testing"
+)
+
+const testCluster = 64 * 1024
+
+func TestQcow2Read(t *testing.T) {
+	data := testutil.Buffer(testCluster)
+	path, err := testutil.CreateQcow2(testutil.Qcow2Options{
+		Size: 4 * testCluster,
+		Data: map[int64][]byte{2: data},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u := &url.URL{Scheme: "file", Path: path}
+	b, err := Open(u, OpenOptions{Format: "qcow2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if size, _ := b.Size(); size != 4*testCluster {
+		t.Fatalf("Expected virtual size %v, got %v", 4*testCluster, size)
+	}
+
+	var buf bytes.Buffer
+	err = Send(context.Background(), b, &buf, Options{Size: 4 * testCluster})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make([]byte, 4*testCluster)
+	copy(expected[2*testCluster:], data)
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Fatal("Guest data does not match")
+	}
+
+	extents, err := b.Extents(context.Background(), 0, 4*testCluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedExtents := []Extent{
+		{Start: 0, Length: 2 * testCluster, Zero: true, Hole: true},
+		{Start: 2 * testCluster, Length: testCluster},
+		{Start: 3 * testCluster, Length: testCluster, Zero: true, Hole: true},
+	}
+	if !reflect.DeepEqual(extents, expectedExtents) {
+		t.Fatalf("Expected extents %v, got %v", expectedExtents, extents)
+	}
+}
+
+func TestQcow2Write(t *testing.T) {
+	const size = 8 * testCluster
+	path, err := testutil.CreateQcow2(testutil.Qcow2Options{Size: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u := &url.URL{Scheme: "file", Path: path}
+	b, err := Open(u, OpenOptions{Writable: true, Format: "qcow2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	data := testutil.Buffer(size)
+	err = Receive(ctx, b, bytes.NewReader(data), Options{Size: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Zero(ctx, 2*testCluster, 2*testCluster); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	image, err := qcow2.Open(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+	if err := image.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, size)
+	if _, err := image.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	copy(data[2*testCluster:4*testCluster], make([]byte, 2*testCluster))
+	if !bytes.Equal(buf, data) {
+		t.Fatal("Guest data does not match data written")
+	}
+}
+
+func TestQcow2Shared(t *testing.T) {
+	const size = 8 * testCluster
+	path, err := testutil.CreateQcow2(testutil.Qcow2Options{Size: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	// A reader opened before the writers does not see the writes.
+	u := &url.URL{Scheme: "file", Path: path}
+	reader, err := Open(u, OpenOptions{Format: "qcow2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if _, err := reader.WriteAt([]byte("data"), 0); err != qcow2.ErrReadOnly {
+		t.Fatalf("Expected %v, got %v", qcow2.ErrReadOnly, err)
+	}
+
+	// Writers must share the image allocation state.
+	data := testutil.Buffer(size)
+	var writers []Backend
+	for i := 0; i < 2; i++ {
+		b, err := Open(u, OpenOptions{Writable: true, Format: "qcow2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writers = append(writers, b)
+	}
+	for i, b := range writers {
+		off := int64(i) * size / 2
+		if _, err := b.WriteAt(data[off:off+size/2], off); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Readers opened while writers are open use the writable image.
+	after, err := Open(u, OpenOptions{Format: "qcow2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, size)
+	if _, err := after.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	after.Close()
+	if !bytes.Equal(buf, data) {
+		t.Fatal("Reader does not see data written")
+	}
+
+	for _, b := range writers {
+		if err := b.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		b.Close()
+	}
+
+	image, err := qcow2.Open(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+	if err := image.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := image.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("Guest data does not match data written")
+	}
+}
+
+func TestQcow2ZeroCanceled(t *testing.T) {
+	path, err := testutil.CreateQcow2(testutil.Qcow2Options{Size: testCluster})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u := &url.URL{Scheme: "file", Path: path}
+	b, err := Open(u, OpenOptions{Writable: true, Format: "qcow2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.Zero(ctx, 0, testCluster); err != fileio.ErrCanceled {
+		t.Fatalf("Expected %v, got %v", fileio.ErrCanceled, err)
+	}
+}
+
+func TestOpenUnsupportedFormat(t *testing.T) {
+	for _, u := range []*url.URL{
+		{Scheme: "file", Path: "/no/such/path"},
+		{Scheme: "memory", Host: "format"},
+	} {
+		if _, err := Open(u, OpenOptions{Format: "vmdk"}); err == nil {
+			t.Fatalf("Opening %v with unsupported format did not fail", u)
+		}
+	}
+	u := &url.URL{Scheme: "memory", Host: "format"}
+	if _, err := Open(u, OpenOptions{Format: "qcow2"}); err == nil {
+		t.Fatal("Opening memory image as qcow2 did not fail")
+	}
+}
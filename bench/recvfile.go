@@ -9,6 +9,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -25,6 +26,7 @@ const (
 var (
 	offset   = flag.Int64("offset", 0, "offset in image (in MiB)")
 	progress = flag.Bool("progress", false, "show copy progress (default false)")
+	flush    = flag.Bool("flush", true, "flush data to storage when done")
 )
 
 func init() {
@@ -52,14 +54,21 @@ func main() {
 		os.Exit(2)
 	}
 
+	opts := fileio.Options{
+		Path:   path,
+		Offset: *offset * MB,
+		Size:   size * MB,
+		Flush:  *flush,
+	}
 	if *progress {
 		pi := NewProgressIndicator(size*MB, time.Duration(100)*time.Millisecond)
 		pi.Start()
-		_, err = fileio.Receive(path, os.Stdin, size*MB, *offset*MB, pi)
+		// Set only here to avoid crash when sending (*T)(nil).
+		opts.Progress = pi
+		err = fileio.NewReceive(context.Background(), os.Stdin, opts).Run()
 		pi.Stop()
 	} else {
-		// Duplicated to avoid crash when sending (*T)(nil).
-		_, err = fileio.Receive(path, os.Stdin, size*MB, *offset*MB, nil)
+		err = fileio.NewReceive(context.Background(), os.Stdin, opts).Run()
 	}
 	if err != nil {
 		panic(err)
@@ -15,11 +15,61 @@ import (
 	"unsafe"
 )
 
+const (
+	// From linux/fadvise.h
+	fadvDontNeed = 4
+)
+
+// For testing file systems that do not support direct I/O.
+var openFile = os.OpenFile
+
 // OpenFile opens a file with direct I/O enabled.
 //
 // Write and read to the file must use AlignedBuffer.
 func OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
-	return os.OpenFile(name, flag|syscall.O_DIRECT, perm)
+	return openFile(name, flag|syscall.O_DIRECT, perm)
+}
+
+// File is a file opened by Open, using direct I/O if possible.
+type File struct {
+	*os.File
+
+	// Direct is true if the file was opened with direct I/O.
+	Direct bool
+}
+
+// Open opens a file with direct I/O enabled if the file system supports it.
+//
+// Some file systems (e.g. tmpfs, some network file systems) fail to open with
+// O_DIRECT with EINVAL. In this case the file is opened without direct I/O,
+// and file.Direct is false. Write and read to the file must use AlignedBuffer
+// in both cases.
+func Open(name string, flag int, perm os.FileMode) (*File, error) {
+	file, err := OpenFile(name, flag, perm)
+	if err == nil {
+		return &File{file, true}, nil
+	}
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EINVAL {
+		return nil, err
+	}
+	file, err = openFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &File{file, false}, nil
+}
+
+// DropCache drops size bytes starting at offset from the page cache, when not
+// using direct I/O. This starts writeback of dirty pages, so copying large
+// images does not trash the page cache.
+//
+// This is only advice to the kernel, errors are ignored.
+func (f *File) DropCache(offset int64, size int64) {
+	if f.Direct {
+		return
+	}
+	syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), uintptr(offset), uintptr(size),
+		fadvDontNeed, 0, 0)
 }
 
 // AlignedBuffer allocates aligned buffer.
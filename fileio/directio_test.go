@@ -9,9 +9,12 @@
 package fileio
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
+	"ovirt/imageio/testutil"
 	"path/filepath"
+	"syscall"
 	"testing"
 )
 
@@ -67,3 +70,77 @@ func TestOpenFile(t *testing.T) {
 		t.Fatalf("Read %v bytes, expected %v", n, len(buf))
 	}
 }
+
+func TestOpen(t *testing.T) {
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	file, err := Open(path, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if !file.Direct {
+		t.Fatal("File not opened with direct I/O")
+	}
+}
+
+func TestOpenMissing(t *testing.T) {
+	_, err := Open("/var/tmp/no-such-file", os.O_RDONLY, 0)
+	if err == nil {
+		t.Fatal("Open did not fail for missing file")
+	}
+}
+
+func TestOpenNoDirectIO(t *testing.T) {
+	defer simulateNoDirectIO()()
+
+	const size = 1024 * 1234
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	file, err := Open(path, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if file.Direct {
+		t.Fatal("File opened with direct I/O")
+	}
+
+	buf := testutil.Buffer(size)
+	_, err = Receive(path, bytes.NewReader(buf), size, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer := &bytes.Buffer{}
+	_, err = Send(path, writer, size, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(writer.Bytes(), buf) {
+		t.Fatalf("Expected %v, got %v", buf, writer.Bytes())
+	}
+}
+
+// simulateNoDirectIO makes opening files with O_DIRECT fail with EINVAL, like
+// file systems that do not support direct I/O. Returns a function restoring
+// the original behavior.
+func simulateNoDirectIO() func() {
+	saved := openFile
+	openFile = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		if flag&syscall.O_DIRECT != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EINVAL}
+		}
+		return saved(name, flag, perm)
+	}
+	return func() { openFile = saved }
+}
@@ -0,0 +1,102 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package fileio
+
+import (
+	"context"
+	"os"
+	"syscall"
+)
+
+const (
+	// From linux/fs.h
+	seekData = 3
+	seekHole = 4
+)
+
+// Extent describes a range in an image.
+//
+// Zero is true if the range reads as zeros, and Hole is true if the range is
+// not allocated.
+type Extent struct {
+	Start  int64 `json:"start"`
+	Length int64 `json:"length"`
+	Zero   bool  `json:"zero"`
+	Hole   bool  `json:"hole"`
+}
+
+// Extents returns the data and hole extents in the first size bytes of path.
+//
+// Holes are detected using SEEK_DATA and SEEK_HOLE. If the file system or
+// the device does not support this, the entire range is reported as data.
+// Data extents may contain zeros; only holes are reported as zero.
+func Extents(path string, size int64) (extents []Extent, err error) {
+	return ExtentsContext(context.Background(), path, size)
+}
+
+// ExtentsContext is like Extents, but returns ErrCanceled when ctx is
+// canceled. Cancellation is checked before looking up each extent.
+func ExtentsContext(ctx context.Context, path string, size int64) (extents []Extent, err error) {
+	return ExtentsAt(ctx, path, 0, size)
+}
+
+// ExtentsAt is like ExtentsContext, returning the extents of length bytes at
+// offset. The first extent starts at offset.
+func ExtentsAt(ctx context.Context, path string, offset int64, length int64) (extents []Extent, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	fd := int(file.Fd())
+	extents = []Extent{}
+	pos := offset
+	end := offset + length
+
+	for pos < end {
+		if ctx.Err() != nil {
+			return nil, ErrCanceled
+		}
+
+		data, es := syscall.Seek(fd, pos, seekData)
+		if es == syscall.ENXIO {
+			// No more data after pos.
+			data = end
+		} else if es == syscall.EINVAL && pos == offset {
+			// Seeking data or holes is not supported.
+			return []Extent{{Start: offset, Length: length}}, nil
+		} else if es != nil {
+			return nil, es
+		}
+		if data > end {
+			data = end
+		}
+
+		if data > pos {
+			extents = append(extents, Extent{pos, data - pos, true, true})
+		}
+		if data == end {
+			break
+		}
+
+		hole, es := syscall.Seek(fd, data, seekHole)
+		if es != nil {
+			return nil, es
+		}
+		if hole > end {
+			hole = end
+		}
+
+		extents = append(extents, Extent{data, hole - data, false, false})
+		pos = hole
+	}
+
+	return
+}
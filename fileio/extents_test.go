@@ -0,0 +1,167 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package fileio
+
+import (
+	"context"
+	"os"
+	"ovirt/imageio/testutil"
+	"testing"
+)
+
+const extentsBlock = 1024 * 1024
+
+func TestExtentsEmpty(t *testing.T) {
+	path, err := testutil.CreateFile(4 * extentsBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	extents, err := Extents(path, 4*extentsBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkExtentsCover(t, extents, 4*extentsBlock)
+	for _, e := range extents {
+		if !e.Zero && e.Start < 3*extentsBlock {
+			// Creating the file wrote the last byte, all the rest is a hole.
+			t.Fatalf("Unexpected data extent: %+v", e)
+		}
+	}
+}
+
+func TestExtentsData(t *testing.T) {
+	const size = 4 * extentsBlock
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteAt(testutil.Buffer(extentsBlock), extentsBlock)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extents, err := Extents(path, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkExtentsCover(t, extents, size)
+
+	for _, e := range extents {
+		if e.Start <= extentsBlock && e.Start+e.Length >= 2*extentsBlock {
+			if e.Zero || e.Hole {
+				t.Fatalf("Expected data extent, got %+v", e)
+			}
+			return
+		}
+	}
+	t.Fatalf("Data not found in %+v", extents)
+}
+
+func TestExtentsShortFile(t *testing.T) {
+	path, err := testutil.CreateFile(extentsBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	extents, err := Extents(path, 2*extentsBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkExtentsCover(t, extents, 2*extentsBlock)
+	last := extents[len(extents)-1]
+	if !last.Zero {
+		t.Fatalf("Expected zero extent after end of file, got %+v", last)
+	}
+}
+
+func TestExtentsAt(t *testing.T) {
+	const size = 4 * extentsBlock
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteAt(testutil.Buffer(extentsBlock), extentsBlock)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Range starting inside the data extent.
+	const offset = extentsBlock + 100
+	extents, err := ExtentsAt(context.Background(), path, offset, 2*extentsBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(extents) == 0 || extents[0].Start != offset {
+		t.Fatalf("Expected extents starting at %v, got %+v", offset, extents)
+	}
+	if extents[0].Zero || extents[0].Start+extents[0].Length < 2*extentsBlock {
+		t.Fatalf("Expected data extent, got %+v", extents[0])
+	}
+	last := extents[len(extents)-1]
+	if last.Start+last.Length != offset+2*extentsBlock {
+		t.Fatalf("Extents do not end at %v: %+v", offset+2*extentsBlock, extents)
+	}
+}
+
+func TestExtentsCanceled(t *testing.T) {
+	path, err := testutil.CreateFile(extentsBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = ExtentsContext(ctx, path, extentsBlock)
+	if err != ErrCanceled {
+		t.Fatalf("Expected %v, got %v", ErrCanceled, err)
+	}
+}
+
+func TestExtentsMissing(t *testing.T) {
+	_, err := Extents("/var/tmp/no-such-file", 1024)
+	if err == nil {
+		t.Fatal("Extents did not fail for missing file")
+	}
+}
+
+// checkExtentsCover checks that extents cover size bytes without gaps.
+func checkExtentsCover(t *testing.T, extents []Extent, size int64) {
+	pos := int64(0)
+	for _, e := range extents {
+		if e.Start != pos {
+			t.Fatalf("Expected extent at %v, got %+v", pos, e)
+		}
+		if e.Length <= 0 {
+			t.Fatalf("Invalid extent length: %+v", e)
+		}
+		pos += e.Length
+	}
+	if pos != size {
+		t.Fatalf("Extents cover %v bytes, expected %v: %+v", pos, size, extents)
+	}
+}
@@ -9,52 +9,148 @@
 package fileio
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"io"
 	"os"
+	"syscall"
 )
 
 const (
 	bufsize   = 8 * 1024 * 1024
 	alignment = 4096
+	blocksize = 512
 )
 
+// ErrCanceled is returned by the context variants of the fileio functions
+// when the context was canceled before the operation was completed.
+var ErrCanceled = errors.New("operation canceled")
+
+// errNegativeOffset is returned by ReadAt and WriteAt for negative offset,
+// like os.File.
+var errNegativeOffset = errors.New("negative offset")
+
 // Progress is an interface for reporting operation progress.
 type Progress interface {
 	Set(value int64)
 }
 
-// Receive copies size bytes from reader to path, staring at offset.
+// Receive copies size bytes from reader to path, staring at offset, and
+// flushes data to storage before returning. Use NewReceive to receive without
+// flushing.
 //
-// Todo:
-// - Check the option of Operation struct keeping the current progress, like
-//   the Python version. Can be useful when we need to add cancling support.
-// - There are too many parameters, would be nice to accept options struct
-//   instead.
+// Data is written using direct I/O. If offset or size are not aligned to 512
+// bytes, the unaligned head and tail are written using read-modify-write.
 func Receive(path string, reader io.Reader, size int64, offset int64, progress Progress) (received int64, err error) {
-	if size%512 != 0 {
-		return 0, fmt.Errorf("size is not a multiple of 512 bytes: %v", size)
-	}
+	return ReceiveContext(context.Background(), path, reader, size, offset, progress)
+}
 
-	if offset%512 != 0 {
-		return 0, fmt.Errorf("offset is not a multiple of 512 bytes: %v", offset)
-	}
+// ReceiveContext is like Receive, but stops receiving and returns ErrCanceled
+// when ctx is canceled. Cancellation is checked before each chunk is copied.
+func ReceiveContext(ctx context.Context, path string, reader io.Reader, size int64, offset int64, progress Progress) (received int64, err error) {
+	op := NewReceive(ctx, reader, Options{
+		Path:     path,
+		Offset:   offset,
+		Size:     size,
+		Flush:    true,
+		Progress: progress,
+	})
+	err = op.Run()
+	return op.Progress(), err
+}
 
-	file, err := OpenFile(path, os.O_WRONLY, 0600)
+// Flush flushes data written to path to storage.
+//
+// Use after receiving data without flushing, to flush all the data at once.
+func Flush(path string) error {
+	return FlushContext(context.Background(), path)
+}
+
+// FlushContext is like Flush, but returns ErrCanceled if ctx is canceled
+// before flushing was started.
+func FlushContext(ctx context.Context, path string) error {
+	return NewFlush(ctx, Options{Path: path}).Run()
+}
+
+// Send copies size bytes from path to writer, staring at offset.
+//
+// Like Receive, the file is read using direct I/O into an aligned buffer. If
+// offset or size are not aligned to 512 bytes, the unaligned head and tail are
+// read into a bounce buffer. Exactly size bytes are written to writer; if the
+// file is too short, io.ErrUnexpectedEOF is returned.
+func Send(path string, writer io.Writer, size int64, offset int64, progress Progress) (sent int64, err error) {
+	return SendContext(context.Background(), path, writer, size, offset, progress)
+}
+
+// SendContext is like Send, but stops sending and returns ErrCanceled when ctx
+// is canceled. Cancellation is checked before each chunk is copied.
+func SendContext(ctx context.Context, path string, writer io.Writer, size int64, offset int64, progress Progress) (sent int64, err error) {
+	op := NewSend(ctx, writer, Options{
+		Path:     path,
+		Offset:   offset,
+		Size:     size,
+		Progress: progress,
+	})
+	err = op.Run()
+	return op.Progress(), err
+}
+
+func (op *Operation) receive(reader io.Reader) (err error) {
+	flag := os.O_WRONLY
+	if !op.aligned() {
+		// Unaligned head or tail are written using read-modify-write.
+		flag = os.O_RDWR
+	}
+	file, err := Open(op.opts.Path, flag, 0600)
 	if err != nil {
 		return
 	}
 	defer file.Close()
 
-	if offset > 0 {
-		if _, err = file.Seek(offset, os.SEEK_SET); err != nil {
-			return
+	err = op.receiveRange(file, reader)
+
+	if op.opts.Flush {
+		if se := file.Sync(); se != nil && err == nil {
+			err = se
 		}
 	}
 
-	buf, err := AlignedBuffer(bufsize, alignment)
+	return
+}
+
+func (op *Operation) receiveRange(file *File, reader io.Reader) error {
+	buf, err := op.buffer()
 	if err != nil {
-		return
+		return err
+	}
+
+	pos := op.opts.Offset
+	end := pos + op.opts.Size
+
+	if pos%blocksize != 0 {
+		n, err := updateBlock(file, buf[:blocksize], pos, end, func(b []byte) error {
+			_, err := io.ReadFull(reader, b)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		pos += n
+		op.add(n)
+	}
+
+	alignedEnd := end - end%blocksize
+	if pos < alignedEnd {
+		if _, err = file.Seek(pos, os.SEEK_SET); err != nil {
+			return err
+		}
+	}
+
+	sparse := false
+	if op.opts.Sparse {
+		if sparse, err = isRegularFile(file); err != nil {
+			return err
+		}
 	}
 
 	// This is mostly like io.CopyBuffer, but:
@@ -64,38 +160,161 @@ func Receive(path string, reader io.Reader, size int64, offset int64, progress P
 	//   This can be also implemented using http.MaxBytesReader, but
 	//   it seems too complext for our needs.
 	// - report progress after each write
+	// - punch holes instead of writing zeros if sparse
+
+	for pos < alignedEnd {
+		if op.canceled() {
+			return ErrCanceled
+		}
 
-	for received < size {
 		b := buf
-		todo := int(size - received)
-		if todo < len(buf) {
+		todo := alignedEnd - pos
+		if todo < int64(len(buf)) {
 			b = buf[:todo]
 		}
 
-		_, er := io.ReadFull(reader, b)
-		if er != nil {
-			err = er
-			break
+		if _, err = io.ReadFull(reader, b); err != nil {
+			return err
 		}
 
-		n, ew := file.Write(b)
-		if n > 0 {
-			received += int64(n)
-			if progress != nil {
-				progress.Set(received)
+		if sparse && isZero(b) {
+			err = punchHole(file, pos, int64(len(b)))
+			if err == nil {
+				// Punching holes does not modify the file offset.
+				if _, err = file.Seek(int64(len(b)), os.SEEK_CUR); err != nil {
+					return err
+				}
+				pos += int64(len(b))
+				op.add(int64(len(b)))
+				continue
+			}
+			if err != syscall.EOPNOTSUPP {
+				return err
 			}
+			// Punching holes is not supported, write zeros.
+			sparse = false
 		}
-		if ew != nil {
+
+		n, err := file.Write(b)
+		if n > 0 {
+			file.DropCache(pos, int64(n))
+			pos += int64(n)
+			op.add(int64(n))
+		}
+		if err != nil {
 			// file.Write handles EINTR and short writes; error means we
 			// cannot write any more.
-			err = ew
-			break
+			return err
+		}
+	}
+
+	if pos < end {
+		if op.canceled() {
+			return ErrCanceled
+		}
+		n, err := updateBlock(file, buf[:blocksize], pos, end, func(b []byte) error {
+			_, err := io.ReadFull(reader, b)
+			return err
+		})
+		if err != nil {
+			return err
 		}
+		op.add(n)
 	}
 
-	if se := file.Sync(); se != nil && err == nil {
-		err = se
+	return nil
+}
+
+func (op *Operation) send(writer io.Writer) (err error) {
+	file, err := Open(op.opts.Path, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	buf, err := op.buffer()
+	if err != nil {
+		return
+	}
+
+	pos := op.opts.Offset
+	end := pos + op.opts.Size
+
+	if pos%blocksize != 0 {
+		n, err := sendBlock(file, writer, buf[:blocksize], pos, end)
+		if err != nil {
+			return err
+		}
+		pos += n
+		op.add(n)
+	}
+
+	alignedEnd := end - end%blocksize
+	if pos < alignedEnd {
+		if _, err = file.Seek(pos, os.SEEK_SET); err != nil {
+			return
+		}
+	}
+
+	// Like receive, we must read full blocks for direct I/O, and write
+	// exactly size bytes. Reading less than size bytes means the file is
+	// smaller than expected, reported as io.ErrUnexpectedEOF.
+
+	for pos < alignedEnd {
+		if op.canceled() {
+			return ErrCanceled
+		}
+
+		b := buf
+		todo := alignedEnd - pos
+		if todo < int64(len(buf)) {
+			b = buf[:todo]
+		}
+
+		_, err = io.ReadFull(file, b)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		file.DropCache(pos, int64(len(b)))
+
+		n, ew := writer.Write(b)
+		if n > 0 {
+			pos += int64(n)
+			op.add(int64(n))
+		}
+		if ew != nil {
+			return ew
+		}
+		if n != len(b) {
+			return io.ErrShortWrite
+		}
+	}
+
+	if pos < end {
+		if op.canceled() {
+			return ErrCanceled
+		}
+		n, err := sendBlock(file, writer, buf[:blocksize], pos, end)
+		if err != nil {
+			return err
+		}
+		op.add(n)
 	}
 
 	return
 }
+
+func (op *Operation) flush() error {
+	if op.canceled() {
+		return ErrCanceled
+	}
+	file, err := Open(op.opts.Path, os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
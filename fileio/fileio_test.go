@@ -10,6 +10,9 @@ package fileio
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"ovirt/imageio/testutil"
@@ -112,8 +115,8 @@ func TestReceiveOffset(t *testing.T) {
 	}
 }
 
-func TestReceiveUnalignedSize(t *testing.T) {
-	const size = 511
+func TestReceiveNoFlush(t *testing.T) {
+	const size = 1024 * 1234
 	path, err := testutil.CreateFile(size)
 	if err != nil {
 		t.Fatal(err)
@@ -121,24 +124,327 @@ func TestReceiveUnalignedSize(t *testing.T) {
 	defer os.Remove(path)
 
 	buf := testutil.Buffer(size)
-	reader := bytes.NewReader(buf)
-	n, err := Receive(path, reader, size, 0, nil)
-	if n != 0 || err == nil {
-		t.Fatalf("Call did not fail: n=%v, err=%v", n, err)
+	op := NewReceive(context.Background(), bytes.NewReader(buf), Options{
+		Path: path,
+		Size: size,
+	})
+	if err = op.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if n := op.Progress(); n != size {
+		t.Fatalf("Received %v bytes, expected %v bytes", n, size)
+	}
+
+	if err = Flush(path); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, buf) {
+		t.Fatalf("Expected %v, got %v", buf, content)
+	}
+}
+
+func TestFlushMissing(t *testing.T) {
+	err := Flush("/var/tmp/no-such-file")
+	if err == nil {
+		t.Fatal("Flush did not fail for missing file")
+	}
+}
+
+func TestReceiveCanceled(t *testing.T) {
+	const size = 2 * bufsize
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := &cancelingReader{bytes.NewReader(testutil.Buffer(size)), cancel}
+	n, err := ReceiveContext(ctx, path, reader, size, 0, nil)
+	if err != ErrCanceled {
+		t.Fatalf("Expected %v, got %v", ErrCanceled, err)
+	}
+	if n != bufsize {
+		t.Fatalf("Received %v bytes, expected %v bytes", n, bufsize)
+	}
+}
+
+// cancelingReader cancels a context when read.
+type cancelingReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (r *cancelingReader) Read(p []byte) (int, error) {
+	r.cancel()
+	return r.r.Read(p)
+}
+
+func TestSendFull(t *testing.T) {
+	const size = 1024 * 1234
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	buf := testutil.Buffer(size)
+	if err = ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	writer := &bytes.Buffer{}
+	n, err := Send(path, writer, size, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != size {
+		t.Fatalf("Sent %v bytes, expected %v bytes", n, size)
+	}
+	if !bytes.Equal(writer.Bytes(), buf) {
+		t.Fatalf("Expected %v, got %v", buf, writer.Bytes())
+	}
+}
+
+func TestSendOffset(t *testing.T) {
+	const filesize = 512 * 3
+	const bufsize = 512
+	const offset = 512
+	path, err := testutil.CreateFile(filesize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	buf := testutil.Buffer(filesize)
+	if err = ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	writer := &bytes.Buffer{}
+	n, err := Send(path, writer, bufsize, offset, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != bufsize {
+		t.Fatalf("Sent %v bytes, expected %v bytes", n, bufsize)
+	}
+	expected := buf[offset : offset+bufsize]
+	if !bytes.Equal(writer.Bytes(), expected) {
+		t.Fatalf("Expected %v, got %v", expected, writer.Bytes())
 	}
 }
 
-func TestReceiveUnalignedOffset(t *testing.T) {
+func TestSendWriterError(t *testing.T) {
 	path, err := testutil.CreateFile(1024)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer os.Remove(path)
 
-	buf := testutil.Buffer(512)
-	reader := bytes.NewReader(buf)
-	n, err := Receive(path, reader, 512, 511, nil)
-	if n != 0 || err == nil {
-		t.Fatalf("Call did not fail: n=%v, err=%v", n, err)
+	writer := &failingWriter{limit: 512}
+	n, err := Send(path, writer, 1024, 0, nil)
+	if err != errWriteFailed {
+		t.Fatalf("Expected %v, got %v", errWriteFailed, err)
+	}
+	if n != 512 {
+		t.Fatalf("Sent %v bytes, expected %v bytes", n, 512)
+	}
+}
+
+func TestSendShortWrite(t *testing.T) {
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	writer := &shortWriter{}
+	n, err := Send(path, writer, 1024, 0, nil)
+	if err != io.ErrShortWrite {
+		t.Fatalf("Expected %v, got %v", io.ErrShortWrite, err)
+	}
+	if n != 1 {
+		t.Fatalf("Sent %v bytes, expected %v bytes", n, 1)
+	}
+}
+
+var errWriteFailed = errors.New("write failed")
+
+// failingWriter fails after writing limit bytes.
+type failingWriter struct {
+	limit   int
+	written int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.written+n > w.limit {
+		n = w.limit - w.written
+	}
+	w.written += n
+	if n < len(p) {
+		return n, errWriteFailed
+	}
+	return n, nil
+}
+
+// shortWriter writes one byte, without reporting an error.
+type shortWriter struct{}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+func TestSendCanceled(t *testing.T) {
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	writer := &bytes.Buffer{}
+	n, err := SendContext(ctx, path, writer, 1024, 0, nil)
+	if err != ErrCanceled {
+		t.Fatalf("Expected %v, got %v", ErrCanceled, err)
+	}
+	if n != 0 || writer.Len() != 0 {
+		t.Fatalf("Sent %v bytes after cancellation", n)
+	}
+}
+
+func TestFlushCanceled(t *testing.T) {
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err = FlushContext(ctx, path); err != ErrCanceled {
+		t.Fatalf("Expected %v, got %v", ErrCanceled, err)
+	}
+}
+
+func TestSendShortFile(t *testing.T) {
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	writer := &bytes.Buffer{}
+	n, err := Send(path, writer, 2048, 0, nil)
+	if err == nil {
+		t.Fatalf("Call did not fail: n=%v", n)
+	}
+}
+
+// unalignedRanges are ranges in files of different sizes, including files with
+// unaligned size.
+var unalignedRanges = []struct {
+	filesize int
+	offset   int64
+	size     int64
+}{
+	{1024, 0, 511},
+	{1024, 511, 512},
+	{1024, 100, 50},
+	{1024, 1, 1022},
+	{4096, 100, 3000},
+	{1000, 0, 1000},
+	{1000, 900, 100},
+	{1000, 500, 400},
+}
+
+func TestReceiveUnaligned(t *testing.T) {
+	for _, r := range unalignedRanges {
+		path, err := testutil.CreateFile(r.filesize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(path)
+
+		// Fill the file with ones to detect unwanted modifications.
+		expected := bytes.Repeat([]byte{1}, r.filesize)
+		if err = ioutil.WriteFile(path, expected, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := testutil.Buffer(int(r.size))
+		n, err := Receive(path, bytes.NewReader(buf), r.size, r.offset, nil)
+		if err != nil {
+			t.Errorf("Receive %+v failed: %v", r, err)
+			continue
+		}
+		if n != r.size {
+			t.Errorf("Receive %+v: received %v bytes", r, n)
+		}
+
+		copy(expected[r.offset:], buf)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, expected) {
+			t.Errorf("Receive %+v: expected %v, got %v", r, expected, content)
+		}
+	}
+}
+
+func TestSendUnaligned(t *testing.T) {
+	for _, r := range unalignedRanges {
+		path, err := testutil.CreateFile(r.filesize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(path)
+
+		buf := testutil.Buffer(r.filesize)
+		if err = ioutil.WriteFile(path, buf, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		writer := &bytes.Buffer{}
+		n, err := Send(path, writer, r.size, r.offset, nil)
+		if err != nil {
+			t.Errorf("Send %+v failed: %v", r, err)
+			continue
+		}
+		if n != r.size {
+			t.Errorf("Send %+v: sent %v bytes", r, n)
+		}
+
+		expected := buf[r.offset : r.offset+r.size]
+		if !bytes.Equal(writer.Bytes(), expected) {
+			t.Errorf("Send %+v: expected %v, got %v", r, expected, writer.Bytes())
+		}
+	}
+}
+
+func TestSendUnalignedShortFile(t *testing.T) {
+	path, err := testutil.CreateFile(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	writer := &bytes.Buffer{}
+	n, err := Send(path, writer, 1024, 0, nil)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected %v, got n=%v err=%v", io.ErrUnexpectedEOF, n, err)
 	}
 }
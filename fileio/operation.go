@@ -0,0 +1,175 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package fileio
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Options describes what an Operation should do.
+type Options struct {
+	// Path to a file or a block device.
+	Path string
+
+	// Offset in bytes. Operations are most efficient when offset is a
+	// multiple of 512 bytes.
+	Offset int64
+
+	// Size in bytes. Operations are most efficient when size is a multiple
+	// of 512 bytes.
+	Size int64
+
+	// BufSize is the size of the I/O buffer, must be a multiple of 512
+	// bytes. If zero, a default buffer size is used.
+	BufSize int
+
+	// Flush data to storage when the operation is done.
+	Flush bool
+
+	// Sparse enables zero detection when receiving data. Chunks full of
+	// zeros are not written; instead a hole is punched in the file, keeping
+	// thin images thin. Only used for regular files, since block devices are
+	// not known to read back zeros after discarding.
+	Sparse bool
+
+	// Progress is set after each chunk if not nil.
+	Progress Progress
+}
+
+// Operation is an I/O operation keeping the current progress, like the Python
+// version.
+//
+// An operation is created with NewReceive, NewSend, NewZero or NewFlush and
+// started with Run. Other goroutines may watch the operation progress, cancel
+// it, or wait until it is done.
+type Operation struct {
+	value   int64 // Must be aligned to 8 byte to use atomic
+	started int32
+	opts    Options
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+	run     func(op *Operation) error
+}
+
+func newOperation(ctx context.Context, opts Options, run func(op *Operation) error) *Operation {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Operation{
+		opts:   opts,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		run:    run,
+	}
+}
+
+// NewReceive creates an operation copying opts.Size bytes from reader to
+// opts.Path, starting at opts.Offset.
+func NewReceive(ctx context.Context, reader io.Reader, opts Options) *Operation {
+	return newOperation(ctx, opts, func(op *Operation) error {
+		return op.receive(reader)
+	})
+}
+
+// NewSend creates an operation copying opts.Size bytes from opts.Path to
+// writer, starting at opts.Offset.
+func NewSend(ctx context.Context, writer io.Writer, opts Options) *Operation {
+	return newOperation(ctx, opts, func(op *Operation) error {
+		return op.send(writer)
+	})
+}
+
+// NewZero creates an operation zeroing opts.Size bytes in opts.Path, starting
+// at opts.Offset.
+func NewZero(ctx context.Context, opts Options) *Operation {
+	return newOperation(ctx, opts, func(op *Operation) error {
+		return op.zero()
+	})
+}
+
+// NewFlush creates an operation flushing data written to opts.Path to
+// storage. Offset, Size and Flush are ignored.
+func NewFlush(ctx context.Context, opts Options) *Operation {
+	return newOperation(ctx, opts, func(op *Operation) error {
+		return op.flush()
+	})
+}
+
+// Run runs the operation, returning when the operation is done. If the
+// operation was canceled, ErrCanceled is returned.
+//
+// An operation can run only once.
+func (op *Operation) Run() error {
+	if !atomic.CompareAndSwapInt32(&op.started, 0, 1) {
+		return fmt.Errorf("operation already started")
+	}
+	defer close(op.done)
+	defer op.cancel()
+
+	if op.opts.Size < 0 || op.opts.Offset < 0 {
+		return fmt.Errorf("size and offset must not be negative: size=%v offset=%v",
+			op.opts.Size, op.opts.Offset)
+	}
+
+	return op.run(op)
+}
+
+// Cancel cancels the operation. The operation stops before copying the next
+// chunk.
+func (op *Operation) Cancel() {
+	op.cancel()
+}
+
+// Done returns a channel that is closed when the operation is done.
+func (op *Operation) Done() <-chan struct{} {
+	return op.done
+}
+
+// Progress returns the number of bytes processed so far.
+func (op *Operation) Progress() int64 {
+	return atomic.LoadInt64(&op.value)
+}
+
+// canceled returns true if the operation was canceled.
+func (op *Operation) canceled() bool {
+	return op.ctx.Err() != nil
+}
+
+// add adds n bytes to the operation progress.
+func (op *Operation) add(n int64) {
+	value := atomic.AddInt64(&op.value, n)
+	if op.opts.Progress != nil {
+		op.opts.Progress.Set(value)
+	}
+}
+
+// aligned returns true if the operation offset and size are aligned for
+// direct I/O.
+func (op *Operation) aligned() bool {
+	return op.opts.Offset%blocksize == 0 && op.opts.Size%blocksize == 0
+}
+
+// buffer allocates an aligned buffer for the operation. The buffer is not
+// larger than the operation size rounded up to the block size.
+func (op *Operation) buffer() ([]byte, error) {
+	size := op.opts.BufSize
+	if size == 0 {
+		size = bufsize
+	}
+	if op.opts.Size < int64(size) {
+		size = int(op.opts.Size)
+		if size%blocksize != 0 {
+			size += blocksize - size%blocksize
+		}
+	}
+	return AlignedBuffer(size, alignment)
+}
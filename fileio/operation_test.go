@@ -0,0 +1,202 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package fileio
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"ovirt/imageio/testutil"
+	"reflect"
+	"testing"
+)
+
+func TestOperationReceive(t *testing.T) {
+	const size = 4096
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	buf := testutil.Buffer(size)
+	progress := &recordingProgress{}
+	op := NewReceive(context.Background(), bytes.NewReader(buf), Options{
+		Path:     path,
+		Size:     size,
+		BufSize:  1024,
+		Flush:    true,
+		Progress: progress,
+	})
+	if err = op.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if op.Progress() != size {
+		t.Fatalf("Expected progress %v, got %v", size, op.Progress())
+	}
+	expected := []int64{1024, 2048, 3072, 4096}
+	if !reflect.DeepEqual(progress.values, expected) {
+		t.Fatalf("Expected progress values %v, got %v", expected, progress.values)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, buf) {
+		t.Fatalf("Expected %v, got %v", buf, content)
+	}
+}
+
+func TestOperationSend(t *testing.T) {
+	const size = 4096
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	buf := testutil.Buffer(size)
+	if err = ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	writer := &bytes.Buffer{}
+	op := NewSend(context.Background(), writer, Options{
+		Path:    path,
+		Offset:  1024,
+		Size:    2048,
+		BufSize: 512,
+	})
+	if err = op.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if op.Progress() != 2048 {
+		t.Fatalf("Expected progress %v, got %v", 2048, op.Progress())
+	}
+	if !bytes.Equal(writer.Bytes(), buf[1024:3072]) {
+		t.Fatalf("Expected %v, got %v", buf[1024:3072], writer.Bytes())
+	}
+}
+
+func TestOperationZero(t *testing.T) {
+	checkZero(t, func(path string) error {
+		op := NewZero(context.Background(), Options{
+			Path:   path,
+			Offset: 512,
+			Size:   1024,
+		})
+		err := op.Run()
+		if err == nil && op.Progress() != 1024 {
+			t.Fatalf("Expected progress %v, got %v", 1024, op.Progress())
+		}
+		return err
+	})
+}
+
+func TestOperationCancel(t *testing.T) {
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	op := NewSend(context.Background(), &bytes.Buffer{}, Options{
+		Path: path,
+		Size: 1024,
+	})
+	op.Cancel()
+	if err = op.Run(); err != ErrCanceled {
+		t.Fatalf("Expected %v, got %v", ErrCanceled, err)
+	}
+	if op.Progress() != 0 {
+		t.Fatalf("Expected no progress, got %v", op.Progress())
+	}
+}
+
+func TestOperationDone(t *testing.T) {
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	op := NewFlush(context.Background(), Options{Path: path})
+
+	select {
+	case <-op.Done():
+		t.Fatal("Operation done before running")
+	default:
+	}
+
+	if err = op.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-op.Done():
+	default:
+		t.Fatal("Operation not done after running")
+	}
+}
+
+func TestOperationRunTwice(t *testing.T) {
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	op := NewFlush(context.Background(), Options{Path: path})
+	if err = op.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err = op.Run(); err == nil {
+		t.Fatal("Operation run twice")
+	}
+}
+
+func TestOperationBadBufSize(t *testing.T) {
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	op := NewSend(context.Background(), &bytes.Buffer{}, Options{
+		Path:    path,
+		Size:    1024,
+		BufSize: 100,
+	})
+	if err = op.Run(); err == nil {
+		t.Fatal("Operation with unaligned buffer size did not fail")
+	}
+}
+
+func TestOperationNegativeSize(t *testing.T) {
+	op := NewZero(context.Background(), Options{
+		Path: "/var/tmp/no-such-file",
+		Size: -512,
+	})
+	if err := op.Run(); err == nil {
+		t.Fatal("Operation with negative size did not fail")
+	}
+}
+
+// recordingProgress records progress values.
+type recordingProgress struct {
+	values []int64
+}
+
+func (p *recordingProgress) Set(value int64) {
+	p.values = append(p.values, value)
+}
@@ -0,0 +1,60 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package fileio
+
+import (
+	"bytes"
+	"syscall"
+)
+
+// Compared with data to detect zeros. bytes.Equal is optimized, so this is
+// much faster than checking byte by byte.
+var zeros = make([]byte, 64*1024)
+
+// isZero returns true if b contains only zeros.
+func isZero(b []byte) bool {
+	for len(b) > 0 {
+		n := len(b)
+		if n > len(zeros) {
+			n = len(zeros)
+		}
+		if !bytes.Equal(b[:n], zeros[:n]) {
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
+
+// isRegularFile returns true if file is a regular file. Holes punched in
+// regular files are known to read back as zeros.
+func isRegularFile(file *File) (bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	return info.Mode().IsRegular(), nil
+}
+
+// punchHole deallocates size bytes at offset, so they read back as zeros. If
+// the range is after the end of the file, the file is extended.
+func punchHole(file *File, offset int64, size int64) error {
+	err := syscall.Fallocate(int(file.Fd()), fallocPunchHole|fallocKeepSize, offset, size)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < offset+size {
+		return file.Truncate(offset + size)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package fileio
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"ovirt/imageio/testutil"
+	"reflect"
+	"testing"
+)
+
+const sparseChunk = 1024 * 1024
+
+func TestIsZero(t *testing.T) {
+	buf := make([]byte, 3*len(zeros)+512)
+	if !isZero(buf) {
+		t.Fatal("Zero buffer not detected")
+	}
+	if !isZero(buf[:0]) {
+		t.Fatal("Empty buffer not detected")
+	}
+	buf[len(buf)-1] = 1
+	if isZero(buf) {
+		t.Fatal("Non zero buffer detected as zero")
+	}
+}
+
+func TestReceiveSparse(t *testing.T) {
+	const size = 3 * sparseChunk
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	// Allocate the entire file.
+	if err = ioutil.WriteFile(path, bytes.Repeat([]byte{1}, size), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := testutil.Buffer(size)
+	copy(buf[sparseChunk:2*sparseChunk], make([]byte, sparseChunk))
+
+	op := NewReceive(context.Background(), bytes.NewReader(buf), Options{
+		Path:    path,
+		Size:    size,
+		BufSize: sparseChunk,
+		Flush:   true,
+		Sparse:  true,
+	})
+	if err = op.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, buf) {
+		t.Fatal("Unexpected content")
+	}
+
+	extents, err := Extents(path, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Extent{
+		{0, sparseChunk, false, false},
+		{sparseChunk, sparseChunk, true, true},
+		{2 * sparseChunk, sparseChunk, false, false},
+	}
+	if !reflect.DeepEqual(extents, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, extents)
+	}
+}
+
+func TestReceiveSparseExtend(t *testing.T) {
+	path, err := testutil.CreateFile(sparseChunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	op := NewReceive(context.Background(), bytes.NewReader(make([]byte, sparseChunk)), Options{
+		Path:   path,
+		Offset: sparseChunk,
+		Size:   sparseChunk,
+		Sparse: true,
+	})
+	if err = op.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 2*sparseChunk {
+		t.Fatalf("Expected size %v, got %v", 2*sparseChunk, info.Size())
+	}
+}
+
+func TestReceiveNotSparse(t *testing.T) {
+	const size = sparseChunk
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	op := NewReceive(context.Background(), bytes.NewReader(make([]byte, size)), Options{
+		Path: path,
+		Size: size,
+	})
+	if err = op.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	extents, err := Extents(path, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Extent{{0, size, false, false}}
+	if !reflect.DeepEqual(extents, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, extents)
+	}
+}
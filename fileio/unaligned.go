@@ -0,0 +1,312 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package fileio
+
+import (
+	"io"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Direct I/O requires aligned offset and size. To support unaligned images
+// and requests, we read and write the unaligned head and tail of a range
+// using a bounce buffer of one block. The aligned middle of the range uses
+// the normal fast path.
+
+// readBlock reads the block at offset into block, returning the number of
+// bytes read. If the block is after the end of the file, the rest of the
+// block is zeroed.
+//
+// We use a single pread; retrying after a short read would use an unaligned
+// offset, failing with direct I/O.
+func readBlock(file *File, block []byte, offset int64) (int, error) {
+	n, err := syscall.Pread(int(file.Fd()), block, offset)
+	if err != nil {
+		return 0, err
+	}
+	for i := n; i < len(block); i++ {
+		block[i] = 0
+	}
+	return n, nil
+}
+
+// updateBlock modifies the bytes from pos up to end or to the end of the
+// block containing pos, using read-modify-write. Returns the number of bytes
+// modified.
+//
+// Concurrent requests may update different bytes in the same block, so the
+// read-modify-write is serialized per file. The new bytes are prepared before
+// locking, so a slow reader does not block other requests.
+//
+// If the block is the last block of a file with unaligned size, the file is
+// truncated after writing the block, to keep the file size, unless another
+// request extended the file meanwhile.
+func updateBlock(file *File, block []byte, pos int64, end int64, modify func(b []byte) error) (int64, error) {
+	start := pos - pos%blocksize
+	first := pos - start
+	last := int64(len(block))
+	if end-start < last {
+		last = end - start
+	}
+
+	var data [blocksize]byte
+	if err := modify(data[first:last]); err != nil {
+		return 0, err
+	}
+
+	unlock, err := lockFile(file)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	valid, err := readBlock(file, block, start)
+	if err != nil {
+		return 0, err
+	}
+
+	copy(block[first:last], data[first:last])
+
+	if _, err = file.WriteAt(block, start); err != nil {
+		return 0, err
+	}
+
+	newEnd := int64(valid)
+	if last > newEnd {
+		newEnd = last
+	}
+	if newEnd < int64(len(block)) {
+		var st syscall.Stat_t
+		if err = syscall.Fstat(int(file.Fd()), &st); err != nil {
+			return 0, err
+		}
+		if st.Size <= start+int64(len(block)) {
+			if err = file.Truncate(start + newEnd); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return last - first, nil
+}
+
+// fileID identifies a file, regardless of the path used to open it.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// fileLock serializes read-modify-write of blocks in a file.
+type fileLock struct {
+	sync.Mutex
+	refs int
+}
+
+var (
+	fileLocksMutex sync.Mutex
+	fileLocks      = map[fileID]*fileLock{}
+)
+
+// lockFile locks file for read-modify-write of a block, returning a function
+// unlocking the file.
+func lockFile(file *File) (func(), error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(file.Fd()), &st); err != nil {
+		return nil, err
+	}
+	id := fileID{uint64(st.Dev), st.Ino}
+
+	fileLocksMutex.Lock()
+	l := fileLocks[id]
+	if l == nil {
+		l = &fileLock{}
+		fileLocks[id] = l
+	}
+	l.refs++
+	fileLocksMutex.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		fileLocksMutex.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(fileLocks, id)
+		}
+		fileLocksMutex.Unlock()
+	}, nil
+}
+
+// sendBlock writes the bytes from pos up to end or to the end of the block
+// containing pos to writer. Returns the number of bytes sent.
+func sendBlock(file *File, writer io.Writer, block []byte, pos int64, end int64) (int64, error) {
+	start := pos - pos%blocksize
+	valid, err := readBlock(file, block, start)
+	if err != nil {
+		return 0, err
+	}
+
+	first := pos - start
+	last := int64(len(block))
+	if end-start < last {
+		last = end - start
+	}
+
+	if int64(valid) < last {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	n, err := writer.Write(block[first:last])
+	if err == nil && int64(n) != last-first {
+		err = io.ErrShortWrite
+	}
+	return int64(n), err
+}
+
+// ReadAt reads len(p) bytes from file at offset off. Unlike file.ReadAt, p
+// and off do not need to be aligned; unaligned reads use a bounce buffer.
+// If the file is too short, the bytes read are returned with io.EOF.
+func ReadAt(file *File, p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	if isAligned(p, off) {
+		return readAligned(file, p, off)
+	}
+
+	buf, err := AlignedBuffer(bounceSize(off, len(p)), alignment)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		start := pos - pos%blocksize
+		first := int(pos - start)
+		count := first + len(p) - n
+		if count%blocksize != 0 {
+			count += blocksize - count%blocksize
+		}
+		if count > len(buf) {
+			count = len(buf)
+		}
+
+		got, err := syscall.Pread(int(file.Fd()), buf[:count], start)
+		if err != nil {
+			return n, err
+		}
+		if got <= first {
+			return n, io.EOF
+		}
+		n += copy(p[n:], buf[first:got])
+		if got < count && n < len(p) {
+			return n, io.EOF
+		}
+	}
+
+	return n, nil
+}
+
+// WriteAt writes len(p) bytes to file at offset off. Unlike file.WriteAt, p
+// and off do not need to be aligned; the unaligned head and tail are written
+// using read-modify-write, and the middle is copied to a bounce buffer.
+func WriteAt(file *File, p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	if isAligned(p, off) {
+		return file.WriteAt(p, off)
+	}
+
+	buf, err := AlignedBuffer(bounceSize(off, len(p)), alignment)
+	if err != nil {
+		return 0, err
+	}
+
+	pos := off
+	end := off + int64(len(p))
+	copyFrom := func(b []byte) error {
+		copy(b, p[pos-off:])
+		return nil
+	}
+
+	if pos%blocksize != 0 {
+		n, err := updateBlock(file, buf[:blocksize], pos, end, copyFrom)
+		if err != nil {
+			return int(pos - off), err
+		}
+		pos += n
+	}
+
+	alignedEnd := end - end%blocksize
+	for pos < alignedEnd {
+		count := int64(len(buf))
+		if alignedEnd-pos < count {
+			count = alignedEnd - pos
+		}
+		copy(buf[:count], p[pos-off:])
+		if _, err := file.WriteAt(buf[:count], pos); err != nil {
+			return int(pos - off), err
+		}
+		pos += count
+	}
+
+	if pos < end {
+		n, err := updateBlock(file, buf[:blocksize], pos, end, copyFrom)
+		if err != nil {
+			return int(pos - off), err
+		}
+		pos += n
+	}
+
+	return int(pos - off), nil
+}
+
+// readAligned reads into aligned p until p is full. A short read that is not
+// a multiple of the block size can happen only at the end of a file with an
+// unaligned size.
+func readAligned(file *File, p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		got, err := syscall.Pread(int(file.Fd()), p[n:], off+int64(n))
+		if err != nil {
+			return n, err
+		}
+		if got == 0 {
+			return n, io.EOF
+		}
+		n += got
+		if got%blocksize != 0 && n < len(p) {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// isAligned returns true if p and off can be used with direct I/O.
+func isAligned(p []byte, off int64) bool {
+	return len(p) > 0 &&
+		off%blocksize == 0 &&
+		len(p)%blocksize == 0 &&
+		uintptr(unsafe.Pointer(&p[0]))%alignment == 0
+}
+
+// bounceSize returns the size of a bounce buffer for size bytes at offset,
+// covering the entire range, but not larger than bufsize.
+func bounceSize(offset int64, size int) int {
+	n := int(offset%blocksize) + size
+	if n%blocksize != 0 {
+		n += blocksize - n%blocksize
+	}
+	if n > bufsize {
+		n = bufsize
+	}
+	return n
+}
@@ -0,0 +1,265 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package fileio
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"ovirt/imageio/testutil"
+	"sync"
+	"testing"
+)
+
+func TestReadAtUnaligned(t *testing.T) {
+	for _, r := range unalignedRanges {
+		path, err := testutil.CreateFile(r.filesize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(path)
+
+		content := testutil.Buffer(r.filesize)
+		if err = ioutil.WriteFile(path, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := Open(path, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+
+		buf := make([]byte, r.size)
+		n, err := ReadAt(file, buf, r.offset)
+		if err != nil {
+			t.Fatalf("%+v: %v", r, err)
+		}
+		if int64(n) != r.size {
+			t.Fatalf("%+v: read %v bytes, expected %v", r, n, r.size)
+		}
+		expected := content[r.offset : r.offset+r.size]
+		if !bytes.Equal(buf, expected) {
+			t.Fatalf("%+v: expected %v, got %v", r, expected, buf)
+		}
+	}
+}
+
+func TestReadWriteAtNegativeOffset(t *testing.T) {
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	file, err := Open(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	buf := make([]byte, 256)
+	if _, err := ReadAt(file, buf, -256); err == nil {
+		t.Fatal("Reading at negative offset did not fail")
+	}
+	if _, err := WriteAt(file, buf, -256); err == nil {
+		t.Fatal("Writing at negative offset did not fail")
+	}
+}
+
+func TestReadAtAligned(t *testing.T) {
+	const size = 4096
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	content := testutil.Buffer(size)
+	if err = ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := Open(path, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	buf, err := AlignedBuffer(2048, alignment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := ReadAt(file, buf, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(buf) {
+		t.Fatalf("Read %v bytes, expected %v", n, len(buf))
+	}
+	if !bytes.Equal(buf, content[1024:3072]) {
+		t.Fatalf("Expected %v, got %v", content[1024:3072], buf)
+	}
+}
+
+func TestReadAtEOF(t *testing.T) {
+	path, err := testutil.CreateFile(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	file, err := Open(path, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	buf, err := AlignedBuffer(1024, alignment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := ReadAt(file, buf, 0)
+	if err != io.EOF {
+		t.Fatalf("Expected io.EOF, got %v", err)
+	}
+	if n != 1000 {
+		t.Fatalf("Read %v bytes, expected 1000", n)
+	}
+
+	n, err = ReadAt(file, buf[:10], 995)
+	if err != io.EOF {
+		t.Fatalf("Expected io.EOF, got %v", err)
+	}
+	if n != 5 {
+		t.Fatalf("Read %v bytes, expected 5", n)
+	}
+}
+
+func TestWriteAtUnaligned(t *testing.T) {
+	for _, r := range unalignedRanges {
+		path, err := testutil.CreateFile(r.filesize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(path)
+
+		// Fill the file with ones to detect unwanted modifications.
+		expected := bytes.Repeat([]byte{1}, r.filesize)
+		if err = ioutil.WriteFile(path, expected, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := Open(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+
+		buf := testutil.Buffer(int(r.size))
+		n, err := WriteAt(file, buf, r.offset)
+		if err != nil {
+			t.Fatalf("%+v: %v", r, err)
+		}
+		if int64(n) != r.size {
+			t.Fatalf("%+v: wrote %v bytes, expected %v", r, n, r.size)
+		}
+
+		copy(expected[r.offset:], buf)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, expected) {
+			t.Fatalf("%+v: expected %v, got %v", r, expected, content)
+		}
+	}
+}
+
+func TestWriteAtExtend(t *testing.T) {
+	path, err := testutil.CreateFile(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	file, err := Open(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	buf := testutil.Buffer(10)
+	if _, err = WriteAt(file, buf, 2000); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make([]byte, 2010)
+	copy(expected[2000:], buf)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, expected) {
+		t.Fatalf("Expected %v, got %v", expected, content)
+	}
+}
+
+func TestWriteAtConcurrentBlock(t *testing.T) {
+	path, err := testutil.CreateFile(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	// Every writer modifies different bytes in the same blocks, using its
+	// own file, like concurrent requests.
+	const writers = 16
+	var wg sync.WaitGroup
+	errors := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			file, err := Open(path, os.O_RDWR, 0)
+			if err != nil {
+				errors <- err
+				return
+			}
+			defer file.Close()
+			for j := 0; j < 50; j++ {
+				for _, off := range []int64{int64(100 + i), int64(900 + i)} {
+					if _, err := WriteAt(file, []byte{byte(i + 1)}, off); err != nil {
+						errors <- err
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errors)
+	for err := range errors {
+		t.Fatal(err)
+	}
+
+	expected := make([]byte, 1000)
+	for i := 0; i < writers; i++ {
+		expected[100+i] = byte(i + 1)
+		expected[900+i] = byte(i + 1)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, expected) {
+		t.Fatalf("Expected %v, got %v", expected, content)
+	}
+}
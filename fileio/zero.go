@@ -0,0 +1,211 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package fileio
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// From linux/falloc.h
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+	fallocZeroRange = 0x10
+
+	// From linux/fs.h: _IO(0x12, 127)
+	blkZeroOut = 0x127f
+
+	// Zeroing large ranges may be slow on some storage, so we zero in steps
+	// to allow cancellation.
+	zeroStep = 1024 * 1024 * 1024
+)
+
+// Zero zeroes size bytes in path, starting at offset, without sending zeros
+// from userspace when possible.
+//
+// Files are zeroed using fallocate, block devices using the BLKZEROOUT ioctl.
+// If the storage does not support these, we fall back to writing zeros.
+func Zero(path string, size int64, offset int64, flush bool) (err error) {
+	return ZeroContext(context.Background(), path, size, offset, flush)
+}
+
+// ZeroContext is like Zero, but stops zeroing and returns ErrCanceled when ctx
+// is canceled. Cancellation is checked before each chunk is zeroed.
+func ZeroContext(ctx context.Context, path string, size int64, offset int64, flush bool) error {
+	op := NewZero(ctx, Options{
+		Path:   path,
+		Offset: offset,
+		Size:   size,
+		Flush:  flush,
+	})
+	return op.Run()
+}
+
+func (op *Operation) zero() (err error) {
+	flag := os.O_WRONLY
+	if !op.aligned() {
+		// Unaligned head or tail are zeroed using read-modify-write.
+		flag = os.O_RDWR
+	}
+	file, err := Open(op.opts.Path, flag, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	err = op.zeroData(file)
+
+	if op.opts.Flush {
+		if se := file.Sync(); se != nil && err == nil {
+			err = se
+		}
+	}
+
+	return
+}
+
+func (op *Operation) zeroData(file *File) error {
+	pos := op.opts.Offset
+	end := pos + op.opts.Size
+
+	var block []byte
+	if !op.aligned() {
+		var err error
+		if block, err = AlignedBuffer(blocksize, alignment); err != nil {
+			return err
+		}
+	}
+
+	if pos%blocksize != 0 {
+		n, err := updateBlock(file, block, pos, end, clearBytes)
+		if err != nil {
+			return err
+		}
+		pos += n
+		op.add(n)
+	}
+
+	alignedEnd := end - end%blocksize
+
+	for pos < alignedEnd {
+		if op.canceled() {
+			return ErrCanceled
+		}
+		step := alignedEnd - pos
+		if step > zeroStep {
+			step = zeroStep
+		}
+		if err := zeroRange(file, pos, step); err != nil {
+			return err
+		}
+		pos += step
+		op.add(step)
+	}
+
+	if pos < end {
+		if op.canceled() {
+			return ErrCanceled
+		}
+		n, err := updateBlock(file, block, pos, end, clearBytes)
+		if err != nil {
+			return err
+		}
+		op.add(n)
+	}
+
+	return nil
+}
+
+func clearBytes(b []byte) error {
+	for i := range b {
+		b[i] = 0
+	}
+	return nil
+}
+
+func zeroRange(file *File, offset int64, size int64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if isBlockDevice(info) {
+		err = zeroBlockDevice(file.File, offset, size)
+	} else {
+		err = zeroFile(file.File, offset, size)
+	}
+	if err == syscall.EOPNOTSUPP {
+		err = writeZeros(file, offset, size)
+	}
+	return err
+}
+
+func isBlockDevice(info os.FileInfo) bool {
+	mode := info.Mode()
+	return mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0
+}
+
+// zeroFile zeroes a range in a file using fallocate. Zeroing a range
+// allocates the range, keeping the file fully allocated. If the file system
+// does not support this, we try to punch a hole, which reads back as zeros.
+func zeroFile(file *os.File, offset int64, size int64) error {
+	fd := int(file.Fd())
+	err := syscall.Fallocate(fd, fallocZeroRange, offset, size)
+	if err == syscall.EOPNOTSUPP {
+		err = syscall.Fallocate(fd, fallocPunchHole|fallocKeepSize, offset, size)
+	}
+	return err
+}
+
+// zeroBlockDevice zeroes a range in a block device using BLKZEROOUT.
+func zeroBlockDevice(file *os.File, offset int64, size int64) error {
+	arg := [2]uint64{uint64(offset), uint64(size)}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), blkZeroOut,
+		uintptr(unsafe.Pointer(&arg[0])))
+	if errno != 0 {
+		if errno == syscall.EINVAL {
+			// Older kernels do not support this ioctl.
+			return syscall.EOPNOTSUPP
+		}
+		return errno
+	}
+	return nil
+}
+
+// writeZeros zeroes a range by writing zeros, for storage that does not
+// support a better way.
+func writeZeros(file *File, offset int64, size int64) error {
+	buflen := int64(bufsize)
+	if size < buflen {
+		buflen = size
+	}
+	buf, err := AlignedBuffer(int(buflen), alignment)
+	if err != nil {
+		return err
+	}
+
+	for size > 0 {
+		b := buf
+		if size < int64(len(buf)) {
+			b = buf[:size]
+		}
+		n, err := file.WriteAt(b, offset)
+		if err != nil {
+			return err
+		}
+		file.DropCache(offset, int64(n))
+		offset += int64(n)
+		size -= int64(n)
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package fileio
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"ovirt/imageio/testutil"
+	"testing"
+)
+
+func TestZero(t *testing.T) {
+	for _, flush := range []bool{false, true} {
+		checkZero(t, func(path string) error {
+			return Zero(path, 1024, 512, flush)
+		})
+	}
+}
+
+func TestWriteZeros(t *testing.T) {
+	checkZero(t, func(path string) error {
+		file, err := Open(path, os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return writeZeros(file, 512, 1024)
+	})
+}
+
+func TestZeroEmpty(t *testing.T) {
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	if err = Zero(path, 0, 0, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestZeroCanceled(t *testing.T) {
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	buf := testutil.Buffer(1024)
+	if err = ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err = ZeroContext(ctx, path, 1024, 0, false); err != ErrCanceled {
+		t.Fatalf("Expected %v, got %v", ErrCanceled, err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, buf) {
+		t.Fatalf("Expected %v, got %v", buf, content)
+	}
+}
+
+func TestZeroUnalignedHead(t *testing.T) {
+	checkZeroRange(t, 100, 924)
+}
+
+func TestZeroUnalignedTail(t *testing.T) {
+	checkZeroRange(t, 512, 600)
+}
+
+func TestZeroUnalignedHeadTail(t *testing.T) {
+	checkZeroRange(t, 100, 1500)
+}
+
+func TestZeroUnalignedInsideBlock(t *testing.T) {
+	checkZeroRange(t, 600, 100)
+}
+
+// checkZeroRange fills a 2048 bytes file with data, zeroes size bytes at
+// offset, and checks that only that range was zeroed and the file size did not
+// change.
+func checkZeroRange(t *testing.T, offset int64, size int64) {
+	const filesize = 2048
+	path, err := testutil.CreateFile(filesize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	buf := testutil.Buffer(filesize)
+	if err = ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = Zero(path, size, offset, true); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make([]byte, filesize)
+	copy(expected, buf)
+	copy(expected[offset:offset+size], make([]byte, size))
+	if !bytes.Equal(content, expected) {
+		t.Fatalf("Expected %v, got %v", expected, content)
+	}
+}
+
+// checkZero fills a 2048 bytes file with data, calls zero to zero 1024 bytes
+// at offset 512, and checks that only that range was zeroed.
+func checkZero(t *testing.T, zero func(path string) error) {
+	const size = 2048
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	buf := testutil.Buffer(size)
+	if err = ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = zero(path); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != size {
+		t.Fatalf("Expected size %v, got %v", size, len(content))
+	}
+	if !bytes.Equal(content[:512], buf[:512]) {
+		t.Fatalf("Expected %v, got %v", buf[:512], content[:512])
+	}
+	empty := make([]byte, 1024)
+	if !bytes.Equal(content[512:1536], empty) {
+		t.Fatalf("Expected %v, got %v", empty, content[512:1536])
+	}
+	if !bytes.Equal(content[1536:], buf[1536:]) {
+		t.Fatalf("Expected %v, got %v", buf[1536:], content[1536:])
+	}
+}
@@ -9,17 +9,43 @@
 package images
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"ovirt/imageio/auth"
+	"ovirt/imageio/backend"
 	"ovirt/imageio/fileio"
+	"strconv"
+	"strings"
 )
 
 const (
-	ROOT = "/images/"
+	ROOT    = "/images/"
+	EXTENTS = "/extents"
+
+	// Patch requests are small json messages, no need to read more.
+	maxPatchSize = 4096
+
+	// Hint for clients about the number of parallel connections that may
+	// improve throughput.
+	maxConnections = 8
 )
 
+// features supported by the server, and the ticket operation required to
+// use them.
+var features = []struct {
+	name string
+	op   string
+}{
+	{"zero", "write"},
+	{"flush", "write"},
+	{"extents", "read"},
+}
+
 var (
 	listener net.Listener
 )
@@ -68,11 +94,25 @@ func Addr() string {
 }
 
 func handle(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, EXTENTS) {
+		switch r.Method {
+		case "GET":
+			extents(w, r)
+		default:
+			http.Error(w, "You are not allowed to "+r.Method, http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
 	switch r.Method {
 	case "PUT":
 		put(w, r)
 	case "GET":
-		http.NotFound(w, r)
+		get(w, r)
+	case "PATCH":
+		patch(w, r)
+	case "OPTIONS":
+		options(w, r)
 	default:
 		http.Error(w, "You are not allowed to "+r.Method, http.StatusMethodNotAllowed)
 		return
@@ -81,14 +121,445 @@ func handle(w http.ResponseWriter, r *http.Request) {
 
 func put(w http.ResponseWriter, r *http.Request) {
 	ticketUuid := r.URL.Path[len(ROOT):]
-	url, err := auth.MayWrite(ticketUuid, r.ContentLength)
+
+	if r.ContentLength < 0 {
+		http.Error(w, "Content-Length required", http.StatusLengthRequired)
+		return
+	}
+
+	flush, err := parseFlush(r.URL.Query().Get("flush"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	offset := int64(0)
+	length := r.ContentLength
+
+	if s := r.Header.Get("Content-Range"); s != "" {
+		offset, length, err = parseContentRange(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if length != r.ContentLength {
+			msg := fmt.Sprintf("Content-Range length %d does not match Content-Length %d",
+				length, r.ContentLength)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+	}
+
+	url, err := auth.MayWrite(ticketUuid, offset, length)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	ticket, err := auth.Get(ticketUuid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	task, err := auth.Begin(r.Context(), ticketUuid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	defer task.Done()
+
+	b, err := openBackend(ticketUuid, url, backend.OpenOptions{Writable: true})
+	if err != nil {
+		operationError(w, err)
+		return
+	}
+	defer b.Close()
+
+	err = backend.Receive(task.Context(), b, r.Body, backend.Options{
+		Offset:   offset,
+		Size:     length,
+		Flush:    flush,
+		Sparse:   ticket.Sparse,
+		Progress: task,
+	})
+	if err != nil {
+		operationError(w, err)
+		return
+	}
+}
+
+func get(w http.ResponseWriter, r *http.Request) {
+	ticketUuid := r.URL.Path[len(ROOT):]
+	size, err := auth.Size(ticketUuid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	offset := int64(0)
+	length := size
+	status := http.StatusOK
+
+	if s := r.Header.Get("Range"); s != "" {
+		offset, length, err = parseRange(s, size)
+		if err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		status = http.StatusPartialContent
+	}
+
+	url, err := auth.MayRead(ticketUuid, offset, length)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	task, err := auth.Begin(r.Context(), ticketUuid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	defer task.Done()
+
+	b, err := openBackend(ticketUuid, url, backend.OpenOptions{})
+	if err != nil {
+		operationError(w, err)
+		return
+	}
+	defer b.Close()
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	if status == http.StatusPartialContent {
+		w.Header().Set("Content-Range", contentRange(offset, length, size))
+	}
+	w.WriteHeader(status)
+
+	// Once we started to send the body, we cannot report errors. The server
+	// will close the connection since we sent less than Content-Length bytes.
+	backend.Send(task.Context(), b, w, backend.Options{
+		Offset:   offset,
+		Size:     length,
+		Progress: task,
+	})
+}
+
+// parseFlush parses the flush query parameter. Flushing is enabled by
+// default; clients sending many small requests can use "flush=n" and flush
+// once at the end using a PATCH request.
+func parseFlush(s string) (bool, error) {
+	switch s {
+	case "", "y":
+		return true, nil
+	case "n":
+		return false, nil
+	default:
+		return false, fmt.Errorf("Invalid flush value: %q", s)
+	}
+}
+
+// patchRequest is a request to modify an image without sending data.
+//
+// Examples:
+//
+//	{"op": "zero", "offset": 0, "size": 1073741824, "flush": true}
+//	{"op": "flush"}
+type patchRequest struct {
+	Op     string
+	Offset int64
+	Size   int64
+	Flush  bool
+}
+
+func patch(w http.ResponseWriter, r *http.Request) {
+	ticketUuid := r.URL.Path[len(ROOT):]
+
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, maxPatchSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req patchRequest
+	if err = json.Unmarshal(buf, &req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid json: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	switch req.Op {
+	case "zero":
+		zero(w, r, ticketUuid, &req)
+	case "flush":
+		flush(w, r, ticketUuid)
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported operation: %q", req.Op), http.StatusBadRequest)
+	}
+}
+
+func zero(w http.ResponseWriter, r *http.Request, ticketUuid string, req *patchRequest) {
+	if req.Offset < 0 || req.Size < 0 {
+		http.Error(w, "Offset and size must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	url, err := auth.MayWrite(ticketUuid, req.Offset, req.Size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	task, err := auth.Begin(r.Context(), ticketUuid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	defer task.Done()
+
+	b, err := openBackend(ticketUuid, url, backend.OpenOptions{Writable: true})
+	if err != nil {
+		operationError(w, err)
+		return
+	}
+	defer b.Close()
+
+	if err = b.Zero(task.Context(), req.Offset, req.Size); err != nil {
+		operationError(w, err)
+		return
+	}
+	if req.Flush {
+		if err = b.Flush(task.Context()); err != nil {
+			operationError(w, err)
+			return
+		}
+	}
+	task.Set(req.Size)
+}
+
+func flush(w http.ResponseWriter, r *http.Request, ticketUuid string) {
+	url, err := auth.MayWrite(ticketUuid, 0, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	task, err := auth.Begin(r.Context(), ticketUuid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	defer task.Done()
+
+	b, err := openBackend(ticketUuid, url, backend.OpenOptions{Writable: true})
+	if err != nil {
+		operationError(w, err)
+		return
+	}
+	defer b.Close()
+
+	if err = b.Flush(task.Context()); err != nil {
+		operationError(w, err)
+		return
+	}
+}
+
+// optionsResponse describes what the server and the ticket support, so
+// clients can select the best transfer strategy.
+type optionsResponse struct {
+	Features       []string `json:"features"`
+	Ops            []string `json:"ops"`
+	MaxConnections int      `json:"max_connections"`
+}
+
+// options handles OPTIONS requests. The special ticket "*" reports the
+// server capabilities regardless of any ticket.
+func options(w http.ResponseWriter, r *http.Request) {
+	ticketUuid := r.URL.Path[len(ROOT):]
+
+	var ops []string
+	supported := map[string]bool{}
+	for _, f := range features {
+		supported[f.name] = true
+	}
+
+	if ticketUuid == "*" {
+		ops = []string{"read", "write"}
+	} else {
+		ticket, err := auth.Get(ticketUuid)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		ops = ticket.Ops()
+
+		remote, limited, err := backendFeatures(r, ticket)
+		if err != nil {
+			operationError(w, err)
+			return
+		}
+		if limited {
+			supported = map[string]bool{}
+			for _, name := range remote {
+				supported[name] = true
+			}
+		}
+	}
+
+	resp := optionsResponse{
+		Features:       []string{},
+		Ops:            ops,
+		MaxConnections: maxConnections,
+	}
+	allowed := map[string]bool{}
+	allow := []string{"OPTIONS"}
+	for _, op := range ops {
+		allowed[op] = true
+		switch op {
+		case "read":
+			allow = append(allow, "GET")
+		case "write":
+			allow = append(allow, "PUT", "PATCH")
+		}
+	}
+	for _, f := range features {
+		if allowed[f.op] && supported[f.name] {
+			resp.Features = append(resp.Features, f.name)
+		}
+	}
+
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Allow", strings.Join(allow, ","))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	w.Write(buf)
+}
+
+// backendFeatures returns the features supported by the ticket backend, and
+// true if the backend supports only some of the features, like a backend
+// proxying to a remote server. If the backend cannot be opened, all features
+// are reported; the error will be reported when the image is accessed.
+func backendFeatures(r *http.Request, ticket *auth.Ticket) ([]string, bool, error) {
+	u, err := url.Parse(ticket.Url)
+	if err != nil {
+		return nil, false, nil
+	}
+	b, err := openBackend(ticket.Uuid, u, backend.OpenOptions{})
+	if err != nil {
+		return nil, false, nil
+	}
+	defer b.Close()
+
+	fb, ok := b.(backend.FeaturesBackend)
+	if !ok {
+		return nil, false, nil
+	}
+	features, err := fb.Features(r.Context())
+	if err != nil {
+		return nil, false, err
+	}
+	return features, true, nil
+}
+
+// extents handles GET /images/{ticket}/extents. The "context" query
+// parameter selects the kind of extents: "zero" (default) reports zero and
+// hole ranges, and "dirty" reports ranges modified since the ticket dirty
+// bitmap was created.
+func extents(w http.ResponseWriter, r *http.Request) {
+	// "/images/extents" also ends with "/extents", but has no ticket uuid.
+	if len(r.URL.Path) <= len(ROOT)+len(EXTENTS) {
+		http.Error(w, "No ticket uuid", http.StatusNotFound)
+		return
+	}
+	ticketUuid := r.URL.Path[len(ROOT) : len(r.URL.Path)-len(EXTENTS)]
+
+	context := r.URL.Query().Get("context")
+	if context != "" && context != "zero" && context != "dirty" {
+		http.Error(w, fmt.Sprintf("Invalid context: %q", context), http.StatusBadRequest)
+		return
+	}
+
+	size, err := auth.Size(ticketUuid)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
-	_, err = fileio.Receive(url.Path, r.Body, r.ContentLength, 0, nil)
+	url, err := auth.MayRead(ticketUuid, 0, size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	opts := backend.OpenOptions{}
+	if context == "dirty" {
+		ticket, err := auth.Get(ticketUuid)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if ticket.DirtyBitmap == "" {
+			http.Error(w, "Ticket does not have a dirty bitmap", http.StatusNotFound)
+			return
+		}
+		opts.DirtyBitmap = ticket.DirtyBitmap
+	}
+
+	b, err := openBackend(ticketUuid, url, opts)
+	if err != nil {
+		operationError(w, err)
+		return
+	}
+	defer b.Close()
+
+	var extents interface{}
+	if context == "dirty" {
+		db, ok := b.(backend.DirtyBackend)
+		if !ok {
+			http.Error(w, "Backend does not support dirty extents", http.StatusNotFound)
+			return
+		}
+		extents, err = db.DirtyExtents(r.Context(), 0, size)
+	} else {
+		extents, err = b.Extents(r.Context(), 0, size)
+	}
+	if err != nil {
+		operationError(w, err)
+		return
+	}
+
+	buf, err := json.Marshal(extents)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	w.Write(buf)
+}
+
+// operationError reports an error in a backend operation. Operations are
+// canceled when the ticket is removed, or when the client disconnects.
+func operationError(w http.ResponseWriter, err error) {
+	if err == fileio.ErrCanceled {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// openBackend opens the backend for the ticket url. The image format is
+// taken from the ticket, so all handlers open the image the same way.
+func openBackend(ticketUuid string, u *url.URL, opts backend.OpenOptions) (backend.Backend, error) {
+	ticket, err := auth.Get(ticketUuid)
+	if err != nil {
+		return nil, err
+	}
+	opts.Format = ticket.Format
+	return backend.Open(u, opts)
 }
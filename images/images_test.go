@@ -10,16 +10,358 @@ package images
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"ovirt/imageio/auth"
+	"ovirt/imageio/backend"
+	"ovirt/imageio/fileio"
+	"ovirt/imageio/nbd"
+	"ovirt/imageio/qcow2"
 	"ovirt/imageio/testutil"
+	"reflect"
 	"testing"
 )
 
-func TestGetNotFound(t *testing.T) {
+func TestTransferred(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	const size = 2048
+
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u, err := addTicket("rw", size, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	resp, err := request("PUT", "/images/"+u, testutil.Buffer(size))
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	resp.Body.Close()
+
+	msg := []byte(`{"op": "zero", "offset": 0, "size": 1024}`)
+	resp, err = request("PATCH", "/images/"+u, msg)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	resp.Body.Close()
+
+	resp, err = request("GET", "/images/"+u, nil)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	status, err := auth.GetStatus(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Transferred != 2*size+1024 {
+		t.Fatalf("Expected transferred=%v, got %v", 2*size+1024, status.Transferred)
+	}
+}
+
+func TestPutCanceled(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	const chunk = 8 * 1024 * 1024
+	const size = 3 * chunk
+
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u, err := addTicket("w", size, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	// Remove the ticket while the client is sending the second chunk.
+	body := &removingReader{
+		r:     bytes.NewReader(testutil.Buffer(size)),
+		limit: chunk,
+		u:     u,
+	}
+	url := fmt.Sprintf("http://%s/images/%s", Addr(), u)
+	req, err := http.NewRequest("PUT", url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = size
+
+	// The server may close the connection before reading the entire body,
+	// failing the request.
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("Expected %v, got %v", http.StatusForbidden, resp.StatusCode)
+		}
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty := make([]byte, chunk)
+	if !bytes.Equal(content[2*chunk:], empty) {
+		t.Fatal("Data written after ticket was removed")
+	}
+}
+
+// removingReader removes ticket u after reading limit bytes.
+type removingReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+	u     string
+}
+
+func (r *removingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	if r.read > r.limit {
+		auth.Remove(r.u)
+	}
+	return n, err
+}
+
+func TestPutSparse(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	const size = 1024 * 1024
+
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	if err = ioutil.WriteFile(path, testutil.Buffer(size), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	u := "3facfbc1-68e0-4b77-b0c6-87e66fcabcc2"
+	ticket := &auth.Ticket{
+		Mode:    "w",
+		Size:    size,
+		Timeout: 10,
+		Url:     "file://" + path,
+		Uuid:    u,
+		Sparse:  true,
+	}
+	if err = auth.Add(ticket); err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	buf := make([]byte, size)
+	resp, err := request("PUT", "/images/"+u, buf)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, buf) {
+		t.Fatal("Image was not zeroed")
+	}
+
+	extents, err := fileio.Extents(path, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range extents {
+		if !e.Hole {
+			t.Fatalf("Unexpected data extent: %+v", e)
+		}
+	}
+}
+
+func TestPutContentRange(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	const size = 2048
+
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u, err := addTicket("w", size, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	buf := testutil.Buffer(1024)
+	headers := map[string]string{"Content-Range": "bytes 512-1535/*"}
+	resp, err := requestWithHeaders("PUT", "/images/"+u, buf, headers)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty := make([]byte, 512)
+	if !bytes.Equal(content[:512], empty) {
+		t.Fatalf("Expected %v, got %v", empty, content[:512])
+	}
+	if !bytes.Equal(content[512:1536], buf) {
+		t.Fatalf("Expected %v, got %v", buf, content[512:1536])
+	}
+	if !bytes.Equal(content[1536:], empty) {
+		t.Fatalf("Expected %v, got %v", empty, content[1536:])
+	}
+}
+
+func TestPutContentRangeOutOfRange(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u, err := addTicket("w", 1024, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	buf := testutil.Buffer(1024)
+	headers := map[string]string{"Content-Range": "bytes 512-1535/*"}
+	resp, err := requestWithHeaders("PUT", "/images/"+u, buf, headers)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected %v, got %v", http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestPutContentRangeOverflow(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u, err := addTicket("w", 1024, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	// offset + length overflows int64.
+	buf := testutil.Buffer(100)
+	headers := map[string]string{
+		"Content-Range": "bytes 9223372036854775708-9223372036854775807/*",
+	}
+	resp, err := requestWithHeaders("PUT", "/images/"+u, buf, headers)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected %v, got %v", http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestPutContentRangeLengthMismatch(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	path, err := testutil.CreateFile(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u, err := addTicket("w", 2048, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	buf := testutil.Buffer(512)
+	headers := map[string]string{"Content-Range": "bytes 0-1023/*"}
+	resp, err := requestWithHeaders("PUT", "/images/"+u, buf, headers)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected %v, got %v", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestGetNoAuth(t *testing.T) {
 	err := Start("localhost:0")
 	if err != nil {
 		t.Fatal(err)
@@ -32,72 +374,1453 @@ func TestGetNotFound(t *testing.T) {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusNotFound {
-		t.Fatalf("Expected %v, got %v", http.StatusNotFound, resp.StatusCode)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected %v, got %v", http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestGet(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	const size = 1024
+
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	buf := testutil.Buffer(size)
+	if err = ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	u := "3facfbc1-68e0-4b77-b0c6-87e66fcabcc2"
+	ticket := &auth.Ticket{
+		Mode:    "r",
+		Size:    size,
+		Timeout: 10,
+		Url:     "file://" + path,
+		Uuid:    u,
+	}
+	err = auth.Add(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	resp, err := request("GET", "/images/"+u, nil)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, buf) {
+		t.Fatalf("Expected %v, got %v", buf, content)
+	}
+}
+
+func TestGetWriteOnly(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u := "3facfbc1-68e0-4b77-b0c6-87e66fcabcc2"
+	ticket := &auth.Ticket{
+		Mode:    "w",
+		Size:    1024,
+		Timeout: 10,
+		Url:     "file://" + path,
+		Uuid:    u,
+	}
+	err = auth.Add(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	resp, err := request("GET", "/images/"+u, nil)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected %v, got %v", http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestPutNoAuth(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	resp, err := request("PUT", "/images/no-such-ticket", nil)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected %v, got %v", http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestPut(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	const size = 1024
+
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u := "3facfbc1-68e0-4b77-b0c6-87e66fcabcc2"
+	ticket := &auth.Ticket{
+		Mode:    "rw",
+		Size:    size,
+		Timeout: 10,
+		Url:     "file://" + path,
+		Uuid:    u,
+	}
+	err = auth.Add(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	buf := testutil.Buffer(size)
+	resp, err := request("PUT", "/images/"+u, buf)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if !bytes.Equal(content, buf) {
+		t.Fatalf("Expected %v, got %v", buf, content)
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	const size = 2048
+
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	buf := testutil.Buffer(size)
+	if err = ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := addTicket("r", size, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	headers := map[string]string{"Range": "bytes=512-1535"}
+	resp, err := requestWithHeaders("GET", "/images/"+u, nil, headers)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Expected %v, got %v", http.StatusPartialContent, resp.StatusCode)
+	}
+
+	cr := resp.Header.Get("Content-Range")
+	if cr != "bytes 512-1535/2048" {
+		t.Fatalf("Unexpected Content-Range: %q", cr)
+	}
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, buf[512:1536]) {
+		t.Fatalf("Expected %v, got %v", buf[512:1536], content)
+	}
+}
+
+func TestGetRangeNotSatisfiable(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u, err := addTicket("r", 1024, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	headers := map[string]string{"Range": "bytes=1024-2047"}
+	resp, err := requestWithHeaders("GET", "/images/"+u, nil, headers)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("Expected %v, got %v", http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+	}
+
+	cr := resp.Header.Get("Content-Range")
+	if cr != "bytes */1024" {
+		t.Fatalf("Unexpected Content-Range: %q", cr)
+	}
+}
+
+func TestGetRangeUnaligned(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	const size = 1000
+
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	buf := testutil.Buffer(size)
+	if err = ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := addTicket("r", size, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	headers := map[string]string{"Range": "bytes=1-998"}
+	resp, err := requestWithHeaders("GET", "/images/"+u, nil, headers)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Expected %v, got %v", http.StatusPartialContent, resp.StatusCode)
+	}
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, buf[1:999]) {
+		t.Fatalf("Expected %v, got %v", buf[1:999], content)
+	}
+}
+
+func TestPutUnaligned(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	const size = 1000
+
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u, err := addTicket("w", size, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	buf := testutil.Buffer(size - 1)
+	headers := map[string]string{"Content-Range": "bytes 1-999/*"}
+	resp, err := requestWithHeaders("PUT", "/images/"+u, buf, headers)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append([]byte{0}, buf...)
+	if !bytes.Equal(content, expected) {
+		t.Fatalf("Expected %v, got %v", expected, content)
+	}
+}
+
+func TestPatchZero(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	const size = 2048
+
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	buf := testutil.Buffer(size)
+	if err = ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := addTicket("w", size, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	msg := []byte(`{"op": "zero", "offset": 512, "size": 1024, "flush": true}`)
+	resp, err := request("PATCH", "/images/"+u, msg)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(buf[512:1536], make([]byte, 1024))
+	if !bytes.Equal(content, buf) {
+		t.Fatalf("Expected %v, got %v", buf, content)
+	}
+}
+
+func TestPatchZeroUnaligned(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	const size = 2048
+
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	buf := testutil.Buffer(size)
+	if err = ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := addTicket("w", size, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	msg := []byte(`{"op": "zero", "offset": 100, "size": 1500, "flush": true}`)
+	resp, err := request("PATCH", "/images/"+u, msg)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(buf[100:1600], make([]byte, 1500))
+	if !bytes.Equal(content, buf) {
+		t.Fatalf("Expected %v, got %v", buf, content)
+	}
+}
+
+func TestPutNoFlushPatchFlush(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	const size = 2048
+
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u, err := addTicket("w", size, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	buf := testutil.Buffer(size)
+	for offset := 0; offset < size; offset += 1024 {
+		headers := map[string]string{
+			"Content-Range": fmt.Sprintf("bytes %d-%d/*", offset, offset+1023),
+		}
+		resp, err := requestWithHeaders("PUT", "/images/"+u+"?flush=n",
+			buf[offset:offset+1024], headers)
+		if resp == nil {
+			t.Fatalf("Request failed: err=%v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	resp, err := request("PATCH", "/images/"+u, []byte(`{"op": "flush"}`))
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, buf) {
+		t.Fatalf("Expected %v, got %v", buf, content)
+	}
+}
+
+func TestPutInvalidFlush(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u, err := addTicket("w", 1024, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	resp, err := request("PUT", "/images/"+u+"?flush=maybe", testutil.Buffer(1024))
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected %v, got %v", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestPatchFlushReadOnly(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u, err := addTicket("r", 1024, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	resp, err := request("PATCH", "/images/"+u, []byte(`{"op": "flush"}`))
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected %v, got %v", http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestPatchZeroOverflow(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u, err := addTicket("w", 1024, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	// offset + size wraps around to a negative value.
+	for _, r := range [][2]int64{
+		{math.MaxInt64, 2},
+		{512, math.MaxInt64},
+		{math.MaxInt64 - 100, 200},
+	} {
+		msg := fmt.Sprintf(`{"op": "zero", "offset": %d, "size": %d}`, r[0], r[1])
+		resp, err := request("PATCH", "/images/"+u, []byte(msg))
+		if resp == nil {
+			t.Fatalf("Request failed: err=%v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("offset=%d size=%d: expected %v, got %v",
+				r[0], r[1], http.StatusForbidden, resp.StatusCode)
+		}
+	}
+}
+
+func TestPatchZeroReadOnly(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u, err := addTicket("r", 1024, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	msg := []byte(`{"op": "zero", "offset": 0, "size": 1024}`)
+	resp, err := request("PATCH", "/images/"+u, msg)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected %v, got %v", http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+var invalidPatches = []string{
+	``,
+	`not json`,
+	`{"op": "no-such-op"}`,
+	`{"op": "zero", "offset": -512, "size": 512}`,
+}
+
+func TestPatchInvalid(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u, err := addTicket("w", 1024, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	for _, msg := range invalidPatches {
+		resp, err := request("PATCH", "/images/"+u, []byte(msg))
+		if resp == nil {
+			t.Fatalf("Request failed: err=%v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Patch %q: expected %v, got %v", msg, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+}
+
+func TestExtents(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	const size = 1024 * 1024
+
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u, err := addTicket("r", size, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	resp, err := request("GET", "/images/"+u+"/extents", nil)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	var extents []fileio.Extent
+	if err = json.NewDecoder(resp.Body).Decode(&extents); err != nil {
+		t.Fatal(err)
+	}
+
+	pos := int64(0)
+	for _, e := range extents {
+		if e.Start != pos {
+			t.Fatalf("Expected extent at %v, got %+v", pos, e)
+		}
+		pos += e.Length
+	}
+	if pos != size {
+		t.Fatalf("Extents cover %v bytes, expected %v: %+v", pos, size, extents)
+	}
+}
+
+func TestMemoryImage(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	const size = 1024 * 1024
+
+	u, err := addMemoryTicket("rw", size, "images-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	buf := testutil.Buffer(4096)
+	resp, err := requestWithHeaders("PUT", "/images/"+u, buf, map[string]string{
+		"Content-Range": fmt.Sprintf("bytes %d-%d/*", size/2, size/2+len(buf)-1),
+	})
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	resp, err = request("GET", "/images/"+u, nil)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make([]byte, size)
+	copy(expected[size/2:], buf)
+	if !bytes.Equal(data, expected) {
+		t.Fatal("Downloaded data does not match uploaded data")
+	}
+
+	resp, err = request("GET", "/images/"+u+"/extents", nil)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+	var extents []backend.Extent
+	if err = json.NewDecoder(resp.Body).Decode(&extents); err != nil {
+		t.Fatal(err)
+	}
+	if len(extents) != 3 || extents[1].Zero || extents[1].Start > size/2 {
+		t.Fatalf("Unexpected extents: %+v", extents)
+	}
+}
+
+func TestGetQcow2(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	const cluster = 64 * 1024
+	const size = 16 * cluster
+
+	data := testutil.Buffer(cluster)
+	path, err := testutil.CreateQcow2(testutil.Qcow2Options{
+		Size: size,
+		Data: map[int64][]byte{3: data},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	ticket := &auth.Ticket{
+		Mode:    "r",
+		Size:    size,
+		Timeout: 10,
+		Url:     "file://" + path,
+		Uuid:    "3facfbc1-68e0-4b77-b0c6-87e66fcabcc2",
+		Format:  "qcow2",
+	}
+	if err := auth.Add(ticket); err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(ticket.Uuid)
+
+	resp, err := request("GET", "/images/"+ticket.Uuid, nil)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+	expected := make([]byte, size)
+	copy(expected[3*cluster:], data)
+	if !bytes.Equal(body, expected) {
+		t.Fatal("Downloaded data does not match guest data")
+	}
+
+	resp, err = request("GET", "/images/"+ticket.Uuid+"/extents", nil)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+	var extents []backend.Extent
+	if err = json.NewDecoder(resp.Body).Decode(&extents); err != nil {
+		t.Fatal(err)
+	}
+	expectedExtents := []backend.Extent{
+		{Start: 0, Length: 3 * cluster, Zero: true, Hole: true},
+		{Start: 3 * cluster, Length: cluster},
+		{Start: 4 * cluster, Length: 12 * cluster, Zero: true, Hole: true},
+	}
+	if !reflect.DeepEqual(extents, expectedExtents) {
+		t.Fatalf("Expected extents %v, got %v", expectedExtents, extents)
+	}
+}
+
+func TestPutQcow2(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	const cluster = 64 * 1024
+	const size = 16 * cluster
+
+	path, err := testutil.CreateQcow2(testutil.Qcow2Options{Size: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	ticket := &auth.Ticket{
+		Mode:    "rw",
+		Size:    size,
+		Timeout: 10,
+		Url:     "file://" + path,
+		Uuid:    "3facfbc1-68e0-4b77-b0c6-87e66fcabcc2",
+		Format:  "qcow2",
+	}
+	if err := auth.Add(ticket); err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(ticket.Uuid)
+
+	// Upload raw data, leaving the first cluster unallocated.
+	data := testutil.Buffer(size - cluster)
+	resp, err := requestWithHeaders("PUT", "/images/"+ticket.Uuid+"?flush=n", data, map[string]string{
+		"Content-Range": fmt.Sprintf("bytes %d-%d/*", cluster, size-1),
+	})
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	msg := fmt.Sprintf(`{"op": "zero", "offset": %d, "size": %d, "flush": true}`, 4*cluster, 4*cluster)
+	resp, err = request("PATCH", "/images/"+ticket.Uuid, []byte(msg))
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	image, err := qcow2.Open(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+	if err := image.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make([]byte, size)
+	copy(expected[cluster:], data)
+	copy(expected[4*cluster:8*cluster], make([]byte, 4*cluster))
+	buf := make([]byte, size)
+	if _, err := image.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, expected) {
+		t.Fatal("Guest data does not match uploaded data")
+	}
+
+	extents, err := image.Extents(0, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedExtents := []qcow2.Extent{
+		{Start: 0, Length: cluster, Zero: true, Hole: true},
+		{Start: cluster, Length: 3 * cluster},
+		{Start: 4 * cluster, Length: 4 * cluster, Zero: true, Hole: true},
+		{Start: 8 * cluster, Length: 8 * cluster},
+	}
+	if !reflect.DeepEqual(extents, expectedExtents) {
+		t.Fatalf("Expected extents %v, got %v", expectedExtents, extents)
+	}
+}
+
+func TestPutQcow2Concurrent(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	const size = 16 * 1024 * 1024
+	const half = size / 2
+
+	path, err := testutil.CreateQcow2(testutil.Qcow2Options{Size: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	ticket := &auth.Ticket{
+		Mode:    "rw",
+		Size:    size,
+		Timeout: 10,
+		Url:     "file://" + path,
+		Uuid:    "3facfbc1-68e0-4b77-b0c6-87e66fcabcc2",
+		Format:  "qcow2",
+	}
+	if err := auth.Add(ticket); err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(ticket.Uuid)
+
+	// Upload both halves of the image concurrently. Both requests allocate
+	// clusters in the same image.
+	data := testutil.Buffer(size)
+	errors := make(chan error, 2)
+	for _, offset := range []int{0, half} {
+		go func(offset int) {
+			resp, err := requestWithHeaders("PUT", "/images/"+ticket.Uuid, data[offset:offset+half], map[string]string{
+				"Content-Range": fmt.Sprintf("bytes %d-%d/*", offset, offset+half-1),
+			})
+			if resp == nil {
+				errors <- err
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				errors <- fmt.Errorf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+				return
+			}
+			errors <- nil
+		}(offset)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errors; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := request("GET", "/images/"+ticket.Uuid, nil)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("Guest data does not match uploaded data")
+	}
+
+	image, err := qcow2.Open(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+	if err := image.Check(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtentsWriteOnly(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u, err := addTicket("w", 1024, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	resp, err := request("GET", "/images/"+u+"/extents", nil)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected %v, got %v", http.StatusForbidden, resp.StatusCode)
 	}
 }
 
-func TestPutNoAuth(t *testing.T) {
+func TestExtentsInvalidContext(t *testing.T) {
 	err := Start("localhost:0")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer Stop()
 
-	resp, err := request("PUT", "/images/no-such-ticket", nil)
+	path, err := testutil.CreateFile(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	u, err := addTicket("r", 1024, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	resp, err := request("GET", "/images/"+u+"/extents?context=invalid", nil)
 	if resp == nil {
 		t.Fatalf("Request failed: err=%v", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusForbidden {
-		t.Fatalf("Expected %v, got %v", http.StatusForbidden, resp.StatusCode)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected %v, got %v", http.StatusBadRequest, resp.StatusCode)
 	}
 }
 
-func TestPut(t *testing.T) {
+func TestExtentsNoTicketUuid(t *testing.T) {
 	err := Start("localhost:0")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer Stop()
 
-	const size = 1024
+	for _, path := range []string{"/images/extents", "/images//extents"} {
+		resp, err := request("GET", path, nil)
+		if resp == nil {
+			t.Fatalf("Request failed: err=%v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s: expected %v, got %v", path, http.StatusNotFound, resp.StatusCode)
+		}
+	}
+}
 
-	path, err := testutil.CreateFile(size)
+func TestExtentsDirtyNoBitmap(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	path, err := testutil.CreateFile(1024)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer os.Remove(path)
 
+	u, err := addTicket("r", 1024, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	resp, err := request("GET", "/images/"+u+"/extents?context=dirty", nil)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected %v, got %v", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+// bitmapExport is a NBD export with a dirty bitmap, marking every other
+// block as dirty.
+type bitmapExport struct {
+	data []byte
+}
+
+func (e *bitmapExport) ReadAt(p []byte, off int64) (int, error) {
+	return copy(p, e.data[off:]), nil
+}
+
+func (e *bitmapExport) WriteAt(p []byte, off int64) (int, error) {
+	return copy(e.data[off:], p), nil
+}
+
+func (e *bitmapExport) Zero(offset int64, length int64) error {
+	copy(e.data[offset:offset+length], make([]byte, length))
+	return nil
+}
+
+func (e *bitmapExport) Flush() error {
+	return nil
+}
+
+func (e *bitmapExport) Extents(offset int64, length int64) ([]nbd.Extent, error) {
+	return []nbd.Extent{{Start: offset, Length: length}}, nil
+}
+
+func (e *bitmapExport) Size() int64 {
+	return int64(len(e.data))
+}
+
+func (e *bitmapExport) ReadOnly() bool {
+	return true
+}
+
+func (e *bitmapExport) Close() error {
+	return nil
+}
+
+func (e *bitmapExport) Bitmaps() []string {
+	return []string{"backup-1"}
+}
+
+func (e *bitmapExport) BitmapExtents(bitmap string, offset int64, length int64) ([]nbd.Extent, error) {
+	var extents []nbd.Extent
+	for pos := offset; pos < offset+length; pos += 4096 {
+		var flags uint32
+		if pos/4096%2 == 0 {
+			flags = nbd.StateDirty
+		}
+		extents = append(extents, nbd.Extent{Start: pos, Length: 4096, Flags: flags})
+	}
+	return extents, nil
+}
+
+func TestExtentsDirty(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	const size = 4 * 4096
+
+	f, err := ioutil.TempFile("/var/tmp", "nbd.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := f.Name()
+	f.Close()
+	os.Remove(sock)
+
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(sock)
+	defer l.Close()
+
+	server := &nbd.Server{Open: func(name string) (nbd.Export, error) {
+		return &bitmapExport{data: make([]byte, size)}, nil
+	}}
+	go server.Serve(l)
+
 	u := "3facfbc1-68e0-4b77-b0c6-87e66fcabcc2"
 	ticket := &auth.Ticket{
-		Mode:    "rw",
-		Size:    size,
+		Mode:        "r",
+		Size:        size,
+		Timeout:     10,
+		Url:         "nbd:unix:" + sock,
+		Uuid:        u,
+		DirtyBitmap: "backup-1",
+	}
+	if err = auth.Add(ticket); err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(u)
+
+	resp, err := request("GET", "/images/"+u+"/extents?context=dirty", nil)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	var extents []backend.DirtyExtent
+	if err = json.NewDecoder(resp.Body).Decode(&extents); err != nil {
+		t.Fatal(err)
+	}
+	expected := []backend.DirtyExtent{
+		{Start: 0, Length: 4096, Dirty: true},
+		{Start: 4096, Length: 4096, Dirty: false},
+		{Start: 8192, Length: 4096, Dirty: true},
+		{Start: 12288, Length: 4096, Dirty: false},
+	}
+	if !reflect.DeepEqual(extents, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, extents)
+	}
+}
+
+// addProxyTicket adds a ticket for a remote image on the same server,
+// proxying requests to remote ticket.
+func addProxyTicket(mode string, size int64, remote string) (string, error) {
+	u := "a7a6a8b4-7c2a-4b39-9c59-3b1c1a2f5e7d"
+	ticket := &auth.Ticket{
+		Mode:    mode,
+		Size:    auth.Bytes(size),
 		Timeout: 10,
-		Url:     "file://" + path,
+		Url:     fmt.Sprintf("http://%s/images/%s", Addr(), remote),
 		Uuid:    u,
 	}
-	err = auth.Add(ticket)
+	return u, auth.Add(ticket)
+}
+
+func TestProxy(t *testing.T) {
+	err := Start("localhost:0")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer auth.Remove(u)
+	defer Stop()
 
-	buf := testutil.Buffer(size)
-	resp, err := request("PUT", "/images/"+u, buf)
+	const size = 1024 * 1024
+
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	remote, err := addTicket("rw", size, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(remote)
+
+	proxy, err := addProxyTicket("rw", size, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(proxy)
+
+	// Upload through the proxy.
+	buf := testutil.Buffer(size / 2)
+	resp, err := requestWithHeaders("PUT", "/images/"+proxy, buf, map[string]string{
+		"Content-Range": fmt.Sprintf("bytes %d-%d/*", size/4, size/4+len(buf)-1),
+	})
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content[size/4:size/4+len(buf)], buf) {
+		t.Fatal("File content does not match data uploaded through the proxy")
+	}
+
+	// Download a range through the proxy.
+	resp, err = requestWithHeaders("GET", "/images/"+proxy, nil, map[string]string{
+		"Range": fmt.Sprintf("bytes=%d-%d", size/4, size/4+999),
+	})
 	if resp == nil {
 		t.Fatalf("Request failed: err=%v", err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Expected %v, got %v", http.StatusPartialContent, resp.StatusCode)
+	}
+	expectedRange := fmt.Sprintf("bytes %d-%d/%d", size/4, size/4+999, size)
+	if cr := resp.Header.Get("Content-Range"); cr != expectedRange {
+		t.Fatalf("Expected Content-Range %q, got %q", expectedRange, cr)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, buf[:1000]) {
+		t.Fatal("Data downloaded through the proxy does not match")
+	}
 
+	// Zero through the proxy.
+	msg := fmt.Sprintf(`{"op": "zero", "offset": %d, "size": 4096, "flush": true}`, size/4)
+	resp, err = request("PATCH", "/images/"+proxy, []byte(msg))
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
 	}
+	content, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content[size/4:size/4+4096], make([]byte, 4096)) {
+		t.Fatal("Range was not zeroed through the proxy")
+	}
 
-	content, err := ioutil.ReadFile(path)
-	if !bytes.Equal(content, buf) {
-		t.Fatalf("Expected %v, got %v", buf, content)
+	// Options are forwarded to the remote server.
+	_, opts, err := requestOptions("/images/" + proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"zero", "flush", "extents"}
+	if !reflect.DeepEqual(opts.Features, expected) {
+		t.Fatalf("Expected features %v, got %v", expected, opts.Features)
+	}
+}
+
+func TestProxyRemoteNoAuth(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	proxy, err := addProxyTicket("rw", 1024, "no-such-ticket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(proxy)
+
+	resp, err := request("PUT", "/images/"+proxy, make([]byte, 1024))
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("Expected %v, got %v", http.StatusInternalServerError, resp.StatusCode)
+	}
+}
+
+var optionsTests = []struct {
+	mode     string
+	allow    string
+	features []string
+	ops      []string
+}{
+	{"r", "OPTIONS,GET", []string{"extents"}, []string{"read"}},
+	{"w", "OPTIONS,PUT,PATCH", []string{"zero", "flush"}, []string{"write"}},
+	{"rw", "OPTIONS,GET,PUT,PATCH", []string{"zero", "flush", "extents"}, []string{"read", "write"}},
+}
+
+func TestOptions(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	for _, test := range optionsTests {
+		u, err := addTicket(test.mode, 1024, "/no/such/path")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, opts, err := requestOptions("/images/" + u)
+		auth.Remove(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		allow := resp.Header.Get("Allow")
+		if allow != test.allow {
+			t.Errorf("Mode %q: expected Allow %q, got %q", test.mode, test.allow, allow)
+		}
+		if !reflect.DeepEqual(opts.Features, test.features) {
+			t.Errorf("Mode %q: expected features %v, got %v", test.mode, test.features, opts.Features)
+		}
+		if !reflect.DeepEqual(opts.Ops, test.ops) {
+			t.Errorf("Mode %q: expected ops %v, got %v", test.mode, test.ops, opts.Ops)
+		}
+		if opts.MaxConnections != maxConnections {
+			t.Errorf("Mode %q: expected max connections %v, got %v",
+				test.mode, maxConnections, opts.MaxConnections)
+		}
+	}
+}
+
+func TestOptionsServer(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	resp, opts, err := requestOptions("/images/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allow := resp.Header.Get("Allow")
+	if allow != "OPTIONS,GET,PUT,PATCH" {
+		t.Errorf("Unexpected Allow: %q", allow)
+	}
+	expected := []string{"zero", "flush", "extents"}
+	if !reflect.DeepEqual(opts.Features, expected) {
+		t.Errorf("Expected features %v, got %v", expected, opts.Features)
+	}
+}
+
+func TestOptionsNoAuth(t *testing.T) {
+	err := Start("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	resp, err := request("OPTIONS", "/images/no-such-ticket", nil)
+	if resp == nil {
+		t.Fatalf("Request failed: err=%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected %v, got %v", http.StatusForbidden, resp.StatusCode)
 	}
 }
 
@@ -121,8 +1844,62 @@ func TestNotRunning(t *testing.T) {
 	}
 }
 
+// addTicket adds a ticket for path, returning the ticket uuid.
+//
+// Caller is responsible for removing the ticket.
+func addTicket(mode string, size int64, path string) (string, error) {
+	u := "3facfbc1-68e0-4b77-b0c6-87e66fcabcc2"
+	ticket := &auth.Ticket{
+		Mode:    mode,
+		Size:    auth.Bytes(size),
+		Timeout: 10,
+		Url:     "file://" + path,
+		Uuid:    u,
+	}
+	return u, auth.Add(ticket)
+}
+
+// addMemoryTicket adds a ticket for a memory image, so tests do not need
+// a temporary file. The image is removed when the ticket is removed.
+func addMemoryTicket(mode string, size int64, name string) (string, error) {
+	u := "3facfbc1-68e0-4b77-b0c6-87e66fcabcc2"
+	ticket := &auth.Ticket{
+		Mode:    mode,
+		Size:    auth.Bytes(size),
+		Timeout: 10,
+		Url:     fmt.Sprintf("memory://%s?size=%d", name, size),
+		Uuid:    u,
+	}
+	return u, auth.Add(ticket)
+}
+
+// requestOptions sends OPTIONS request to path and parses the response.
+func requestOptions(path string) (*http.Response, *optionsResponse, error) {
+	resp, err := request("OPTIONS", path, nil)
+	if resp == nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	var opts optionsResponse
+	if err = json.NewDecoder(resp.Body).Decode(&opts); err != nil {
+		return nil, nil, err
+	}
+	return resp, &opts, nil
+}
+
 // request sends http request ot the images server
 func request(method string, path string, buf []byte) (resp *http.Response, err error) {
+	return requestWithHeaders(method, path, buf, nil)
+}
+
+// requestWithHeaders sends http request with extra headers to the images
+// server
+func requestWithHeaders(method string, path string, buf []byte, headers map[string]string) (resp *http.Response, err error) {
 	url := fmt.Sprintf("http://%s%s", Addr(), path)
 	body := bytes.NewReader(buf)
 	req, err := http.NewRequest(method, url, body)
@@ -133,5 +1910,8 @@ func request(method string, path string, buf []byte) (resp *http.Response, err e
 		req.Header.Set("Content-Length", fmt.Sprintf("%d", len(buf)))
 		req.Header.Set("Content-Type", "application/octet-stream")
 	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
 	return http.DefaultClient.Do(req)
 }
@@ -0,0 +1,104 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package images
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseRange parses a Range header value such as "bytes=0-1023", and returns
+// the offset and length of the range in an image of size bytes.
+//
+// Only a single range is supported; clients downloading in parallel should
+// send one request per range.
+func parseRange(s string, size int64) (offset int64, length int64, err error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(s, prefix) {
+		return 0, 0, fmt.Errorf("Unsupported range unit: %v", s)
+	}
+	spec := strings.TrimSpace(s[len(prefix):])
+	if strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("Multiple ranges not supported: %v", s)
+	}
+	dash := strings.Index(spec, "-")
+	if dash == -1 {
+		return 0, 0, fmt.Errorf("Invalid range: %v", s)
+	}
+	first, last := spec[:dash], spec[dash+1:]
+
+	if first == "" {
+		// Suffix range: "bytes=-N" means the last N bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("Invalid range: %v", s)
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("Invalid range: %v", s)
+	}
+	if start >= size {
+		return 0, 0, fmt.Errorf("Range start out of range: %v", s)
+	}
+
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, fmt.Errorf("Invalid range: %v", s)
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	return start, end - start + 1, nil
+}
+
+// parseContentRange parses a Content-Range header value such as
+// "bytes 0-1023/*", and returns the offset and length of the range. The
+// complete length part is ignored, since the size of the image is known.
+func parseContentRange(s string) (offset int64, length int64, err error) {
+	const prefix = "bytes "
+	if !strings.HasPrefix(s, prefix) {
+		return 0, 0, fmt.Errorf("Unsupported content range unit: %v", s)
+	}
+	spec := strings.TrimSpace(s[len(prefix):])
+	slash := strings.Index(spec, "/")
+	if slash == -1 {
+		return 0, 0, fmt.Errorf("Invalid content range: %v", s)
+	}
+	spec = spec[:slash]
+	dash := strings.Index(spec, "-")
+	if dash == -1 {
+		return 0, 0, fmt.Errorf("Invalid content range: %v", s)
+	}
+	start, err := strconv.ParseInt(spec[:dash], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("Invalid content range: %v", s)
+	}
+	end, err := strconv.ParseInt(spec[dash+1:], 10, 64)
+	if err != nil || end < start {
+		return 0, 0, fmt.Errorf("Invalid content range: %v", s)
+	}
+	return start, end - start + 1, nil
+}
+
+// contentRange formats a Content-Range header value for length bytes at
+// offset in an image of size bytes.
+func contentRange(offset int64, length int64, size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size)
+}
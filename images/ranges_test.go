@@ -0,0 +1,115 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package images
+
+import (
+	"testing"
+)
+
+var validRanges = []struct {
+	header string
+	offset int64
+	length int64
+}{
+	{"bytes=0-1023", 0, 1024},
+	{"bytes=512-1023", 512, 512},
+	{"bytes=512-", 512, 512},
+	{"bytes=0-4095", 0, 1024},
+	{"bytes=-512", 512, 512},
+	{"bytes=-4096", 0, 1024},
+}
+
+func TestParseRange(t *testing.T) {
+	for _, test := range validRanges {
+		offset, length, err := parseRange(test.header, 1024)
+		if err != nil {
+			t.Errorf("Parsing %q failed: %v", test.header, err)
+			continue
+		}
+		if offset != test.offset || length != test.length {
+			t.Errorf("Parsing %q: expected offset=%v length=%v, got offset=%v length=%v",
+				test.header, test.offset, test.length, offset, length)
+		}
+	}
+}
+
+var invalidRanges = []string{
+	"",
+	"0-1023",
+	"items=0-1023",
+	"bytes=",
+	"bytes=0",
+	"bytes=x-1023",
+	"bytes=0-x",
+	"bytes=1023-0",
+	"bytes=1024-",
+	"bytes=-0",
+	"bytes=0-511,512-1023",
+}
+
+func TestParseRangeInvalid(t *testing.T) {
+	for _, header := range invalidRanges {
+		offset, length, err := parseRange(header, 1024)
+		if err == nil {
+			t.Errorf("Parsing %q did not fail: offset=%v length=%v", header, offset, length)
+		}
+	}
+}
+
+var validContentRanges = []struct {
+	header string
+	offset int64
+	length int64
+}{
+	{"bytes 0-1023/*", 0, 1024},
+	{"bytes 512-1023/*", 512, 512},
+	{"bytes 512-1023/1024", 512, 512},
+}
+
+func TestParseContentRange(t *testing.T) {
+	for _, test := range validContentRanges {
+		offset, length, err := parseContentRange(test.header)
+		if err != nil {
+			t.Errorf("Parsing %q failed: %v", test.header, err)
+			continue
+		}
+		if offset != test.offset || length != test.length {
+			t.Errorf("Parsing %q: expected offset=%v length=%v, got offset=%v length=%v",
+				test.header, test.offset, test.length, offset, length)
+		}
+	}
+}
+
+var invalidContentRanges = []string{
+	"",
+	"0-1023/*",
+	"bytes=0-1023/*",
+	"bytes 0-1023",
+	"bytes 0/*",
+	"bytes -1023/*",
+	"bytes 0-/*",
+	"bytes x-1023/*",
+	"bytes 1023-0/*",
+}
+
+func TestParseContentRangeInvalid(t *testing.T) {
+	for _, header := range invalidContentRanges {
+		offset, length, err := parseContentRange(header)
+		if err == nil {
+			t.Errorf("Parsing %q did not fail: offset=%v length=%v", header, offset, length)
+		}
+	}
+}
+
+func TestContentRange(t *testing.T) {
+	s := contentRange(512, 512, 1024)
+	if s != "bytes 512-1023/1024" {
+		t.Fatalf("Unexpected content range: %v", s)
+	}
+}
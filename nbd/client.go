@@ -0,0 +1,616 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// DialOptions control the negotiation with the server.
+type DialOptions struct {
+	// Export is the name of the export. If empty, the server default export
+	// is used.
+	Export string
+
+	// DirtyBitmap is the name of a dirty bitmap to negotiate. If empty, only
+	// allocation status is available.
+	DirtyBitmap string
+}
+
+// Client is a NBD client connected to a single export.
+//
+// Client is not safe for concurrent use.
+type Client struct {
+	conn       net.Conn
+	r          *bufio.Reader
+	w          *bufio.Writer
+	size       int64
+	flags      uint16
+	structured bool
+	contexts   map[string]uint32
+	handle     uint64
+}
+
+// Dial connects to the server at address, and negotiates the export
+// specified in opts.
+func Dial(network, address string, opts DialOptions) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		conn:     conn,
+		r:        bufio.NewReader(conn),
+		w:        bufio.NewWriter(conn),
+		contexts: map[string]uint32{},
+	}
+	if err = c.handshake(opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Size returns the size of the export.
+func (c *Client) Size() int64 {
+	return c.size
+}
+
+// Flags returns the export transmission flags.
+func (c *Client) Flags() uint16 {
+	return c.flags
+}
+
+// ReadOnly returns true if the export does not allow writing.
+func (c *Client) ReadOnly() bool {
+	return c.flags&FlagReadOnly != 0
+}
+
+func (c *Client) handshake(opts DialOptions) error {
+	var hello struct {
+		Magic    uint64
+		OptMagic uint64
+		Flags    uint16
+	}
+	if err := recv(c.r, &hello); err != nil {
+		return err
+	}
+	if hello.Magic != nbdMagic || hello.OptMagic != optMagic {
+		return fmt.Errorf("unsupported server handshake: %x %x", hello.Magic, hello.OptMagic)
+	}
+	if hello.Flags&flagFixedNew == 0 {
+		return fmt.Errorf("server does not support fixed newstyle negotiation")
+	}
+
+	clientFlags := uint32(clientFixedNew)
+	noZeroes := hello.Flags&flagNoZeroes != 0
+	if noZeroes {
+		clientFlags |= clientNoZeroes
+	}
+	if err := send(c.w, clientFlags); err != nil {
+		return err
+	}
+
+	if err := c.negotiateStructured(); err != nil {
+		return err
+	}
+	if c.structured {
+		queries := []string{BaseAllocation}
+		if opts.DirtyBitmap != "" {
+			queries = append(queries, DirtyBitmapPrefix+opts.DirtyBitmap)
+		}
+		if err := c.negotiateMetaContext(opts.Export, queries); err != nil {
+			return err
+		}
+	}
+
+	return c.negotiateGo(opts.Export, noZeroes)
+}
+
+func (c *Client) negotiateStructured() error {
+	if err := c.sendOption(optStructured, nil); err != nil {
+		return err
+	}
+	reply, _, err := c.recvOptionReply(optStructured)
+	if err != nil {
+		return err
+	}
+	c.structured = reply.Type == repAck
+	return nil
+}
+
+func (c *Client) negotiateMetaContext(export string, queries []string) error {
+	data := make([]byte, 0, 64)
+	data = appendString32(data, export)
+	data = appendUint32(data, uint32(len(queries)))
+	for _, q := range queries {
+		data = appendString32(data, q)
+	}
+	if err := c.sendOption(optSetMetaContext, data); err != nil {
+		return err
+	}
+
+	for {
+		reply, data, err := c.recvOptionReply(optSetMetaContext)
+		if err != nil {
+			return err
+		}
+		switch reply.Type {
+		case repMetaContext:
+			if len(data) < 4 {
+				return fmt.Errorf("invalid meta context reply: %v", data)
+			}
+			id := binary.BigEndian.Uint32(data)
+			c.contexts[string(data[4:])] = id
+		case repAck:
+			return nil
+		default:
+			// The server does not support meta contexts; block status will
+			// report everything as data.
+			if reply.Type&(1<<31) != 0 {
+				return nil
+			}
+		}
+	}
+}
+
+func (c *Client) negotiateGo(export string, noZeroes bool) error {
+	data := make([]byte, 0, 64)
+	data = appendString32(data, export)
+	data = append(data, 0, 0) // No info requests.
+	if err := c.sendOption(optGo, data); err != nil {
+		return err
+	}
+
+	for {
+		reply, data, err := c.recvOptionReply(optGo)
+		if err != nil {
+			return err
+		}
+		switch reply.Type {
+		case repInfo:
+			if len(data) >= 12 && binary.BigEndian.Uint16(data) == infoExport {
+				c.size = int64(binary.BigEndian.Uint64(data[2:]))
+				c.flags = binary.BigEndian.Uint16(data[10:])
+			}
+		case repAck:
+			return nil
+		case repErrUnsup:
+			return c.negotiateExportName(export, noZeroes)
+		default:
+			if reply.Type&(1<<31) != 0 {
+				return fmt.Errorf("server rejected export %q: %s", export, data)
+			}
+		}
+	}
+}
+
+// negotiateExportName selects an export on old servers not supporting
+// NBD_OPT_GO.
+func (c *Client) negotiateExportName(export string, noZeroes bool) error {
+	if err := c.sendOption(optExportName, []byte(export)); err != nil {
+		return err
+	}
+	var info struct {
+		Size  uint64
+		Flags uint16
+	}
+	if err := recv(c.r, &info); err != nil {
+		return err
+	}
+	c.size = int64(info.Size)
+	c.flags = info.Flags
+	if !noZeroes {
+		_, err := io.CopyN(ioutil.Discard, c.r, exportNameZeros)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) sendOption(opt uint32, data []byte) error {
+	if err := send(c.w, option{optMagic, opt, uint32(len(data))}); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(data); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *Client) recvOptionReply(opt uint32) (optionReply, []byte, error) {
+	var reply optionReply
+	if err := recv(c.r, &reply); err != nil {
+		return reply, nil, err
+	}
+	if reply.Magic != optReplyMagic || reply.Option != opt {
+		return reply, nil, fmt.Errorf("unexpected option reply: %+v", reply)
+	}
+	if reply.Length > maxOptionSize {
+		return reply, nil, fmt.Errorf("option reply too large: %v", reply.Length)
+	}
+	data := make([]byte, reply.Length)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return reply, nil, err
+	}
+	return reply, data, nil
+}
+
+// ReadAt reads len(p) bytes from the export at offset off. Reading after the
+// end of the export returns io.EOF.
+func (c *Client) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= c.size {
+			return n, io.EOF
+		}
+		count := len(p) - n
+		if count > maxPayload {
+			count = maxPayload
+		}
+		if int64(count) > c.size-pos {
+			count = int(c.size - pos)
+		}
+		if err := c.read(p[n:n+count], pos); err != nil {
+			return n, err
+		}
+		n += count
+	}
+	return n, nil
+}
+
+func (c *Client) read(p []byte, off int64) error {
+	handle, err := c.sendRequest(cmdRead, 0, off, uint32(len(p)), nil)
+	if err != nil {
+		return err
+	}
+	return c.recvReply(handle, p, func(typ uint16, length uint32) error {
+		switch typ {
+		case replyTypeOffsetData:
+			var start uint64
+			if err := recv(c.r, &start); err != nil {
+				return err
+			}
+			size := int64(length) - 8
+			first := int64(start) - off
+			if first < 0 || size < 0 || first+size > int64(len(p)) {
+				return fmt.Errorf("invalid data chunk offset %v length %v", start, size)
+			}
+			_, err := io.ReadFull(c.r, p[first:first+size])
+			return err
+		case replyTypeOffsetHole:
+			var hole struct {
+				Offset uint64
+				Length uint32
+			}
+			if err := recv(c.r, &hole); err != nil {
+				return err
+			}
+			first := int64(hole.Offset) - off
+			if first < 0 || first+int64(hole.Length) > int64(len(p)) {
+				return fmt.Errorf("invalid hole chunk %+v", hole)
+			}
+			zero := p[first : first+int64(hole.Length)]
+			for i := range zero {
+				zero[i] = 0
+			}
+			return nil
+		default:
+			_, err := io.CopyN(ioutil.Discard, c.r, int64(length))
+			return err
+		}
+	})
+}
+
+// WriteAt writes len(p) bytes to the export at offset off.
+func (c *Client) WriteAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		count := len(p) - n
+		if count > maxPayload {
+			count = maxPayload
+		}
+		pos := off + int64(n)
+		handle, err := c.sendRequest(cmdWrite, 0, pos, uint32(count), p[n:n+count])
+		if err != nil {
+			return n, err
+		}
+		if err = c.recvReply(handle, nil, c.discard); err != nil {
+			return n, err
+		}
+		n += count
+	}
+	return n, nil
+}
+
+// Zero zeroes length bytes starting at offset. If the server does not
+// support NBD_CMD_WRITE_ZEROES, zeros are written.
+func (c *Client) Zero(offset int64, length int64) error {
+	if c.flags&FlagSendWriteZeroes == 0 {
+		buf := make([]byte, minInt64(length, maxPayload))
+		for length > 0 {
+			n := minInt64(length, int64(len(buf)))
+			if _, err := c.WriteAt(buf[:n], offset); err != nil {
+				return err
+			}
+			offset += n
+			length -= n
+		}
+		return nil
+	}
+	return c.command(cmdWriteZeroes, offset, length)
+}
+
+// Trim discards length bytes starting at offset. Trimmed data may read
+// as zeros or keep the previous content. If the server does not support
+// NBD_CMD_TRIM, this does nothing.
+func (c *Client) Trim(offset int64, length int64) error {
+	if c.flags&FlagSendTrim == 0 {
+		return nil
+	}
+	return c.command(cmdTrim, offset, length)
+}
+
+// Flush flushes data written to the export to storage.
+func (c *Client) Flush() error {
+	if c.flags&FlagSendFlush == 0 {
+		return nil
+	}
+	handle, err := c.sendRequest(cmdFlush, 0, 0, 0, nil)
+	if err != nil {
+		return err
+	}
+	return c.recvReply(handle, nil, c.discard)
+}
+
+// BlockStatus returns the allocation extents starting at offset, covering up
+// to length bytes. The server may return less than length bytes; callers
+// should continue from the end of the last extent.
+//
+// If the server does not support the base:allocation meta context, the
+// range is reported as data.
+func (c *Client) BlockStatus(offset int64, length int64) ([]Extent, error) {
+	if _, ok := c.contexts[BaseAllocation]; !ok {
+		return []Extent{{Start: offset, Length: minInt64(length, maxLength)}}, nil
+	}
+	return c.blockStatus(BaseAllocation, offset, length)
+}
+
+// DirtyStatus is like BlockStatus, but returns the extents of the dirty
+// bitmap negotiated in Dial, using the StateDirty flag.
+func (c *Client) DirtyStatus(offset int64, length int64) ([]Extent, error) {
+	for name := range c.contexts {
+		if strings.HasPrefix(name, DirtyBitmapPrefix) {
+			return c.blockStatus(name, offset, length)
+		}
+	}
+	return nil, fmt.Errorf("no dirty bitmap was negotiated")
+}
+
+// HasDirtyBitmap returns true if the dirty bitmap requested in Dial is
+// available.
+func (c *Client) HasDirtyBitmap() bool {
+	for name := range c.contexts {
+		if strings.HasPrefix(name, DirtyBitmapPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockStatus returns the extents of meta context name. The server reports
+// all negotiated meta contexts; other contexts are ignored.
+func (c *Client) blockStatus(name string, offset int64, length int64) ([]Extent, error) {
+	if length > maxLength {
+		length = maxLength
+	}
+	id := c.contexts[name]
+
+	handle, err := c.sendRequest(cmdBlockStatus, 0, offset, uint32(length), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var extents []Extent
+	err = c.recvReply(handle, nil, func(typ uint16, size uint32) error {
+		if typ != replyTypeBlockStatus || size < 4 || (size-4)%8 != 0 {
+			return fmt.Errorf("unexpected reply chunk type %v length %v", typ, size)
+		}
+		if size > maxPayload {
+			return fmt.Errorf("block status reply too large: %v", size)
+		}
+		var contextID uint32
+		if err := recv(c.r, &contextID); err != nil {
+			return err
+		}
+		descs := make([]struct {
+			Length uint32
+			Flags  uint32
+		}, (size-4)/8)
+		if err := recv(c.r, descs); err != nil {
+			return err
+		}
+		for _, d := range descs {
+			if d.Length == 0 {
+				return fmt.Errorf("invalid block status descriptor length 0")
+			}
+		}
+		if contextID != id {
+			return nil
+		}
+		pos := offset
+		end := offset + length
+		for _, d := range descs {
+			if pos >= end {
+				break
+			}
+			n := minInt64(int64(d.Length), end-pos)
+			extents = append(extents, Extent{Start: pos, Length: n, Flags: d.Flags})
+			pos += n
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(extents) == 0 {
+		return nil, fmt.Errorf("server did not report %v status", name)
+	}
+	return extents, nil
+}
+
+// Close disconnects from the server.
+func (c *Client) Close() error {
+	c.sendRequest(cmdDisc, 0, 0, 0, nil)
+	return c.conn.Close()
+}
+
+// command sends a command without payload, splitting length to multiple
+// requests if needed.
+func (c *Client) command(typ uint16, offset int64, length int64) error {
+	for length > 0 {
+		n := minInt64(length, maxLength)
+		handle, err := c.sendRequest(typ, 0, offset, uint32(n), nil)
+		if err != nil {
+			return err
+		}
+		if err = c.recvReply(handle, nil, c.discard); err != nil {
+			return err
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
+
+func (c *Client) sendRequest(typ uint16, flags uint16, offset int64, length uint32, payload []byte) (uint64, error) {
+	c.handle++
+	req := request{requestMagic, flags, typ, c.handle, uint64(offset), length}
+	if err := send(c.w, req); err != nil {
+		return 0, err
+	}
+	if _, err := c.w.Write(payload); err != nil {
+		return 0, err
+	}
+	return c.handle, c.w.Flush()
+}
+
+// recvReply receives the reply for handle. For a simple reply, data is read
+// into p. For a structured reply, chunk is called to consume the payload of
+// each data chunk. Errors reported by the server are returned as *Error.
+func (c *Client) recvReply(handle uint64, p []byte, chunk func(typ uint16, length uint32) error) error {
+	var replyErr error
+	for {
+		var magic uint32
+		if err := recv(c.r, &magic); err != nil {
+			return err
+		}
+
+		switch magic {
+		case simpleReplyMagic:
+			var reply struct {
+				Error  uint32
+				Handle uint64
+			}
+			if err := recv(c.r, &reply); err != nil {
+				return err
+			}
+			if reply.Handle != handle {
+				return fmt.Errorf("unexpected reply handle %v, expected %v", reply.Handle, handle)
+			}
+			if reply.Error != 0 {
+				return &Error{Errno: syscall.Errno(reply.Error)}
+			}
+			_, err := io.ReadFull(c.r, p)
+			return err
+
+		case structuredReplyMagic:
+			var reply struct {
+				Flags  uint16
+				Type   uint16
+				Handle uint64
+				Length uint32
+			}
+			if err := recv(c.r, &reply); err != nil {
+				return err
+			}
+			if reply.Handle != handle {
+				return fmt.Errorf("unexpected reply handle %v, expected %v", reply.Handle, handle)
+			}
+			switch {
+			case reply.Type == replyTypeNone:
+			case reply.Type&(1<<15) != 0:
+				err, perr := c.recvError(reply.Type, reply.Length)
+				if perr != nil {
+					return perr
+				}
+				if replyErr == nil {
+					replyErr = err
+				}
+			default:
+				if err := chunk(reply.Type, reply.Length); err != nil {
+					return err
+				}
+			}
+			if reply.Flags&replyFlagDone != 0 {
+				return replyErr
+			}
+
+		default:
+			return fmt.Errorf("invalid reply magic: %x", magic)
+		}
+	}
+}
+
+// recvError reads an error chunk payload, returning the error reported by
+// the server, or a protocol error.
+func (c *Client) recvError(typ uint16, length uint32) (*Error, error) {
+	if length < 6 || length > maxOptionSize {
+		return nil, fmt.Errorf("invalid error chunk length: %v", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, err
+	}
+	msglen := int(binary.BigEndian.Uint16(data[4:]))
+	if 6+msglen > len(data) {
+		return nil, fmt.Errorf("invalid error message length: %v", msglen)
+	}
+	return &Error{
+		Errno:   syscall.Errno(binary.BigEndian.Uint32(data)),
+		Message: string(data[6 : 6+msglen]),
+	}, nil
+}
+
+func (c *Client) discard(typ uint16, length uint32) error {
+	_, err := io.CopyN(ioutil.Discard, c.r, int64(length))
+	return err
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendString32(b []byte, s string) []byte {
+	return append(appendUint32(b, uint32(len(s))), s...)
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
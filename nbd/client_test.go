@@ -0,0 +1,309 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package nbd
+
+import (
+	"bytes"
+	"io"
+	"ovirt/imageio/testutil"
+	"syscall"
+	"testing"
+)
+
+func dialExport(t *testing.T, e *memExport) (*testServer, *Client) {
+	s := startServer(t, map[string]*memExport{"export": e})
+	c, err := Dial("unix", s.path, DialOptions{Export: "export"})
+	if err != nil {
+		s.Stop()
+		t.Fatal(err)
+	}
+	return s, c
+}
+
+func TestClientSize(t *testing.T) {
+	s, c := dialExport(t, &memExport{data: make([]byte, 12345)})
+	defer s.Stop()
+	defer c.Close()
+
+	if c.Size() != 12345 {
+		t.Fatalf("Size %v, expected 12345", c.Size())
+	}
+	if c.ReadOnly() {
+		t.Fatal("Export is read only")
+	}
+	if !c.structured {
+		t.Fatal("Structured replies not negotiated")
+	}
+}
+
+func TestClientReadWrite(t *testing.T) {
+	e := &memExport{data: make([]byte, 1024*1024)}
+	s, c := dialExport(t, e)
+	defer s.Stop()
+	defer c.Close()
+
+	buf := testutil.Buffer(100000)
+	n, err := c.WriteAt(buf, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(buf) {
+		t.Fatalf("Wrote %v bytes, expected %v", n, len(buf))
+	}
+	if !bytes.Equal(e.data[1000:101000], buf) {
+		t.Fatal("Export data does not match data written")
+	}
+
+	res := make([]byte, len(buf))
+	if _, err = c.ReadAt(res, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, buf) {
+		t.Fatal("Data read does not match data written")
+	}
+}
+
+func TestClientReadLarge(t *testing.T) {
+	const size = maxPayload + 4096
+	e := &memExport{data: testutil.Buffer(size)}
+	s, c := dialExport(t, e)
+	defer s.Stop()
+	defer c.Close()
+
+	res := make([]byte, size)
+	if _, err := c.ReadAt(res, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, e.data) {
+		t.Fatal("Data read does not match export data")
+	}
+}
+
+func TestClientReadEOF(t *testing.T) {
+	e := &memExport{data: testutil.Buffer(1000)}
+	s, c := dialExport(t, e)
+	defer s.Stop()
+	defer c.Close()
+
+	res := make([]byte, 100)
+	n, err := c.ReadAt(res, 950)
+	if err != io.EOF {
+		t.Fatalf("Expected io.EOF, got %v", err)
+	}
+	if n != 50 || !bytes.Equal(res[:n], e.data[950:]) {
+		t.Fatalf("Unexpected data read: %v", res[:n])
+	}
+}
+
+func TestClientWriteOutOfRange(t *testing.T) {
+	e := &memExport{data: make([]byte, 1000)}
+	s, c := dialExport(t, e)
+	defer s.Stop()
+	defer c.Close()
+
+	_, err := c.WriteAt(make([]byte, 100), 950)
+	nerr, ok := err.(*Error)
+	if !ok || nerr.Errno != syscall.EINVAL {
+		t.Fatalf("Expected EINVAL, got %v", err)
+	}
+
+	// The connection is still usable.
+	if _, err = c.WriteAt(make([]byte, 100), 900); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientReadOverflow(t *testing.T) {
+	e := &memExport{data: make([]byte, 1000)}
+	s, c := dialExport(t, e)
+	defer s.Stop()
+	defer c.Close()
+
+	// Sent as offset 2**64 - 256; offset + length wraps around to 0.
+	_, err := c.ReadAt(make([]byte, 256), -256)
+	nerr, ok := err.(*Error)
+	if !ok || nerr.Errno != syscall.EINVAL {
+		t.Fatalf("Expected EINVAL, got %v", err)
+	}
+
+	// The connection is still usable.
+	if _, err = c.ReadAt(make([]byte, 100), 900); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientReadOnly(t *testing.T) {
+	e := &memExport{data: make([]byte, 1000), readOnly: true}
+	s, c := dialExport(t, e)
+	defer s.Stop()
+	defer c.Close()
+
+	if !c.ReadOnly() {
+		t.Fatal("Export is not read only")
+	}
+	_, err := c.WriteAt(make([]byte, 100), 0)
+	nerr, ok := err.(*Error)
+	if !ok || nerr.Errno != syscall.EPERM {
+		t.Fatalf("Expected EPERM, got %v", err)
+	}
+}
+
+func TestClientZeroTrim(t *testing.T) {
+	e := &memExport{data: bytes.Repeat([]byte{1}, 10000)}
+	s, c := dialExport(t, e)
+	defer s.Stop()
+	defer c.Close()
+
+	if err := c.Zero(100, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Trim(5000, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := bytes.Repeat([]byte{1}, 10000)
+	copy(expected[100:1100], make([]byte, 1000))
+	copy(expected[5000:6000], make([]byte, 1000))
+	if !bytes.Equal(e.data, expected) {
+		t.Fatalf("Expected %v, got %v", expected, e.data)
+	}
+}
+
+func TestClientFlush(t *testing.T) {
+	e := &memExport{data: make([]byte, 1000)}
+	s, c := dialExport(t, e)
+	defer s.Stop()
+	defer c.Close()
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if e.flushes != 1 {
+		t.Fatalf("Export flushed %v times, expected 1", e.flushes)
+	}
+}
+
+func TestClientBlockStatus(t *testing.T) {
+	e := &memExport{data: make([]byte, 10*testBlock)}
+	copy(e.data[2*testBlock:], bytes.Repeat([]byte{1}, 3*testBlock))
+	s, c := dialExport(t, e)
+	defer s.Stop()
+	defer c.Close()
+
+	extents, err := c.BlockStatus(0, c.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Extent{
+		{0, 2 * testBlock, StateHole | StateZero},
+		{2 * testBlock, 3 * testBlock, 0},
+		{5 * testBlock, 5 * testBlock, StateHole | StateZero},
+	}
+	if len(extents) != len(expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, extents)
+	}
+	for i := range expected {
+		if extents[i] != expected[i] {
+			t.Fatalf("Expected %+v, got %+v", expected, extents)
+		}
+	}
+}
+
+func TestClientBlockStatusOffset(t *testing.T) {
+	e := &memExport{data: make([]byte, 10*testBlock)}
+	s, c := dialExport(t, e)
+	defer s.Stop()
+	defer c.Close()
+
+	extents, err := c.BlockStatus(testBlock+100, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(extents) != 1 || extents[0] != (Extent{testBlock + 100, 1000, StateHole | StateZero}) {
+		t.Fatalf("Unexpected extents: %+v", extents)
+	}
+}
+
+func TestClientBlockStatusZeroLength(t *testing.T) {
+	e := &memExport{
+		data:    make([]byte, 10*testBlock),
+		extents: []Extent{{0, 0, 0}},
+	}
+	s, c := dialExport(t, e)
+	defer s.Stop()
+	defer c.Close()
+
+	if _, err := c.BlockStatus(0, c.Size()); err == nil {
+		t.Fatal("Zero length extent did not fail")
+	}
+}
+
+func TestClientDirtyStatus(t *testing.T) {
+	e := &memExport{
+		data:    make([]byte, 4*testBlock),
+		bitmaps: map[string][]bool{"b1": {true, false, false, true}},
+	}
+	s := startServer(t, map[string]*memExport{"": e})
+	defer s.Stop()
+
+	c, err := Dial("unix", s.path, DialOptions{DirtyBitmap: "b1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if !c.HasDirtyBitmap() {
+		t.Fatal("Dirty bitmap not negotiated")
+	}
+	extents, err := c.DirtyStatus(0, c.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Extent{
+		{0, testBlock, StateDirty},
+		{testBlock, 2 * testBlock, 0},
+		{3 * testBlock, testBlock, StateDirty},
+	}
+	if len(extents) != len(expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, extents)
+	}
+	for i := range expected {
+		if extents[i] != expected[i] {
+			t.Fatalf("Expected %+v, got %+v", expected, extents)
+		}
+	}
+
+	// Allocation status is still available.
+	extents, err = c.BlockStatus(0, c.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(extents) != 1 || extents[0].Flags != StateHole|StateZero {
+		t.Fatalf("Unexpected allocation extents: %+v", extents)
+	}
+}
+
+func TestClientDirtyBitmapMissing(t *testing.T) {
+	e := &memExport{data: make([]byte, 4*testBlock)}
+	s := startServer(t, map[string]*memExport{"": e})
+	defer s.Stop()
+
+	c, err := Dial("unix", s.path, DialOptions{DirtyBitmap: "b1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.HasDirtyBitmap() {
+		t.Fatal("Missing dirty bitmap negotiated")
+	}
+	if _, err = c.DirtyStatus(0, c.Size()); err == nil {
+		t.Fatal("Dirty status without a bitmap did not fail")
+	}
+}
@@ -0,0 +1,213 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+// Package nbd implements the NBD protocol client and server, using newstyle
+// negotiation and structured replies.
+//
+// See https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+package nbd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"syscall"
+)
+
+// Handshake.
+const (
+	nbdMagic        = 0x4e42444d41474943 // "NBDMAGIC"
+	optMagic        = 0x49484156454f5054 // "IHAVEOPT"
+	optReplyMagic   = 0x0003e889045565a9
+	flagFixedNew    = 1 << 0
+	flagNoZeroes    = 1 << 1
+	clientFixedNew  = 1 << 0
+	clientNoZeroes  = 1 << 1
+	exportNameZeros = 124
+)
+
+// Options.
+const (
+	optExportName      = 1
+	optAbort           = 2
+	optList            = 3
+	optInfo            = 6
+	optGo              = 7
+	optStructured      = 8
+	optListMetaContext = 9
+	optSetMetaContext  = 10
+)
+
+// Option replies.
+const (
+	repAck         = 1
+	repServer      = 2
+	repInfo        = 3
+	repMetaContext = 4
+	repErrUnsup    = 1<<31 + 1
+	repErrPolicy   = 1<<31 + 2
+	repErrInvalid  = 1<<31 + 3
+	repErrUnknown  = 1<<31 + 6
+)
+
+// Info types.
+const (
+	infoExport    = 0
+	infoBlockSize = 3
+)
+
+// Transmission flags.
+const (
+	FlagHasFlags        = 1 << 0
+	FlagReadOnly        = 1 << 1
+	FlagSendFlush       = 1 << 2
+	FlagSendFUA         = 1 << 3
+	FlagSendTrim        = 1 << 5
+	FlagSendWriteZeroes = 1 << 6
+)
+
+// Commands.
+const (
+	cmdRead        = 0
+	cmdWrite       = 1
+	cmdDisc        = 2
+	cmdFlush       = 3
+	cmdTrim        = 4
+	cmdWriteZeroes = 6
+	cmdBlockStatus = 7
+)
+
+// Command flags.
+const (
+	cmdFlagFUA = 1 << 0
+)
+
+// Transmission magic numbers.
+const (
+	requestMagic         = 0x25609513
+	simpleReplyMagic     = 0x67446698
+	structuredReplyMagic = 0x668e33ef
+)
+
+// Structured reply flags and types.
+const (
+	replyFlagDone        = 1 << 0
+	replyTypeNone        = 0
+	replyTypeOffsetData  = 1
+	replyTypeOffsetHole  = 2
+	replyTypeBlockStatus = 5
+	replyTypeError       = 1<<15 + 1
+	replyTypeErrorOffset = 1<<15 + 2
+)
+
+// Block status flags for the base:allocation meta context.
+const (
+	StateHole = 1 << 0
+	StateZero = 1 << 1
+)
+
+// Block status flags for qemu:dirty-bitmap meta contexts.
+const (
+	StateDirty = 1 << 0
+)
+
+const (
+	// BaseAllocation is the meta context reporting allocation status.
+	BaseAllocation = "base:allocation"
+
+	// DirtyBitmapPrefix is the prefix of meta contexts reporting the dirty
+	// blocks recorded by a qemu dirty bitmap.
+	DirtyBitmapPrefix = "qemu:dirty-bitmap:"
+
+	// Maximum payload of read and write commands. This is the limit used by
+	// qemu-nbd.
+	maxPayload = 32 * 1024 * 1024
+
+	// Maximum length of commands without payload.
+	maxLength = 1 << 30
+
+	// Maximum size of option data the server accepts.
+	maxOptionSize = 4096
+)
+
+// Extent describes a range reported by block status.
+type Extent struct {
+	Start  int64
+	Length int64
+	Flags  uint32
+}
+
+// Error is an error reported by the server.
+type Error struct {
+	Errno   syscall.Errno
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("nbd error: %v: %v", e.Errno, e.Message)
+	}
+	return fmt.Sprintf("nbd error: %v", e.Errno)
+}
+
+type request struct {
+	Magic  uint32
+	Flags  uint16
+	Type   uint16
+	Handle uint64
+	Offset uint64
+	Length uint32
+}
+
+type simpleReply struct {
+	Magic  uint32
+	Error  uint32
+	Handle uint64
+}
+
+type structuredReply struct {
+	Magic  uint32
+	Flags  uint16
+	Type   uint16
+	Handle uint64
+	Length uint32
+}
+
+type option struct {
+	Magic  uint64
+	Option uint32
+	Length uint32
+}
+
+type optionReply struct {
+	Magic  uint64
+	Option uint32
+	Type   uint32
+	Length uint32
+}
+
+func send(w io.Writer, v interface{}) error {
+	return binary.Write(w, binary.BigEndian, v)
+}
+
+func recv(r io.Reader, v interface{}) error {
+	return binary.Read(r, binary.BigEndian, v)
+}
+
+// errno returns the NBD error code for err. The protocol allows only a few
+// error values; anything else is reported as EIO.
+func errno(err error) uint32 {
+	if e, ok := err.(syscall.Errno); ok {
+		switch e {
+		case syscall.EPERM, syscall.EIO, syscall.ENOMEM, syscall.EINVAL,
+			syscall.ENOSPC, syscall.EOVERFLOW, syscall.EOPNOTSUPP, syscall.ESHUTDOWN:
+			return uint32(e)
+		}
+	}
+	return uint32(syscall.EIO)
+}
@@ -0,0 +1,537 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// Export is an image served by Server.
+type Export interface {
+	io.ReaderAt
+	io.WriterAt
+
+	// Zero zeroes length bytes starting at offset.
+	Zero(offset int64, length int64) error
+
+	// Flush flushes data written to the export to storage.
+	Flush() error
+
+	// Extents returns the allocation extents starting at offset, covering
+	// up to length bytes, using the base:allocation flags.
+	Extents(offset int64, length int64) ([]Extent, error)
+
+	// Size returns the size of the export.
+	Size() int64
+
+	// ReadOnly returns true if the export does not allow writing.
+	ReadOnly() bool
+
+	// Close is called when the client disconnects.
+	Close() error
+}
+
+// BitmapExport is implemented by exports providing qemu dirty bitmaps, for
+// the qemu:dirty-bitmap meta contexts.
+type BitmapExport interface {
+	// Bitmaps returns the names of the export dirty bitmaps.
+	Bitmaps() []string
+
+	// BitmapExtents is like Extents, but returns the extents of bitmap,
+	// using the StateDirty flag.
+	BitmapExtents(bitmap string, offset int64, length int64) ([]Extent, error)
+}
+
+// Server serves exports to NBD clients.
+type Server struct {
+	// Open returns the export requested by a client. If Open fails, the
+	// error is reported to the client.
+	Open func(name string) (Export, error)
+}
+
+// Serve accepts connections on l, serving each connection in a new
+// goroutine. Serve returns when l is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single client connection, closing conn when the
+// client disconnects.
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	sc := &serverConn{
+		server: s,
+		r:      bufio.NewReader(conn),
+		w:      bufio.NewWriter(conn),
+	}
+	export, err := sc.negotiate()
+	if err != nil || export == nil {
+		return
+	}
+	defer export.Close()
+	sc.transmit(export)
+}
+
+// metaContext is a meta context selected by the client. The id is the
+// index of the context in the export meta contexts, plus one.
+type metaContext struct {
+	id   uint32
+	name string
+}
+
+type serverConn struct {
+	server     *Server
+	r          *bufio.Reader
+	w          *bufio.Writer
+	noZeroes   bool
+	structured bool
+	contexts   []metaContext
+}
+
+// negotiate performs the handshake, returning the export selected by the
+// client, or nil if the client aborted the negotiation.
+func (sc *serverConn) negotiate() (Export, error) {
+	hello := struct {
+		Magic    uint64
+		OptMagic uint64
+		Flags    uint16
+	}{nbdMagic, optMagic, flagFixedNew | flagNoZeroes}
+	if err := sc.flush(send(sc.w, hello)); err != nil {
+		return nil, err
+	}
+
+	var clientFlags uint32
+	if err := recv(sc.r, &clientFlags); err != nil {
+		return nil, err
+	}
+	sc.noZeroes = clientFlags&clientNoZeroes != 0
+
+	for {
+		var opt option
+		if err := recv(sc.r, &opt); err != nil {
+			return nil, err
+		}
+		if opt.Magic != optMagic || opt.Length > maxOptionSize {
+			return nil, syscall.EINVAL
+		}
+		data := make([]byte, opt.Length)
+		if _, err := io.ReadFull(sc.r, data); err != nil {
+			return nil, err
+		}
+
+		var export Export
+		var err error
+
+		switch opt.Option {
+		case optExportName:
+			return sc.exportName(string(data))
+		case optAbort:
+			return nil, sc.replyOption(opt.Option, repAck, nil)
+		case optInfo, optGo:
+			export, err = sc.info(opt.Option, data)
+			if export != nil && opt.Option == optGo {
+				return export, err
+			}
+			if export != nil {
+				export.Close()
+			}
+		case optStructured:
+			if len(data) != 0 {
+				err = sc.replyOption(opt.Option, repErrInvalid, nil)
+			} else {
+				sc.structured = true
+				err = sc.replyOption(opt.Option, repAck, nil)
+			}
+		case optListMetaContext, optSetMetaContext:
+			err = sc.metaContext(opt.Option, data)
+		default:
+			err = sc.replyOption(opt.Option, repErrUnsup, nil)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// exportName handles NBD_OPT_EXPORT_NAME. There is no way to report an
+// error, so the connection is closed if the export cannot be opened.
+func (sc *serverConn) exportName(name string) (Export, error) {
+	export, err := sc.server.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info := struct {
+		Size  uint64
+		Flags uint16
+	}{uint64(export.Size()), transmissionFlags(export)}
+	err = send(sc.w, info)
+	if err == nil && !sc.noZeroes {
+		_, err = sc.w.Write(make([]byte, exportNameZeros))
+	}
+	if err = sc.flush(err); err != nil {
+		export.Close()
+		return nil, err
+	}
+	return export, nil
+}
+
+// info handles NBD_OPT_INFO and NBD_OPT_GO, returning the opened export.
+func (sc *serverConn) info(opt uint32, data []byte) (Export, error) {
+	name, rest, ok := parseString32(data)
+	if !ok || len(rest) < 2 || len(rest) != 2+2*int(binary.BigEndian.Uint16(rest)) {
+		return nil, sc.replyOption(opt, repErrInvalid, nil)
+	}
+
+	export, err := sc.server.Open(name)
+	if err != nil {
+		return nil, sc.replyOption(opt, repErrUnknown, []byte(err.Error()))
+	}
+
+	exportInfo := make([]byte, 12)
+	binary.BigEndian.PutUint16(exportInfo, infoExport)
+	binary.BigEndian.PutUint64(exportInfo[2:], uint64(export.Size()))
+	binary.BigEndian.PutUint16(exportInfo[10:], transmissionFlags(export))
+
+	blockSize := make([]byte, 14)
+	binary.BigEndian.PutUint16(blockSize, infoBlockSize)
+	binary.BigEndian.PutUint32(blockSize[2:], 1)
+	binary.BigEndian.PutUint32(blockSize[6:], 4096)
+	binary.BigEndian.PutUint32(blockSize[10:], maxPayload)
+
+	err = sc.replyOption(opt, repInfo, exportInfo)
+	if err == nil {
+		err = sc.replyOption(opt, repInfo, blockSize)
+	}
+	if err == nil {
+		err = sc.replyOption(opt, repAck, nil)
+	}
+	if err != nil {
+		export.Close()
+		return nil, err
+	}
+	return export, nil
+}
+
+// metaContext handles NBD_OPT_LIST_META_CONTEXT and
+// NBD_OPT_SET_META_CONTEXT. Queries match a context name, or a prefix ending
+// with ":" when listing contexts.
+func (sc *serverConn) metaContext(opt uint32, data []byte) error {
+	if !sc.structured {
+		return sc.replyOption(opt, repErrInvalid, nil)
+	}
+	name, rest, ok := parseString32(data)
+	if !ok || len(rest) < 4 {
+		return sc.replyOption(opt, repErrInvalid, nil)
+	}
+	count := binary.BigEndian.Uint32(rest)
+	rest = rest[4:]
+
+	var queries []string
+	for i := uint32(0); i < count; i++ {
+		var q string
+		q, rest, ok = parseString32(rest)
+		if !ok {
+			return sc.replyOption(opt, repErrInvalid, nil)
+		}
+		queries = append(queries, q)
+	}
+	if len(rest) != 0 {
+		return sc.replyOption(opt, repErrInvalid, nil)
+	}
+
+	available := sc.availableContexts(name)
+	if opt == optSetMetaContext {
+		sc.contexts = nil
+	}
+	for i, ctx := range available {
+		if !matchContext(ctx, queries, opt == optListMetaContext) {
+			continue
+		}
+		id := uint32(i + 1)
+		reply := appendUint32(nil, id)
+		reply = append(reply, ctx...)
+		if err := sc.replyOption(opt, repMetaContext, reply); err != nil {
+			return err
+		}
+		if opt == optSetMetaContext {
+			sc.contexts = append(sc.contexts, metaContext{id, ctx})
+		}
+	}
+	return sc.replyOption(opt, repAck, nil)
+}
+
+// availableContexts returns the meta contexts supported by export name.
+func (sc *serverConn) availableContexts(name string) []string {
+	contexts := []string{BaseAllocation}
+	export, err := sc.server.Open(name)
+	if err != nil {
+		return contexts
+	}
+	defer export.Close()
+	if be, ok := export.(BitmapExport); ok {
+		for _, bitmap := range be.Bitmaps() {
+			contexts = append(contexts, DirtyBitmapPrefix+bitmap)
+		}
+	}
+	return contexts
+}
+
+func matchContext(ctx string, queries []string, list bool) bool {
+	if list && len(queries) == 0 {
+		return true
+	}
+	for _, q := range queries {
+		if q == ctx || list && strings.HasSuffix(q, ":") && strings.HasPrefix(ctx, q) {
+			return true
+		}
+	}
+	return false
+}
+
+func (sc *serverConn) replyOption(opt uint32, typ uint32, data []byte) error {
+	err := send(sc.w, optionReply{optReplyMagic, opt, typ, uint32(len(data))})
+	if err == nil {
+		_, err = sc.w.Write(data)
+	}
+	return sc.flush(err)
+}
+
+// transmit serves requests until the client disconnects.
+func (sc *serverConn) transmit(export Export) {
+	var buf []byte
+	for {
+		var req request
+		if err := recv(sc.r, &req); err != nil || req.Magic != requestMagic {
+			return
+		}
+
+		if req.Type == cmdDisc {
+			return
+		}
+
+		if req.Type == cmdRead || req.Type == cmdWrite {
+			if req.Length > maxPayload {
+				// We cannot skip the payload of a huge write, and the client
+				// is broken anyway.
+				return
+			}
+			if len(buf) < int(req.Length) {
+				buf = make([]byte, req.Length)
+			}
+		}
+
+		var err error
+
+		switch req.Type {
+		case cmdRead:
+			err = sc.read(export, &req, buf[:req.Length])
+		case cmdWrite:
+			if _, err = io.ReadFull(sc.r, buf[:req.Length]); err != nil {
+				return
+			}
+			err = sc.write(export, &req, buf[:req.Length])
+		case cmdFlush:
+			err = sc.reply(&req, export.Flush())
+		case cmdTrim, cmdWriteZeroes:
+			err = sc.zero(export, &req)
+		case cmdBlockStatus:
+			err = sc.blockStatus(export, &req)
+		default:
+			err = sc.reply(&req, syscall.EINVAL)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (sc *serverConn) read(export Export, req *request, buf []byte) error {
+	if !inRange(export, req) {
+		return sc.reply(req, syscall.EINVAL)
+	}
+	n, err := export.ReadAt(buf, int64(req.Offset))
+	if n == len(buf) {
+		err = nil
+	} else if err == nil || err == io.EOF {
+		err = syscall.EIO
+	}
+	if err != nil {
+		return sc.reply(req, err)
+	}
+
+	if sc.structured {
+		hdr := structuredReply{structuredReplyMagic, replyFlagDone,
+			replyTypeOffsetData, req.Handle, uint32(8 + len(buf))}
+		err = send(sc.w, hdr)
+		if err == nil {
+			err = send(sc.w, req.Offset)
+		}
+	} else {
+		err = send(sc.w, simpleReply{simpleReplyMagic, 0, req.Handle})
+	}
+	if err == nil {
+		_, err = sc.w.Write(buf)
+	}
+	return sc.flush(err)
+}
+
+func (sc *serverConn) write(export Export, req *request, buf []byte) error {
+	if export.ReadOnly() {
+		return sc.reply(req, syscall.EPERM)
+	}
+	if !inRange(export, req) {
+		return sc.reply(req, syscall.EINVAL)
+	}
+	_, err := export.WriteAt(buf, int64(req.Offset))
+	if err == nil && req.Flags&cmdFlagFUA != 0 {
+		err = export.Flush()
+	}
+	return sc.reply(req, err)
+}
+
+func (sc *serverConn) zero(export Export, req *request) error {
+	if export.ReadOnly() {
+		return sc.reply(req, syscall.EPERM)
+	}
+	if !inRange(export, req) {
+		return sc.reply(req, syscall.EINVAL)
+	}
+	err := export.Zero(int64(req.Offset), int64(req.Length))
+	if err == nil && req.Flags&cmdFlagFUA != 0 {
+		err = export.Flush()
+	}
+	return sc.reply(req, err)
+}
+
+func (sc *serverConn) blockStatus(export Export, req *request) error {
+	if !sc.structured || len(sc.contexts) == 0 || !inRange(export, req) {
+		return sc.reply(req, syscall.EINVAL)
+	}
+
+	// Collect all replies before sending, so we can report errors.
+	payloads := make([][]byte, len(sc.contexts))
+	for i, ctx := range sc.contexts {
+		extents, err := contextExtents(export, ctx.name, int64(req.Offset), int64(req.Length))
+		if err != nil {
+			return sc.reply(req, err)
+		}
+		payload := appendUint32(nil, ctx.id)
+		for _, e := range extents {
+			payload = appendUint32(payload, uint32(e.Length))
+			payload = appendUint32(payload, e.Flags)
+		}
+		payloads[i] = payload
+	}
+
+	for i, payload := range payloads {
+		var flags uint16
+		if i == len(payloads)-1 {
+			flags = replyFlagDone
+		}
+		hdr := structuredReply{structuredReplyMagic, flags,
+			replyTypeBlockStatus, req.Handle, uint32(len(payload))}
+		if err := send(sc.w, hdr); err != nil {
+			return err
+		}
+		if _, err := sc.w.Write(payload); err != nil {
+			return err
+		}
+	}
+	return sc.w.Flush()
+}
+
+func contextExtents(export Export, name string, offset int64, length int64) ([]Extent, error) {
+	if name == BaseAllocation {
+		return export.Extents(offset, length)
+	}
+	be, ok := export.(BitmapExport)
+	if !ok {
+		return nil, syscall.EINVAL
+	}
+	return be.BitmapExtents(name[len(DirtyBitmapPrefix):], offset, length)
+}
+
+// reply sends a reply without payload, reporting err to the client.
+func (sc *serverConn) reply(req *request, err error) error {
+	if err == nil {
+		if sc.structured {
+			hdr := structuredReply{structuredReplyMagic, replyFlagDone,
+				replyTypeNone, req.Handle, 0}
+			return sc.flush(send(sc.w, hdr))
+		}
+		return sc.flush(send(sc.w, simpleReply{simpleReplyMagic, 0, req.Handle}))
+	}
+
+	if sc.structured {
+		msg := err.Error()
+		if len(msg) > 1024 {
+			msg = msg[:1024]
+		}
+		payload := appendUint32(nil, errno(err))
+		payload = append(payload, byte(len(msg)>>8), byte(len(msg)))
+		payload = append(payload, msg...)
+		hdr := structuredReply{structuredReplyMagic, replyFlagDone,
+			replyTypeError, req.Handle, uint32(len(payload))}
+		err = send(sc.w, hdr)
+		if err == nil {
+			_, err = sc.w.Write(payload)
+		}
+		return sc.flush(err)
+	}
+	return sc.flush(send(sc.w, simpleReply{simpleReplyMagic, errno(err), req.Handle}))
+}
+
+// flush flushes buffered data, unless err is not nil.
+func (sc *serverConn) flush(err error) error {
+	if err != nil {
+		return err
+	}
+	return sc.w.Flush()
+}
+
+func transmissionFlags(export Export) uint16 {
+	flags := uint16(FlagHasFlags | FlagSendFlush | FlagSendFUA | FlagSendTrim | FlagSendWriteZeroes)
+	if export.ReadOnly() {
+		flags |= FlagReadOnly
+	}
+	return flags
+}
+
+// inRange checks that the request is inside the export, without computing
+// offset + length, which may overflow.
+func inRange(export Export, req *request) bool {
+	size := uint64(export.Size())
+	return req.Offset <= size && uint64(req.Length) <= size-req.Offset
+}
+
+// parseString32 parses a string prefixed by 32 bit length, returning the
+// string and the rest of data.
+func parseString32(data []byte) (string, []byte, bool) {
+	if len(data) < 4 {
+		return "", nil, false
+	}
+	n := binary.BigEndian.Uint32(data)
+	if uint64(n) > uint64(len(data)-4) {
+		return "", nil, false
+	}
+	return string(data[4 : 4+n]), data[4+n:], true
+}
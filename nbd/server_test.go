@@ -0,0 +1,312 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package nbd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"ovirt/imageio/testutil"
+	"sync"
+	"testing"
+)
+
+const testBlock = 4096
+
+// memExport is an export keeping data in memory. Blocks full of zeros are
+// reported as holes. Dirty bitmaps keep a dirty flag per block.
+type memExport struct {
+	mutex    sync.Mutex
+	data     []byte
+	readOnly bool
+	flushes  int
+	bitmaps  map[string][]bool
+
+	// If set, reported by Extents instead of the extents of data.
+	extents []Extent
+}
+
+func (e *memExport) ReadAt(p []byte, off int64) (int, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if off >= int64(len(e.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, e.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (e *memExport) WriteAt(p []byte, off int64) (int, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return copy(e.data[off:], p), nil
+}
+
+func (e *memExport) Zero(offset int64, length int64) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for i := offset; i < offset+length; i++ {
+		e.data[i] = 0
+	}
+	return nil
+}
+
+func (e *memExport) Flush() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.flushes++
+	return nil
+}
+
+func (e *memExport) Extents(offset int64, length int64) ([]Extent, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.extents != nil {
+		return e.extents, nil
+	}
+	var extents []Extent
+	end := offset + length
+	for pos := offset; pos < end; {
+		next := pos - pos%testBlock + testBlock
+		if next > end {
+			next = end
+		}
+		var flags uint32
+		if bytes.Count(e.data[pos:next], []byte{0}) == int(next-pos) {
+			flags = StateHole | StateZero
+		}
+		if n := len(extents); n > 0 && extents[n-1].Flags == flags {
+			extents[n-1].Length += next - pos
+		} else {
+			extents = append(extents, Extent{pos, next - pos, flags})
+		}
+		pos = next
+	}
+	return extents, nil
+}
+
+func (e *memExport) Bitmaps() []string {
+	var names []string
+	for name := range e.bitmaps {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (e *memExport) BitmapExtents(bitmap string, offset int64, length int64) ([]Extent, error) {
+	dirty := e.bitmaps[bitmap]
+	var extents []Extent
+	end := offset + length
+	for pos := offset; pos < end; {
+		next := pos - pos%testBlock + testBlock
+		if next > end {
+			next = end
+		}
+		var flags uint32
+		if dirty[pos/testBlock] {
+			flags = StateDirty
+		}
+		if n := len(extents); n > 0 && extents[n-1].Flags == flags {
+			extents[n-1].Length += next - pos
+		} else {
+			extents = append(extents, Extent{pos, next - pos, flags})
+		}
+		pos = next
+	}
+	return extents, nil
+}
+
+func (e *memExport) Size() int64 {
+	return int64(len(e.data))
+}
+
+func (e *memExport) ReadOnly() bool {
+	return e.readOnly
+}
+
+func (e *memExport) Close() error {
+	return nil
+}
+
+// testServer serves exports on a unix socket.
+type testServer struct {
+	listener net.Listener
+	path     string
+	exports  map[string]*memExport
+}
+
+func startServer(t *testing.T, exports map[string]*memExport) *testServer {
+	f, err := ioutil.TempFile("/var/tmp", "nbd.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := f.Name()
+	f.Close()
+	os.Remove(path)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{listener: l, path: path, exports: exports}
+	server := &Server{Open: func(name string) (Export, error) {
+		e, ok := exports[name]
+		if !ok {
+			return nil, fmt.Errorf("No such export: %q", name)
+		}
+		return e, nil
+	}}
+	go server.Serve(l)
+	return s
+}
+
+func (s *testServer) Stop() {
+	s.listener.Close()
+	os.Remove(s.path)
+}
+
+// startNegotiation connects to the server, leaving the connection in the
+// option negotiation phase. If noZeroes is false, the server pads the reply to
+// NBD_OPT_EXPORT_NAME with zeros.
+func startNegotiation(t *testing.T, path string, noZeroes bool) *Client {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{
+		conn:     conn,
+		r:        bufio.NewReader(conn),
+		w:        bufio.NewWriter(conn),
+		contexts: map[string]uint32{},
+	}
+	var hello [18]byte
+	if _, err = io.ReadFull(c.r, hello[:]); err != nil {
+		t.Fatal(err)
+	}
+	clientFlags := uint32(clientFixedNew)
+	if noZeroes {
+		clientFlags |= clientNoZeroes
+	}
+	if err = send(c.w, clientFlags); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestServerExportName(t *testing.T) {
+	testServerExportName(t, false)
+}
+
+func TestServerExportNameNoZeroes(t *testing.T) {
+	testServerExportName(t, true)
+}
+
+func testServerExportName(t *testing.T, noZeroes bool) {
+	data := testutil.Buffer(8192)
+	s := startServer(t, map[string]*memExport{"": {data: data}})
+	defer s.Stop()
+
+	// Negotiate using NBD_OPT_EXPORT_NAME, without structured replies.
+	c := startNegotiation(t, s.path, noZeroes)
+	defer c.Close()
+
+	err := c.negotiateExportName("", noZeroes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Size() != int64(len(data)) {
+		t.Fatalf("Size %v, expected %v", c.Size(), len(data))
+	}
+
+	buf := make([]byte, 1000)
+	if _, err = c.ReadAt(buf, 100); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data[100:1100]) {
+		t.Fatalf("Expected %v, got %v", data[100:1100], buf)
+	}
+
+	extents, err := c.BlockStatus(0, 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(extents) != 1 || extents[0].Flags != 0 {
+		t.Fatalf("Unexpected extents without meta context: %+v", extents)
+	}
+
+	_, err = c.WriteAt(buf, 10000)
+	if _, ok := err.(*Error); !ok {
+		t.Fatalf("Expected *Error, got %v", err)
+	}
+}
+
+func TestServerUnknownExport(t *testing.T) {
+	s := startServer(t, map[string]*memExport{})
+	defer s.Stop()
+
+	_, err := Dial("unix", s.path, DialOptions{Export: "missing"})
+	if err == nil {
+		t.Fatal("Connecting to missing export did not fail")
+	}
+}
+
+func TestServerListMetaContexts(t *testing.T) {
+	e := &memExport{
+		data:    make([]byte, 8192),
+		bitmaps: map[string][]bool{"b1": {true, false}},
+	}
+	s := startServer(t, map[string]*memExport{"": e})
+	defer s.Stop()
+
+	c := startNegotiation(t, s.path, true)
+	defer c.conn.Close()
+	if err := c.negotiateStructured(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		queries  []string
+		expected []string
+	}{
+		{nil, []string{BaseAllocation, DirtyBitmapPrefix + "b1"}},
+		{[]string{"base:"}, []string{BaseAllocation}},
+		{[]string{DirtyBitmapPrefix}, []string{DirtyBitmapPrefix + "b1"}},
+		{[]string{"qemu:dirty-bitmap:b2"}, nil},
+	} {
+		data := appendString32(nil, "")
+		data = appendUint32(data, uint32(len(tc.queries)))
+		for _, q := range tc.queries {
+			data = appendString32(data, q)
+		}
+		if err := c.sendOption(optListMetaContext, data); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for {
+			reply, data, err := c.recvOptionReply(optListMetaContext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Type == repAck {
+				break
+			}
+			names = append(names, string(data[4:]))
+		}
+		if fmt.Sprint(names) != fmt.Sprint(tc.expected) {
+			t.Fatalf("%v: expected %v, got %v", tc.queries, tc.expected, names)
+		}
+	}
+}
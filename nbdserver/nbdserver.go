@@ -0,0 +1,319 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+// Package nbdserver exports ticketed images using the NBD protocol. The
+// export name is the ticket uuid, and every request is authorized by the
+// ticket, like requests to the images web server.
+package nbdserver
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"ovirt/imageio/auth"
+	"ovirt/imageio/backend"
+	"ovirt/imageio/nbd"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var (
+	listener net.Listener
+)
+
+// Start starts the NBD server. Use network "unix" to listen on a unix socket
+// at addr, or "tcp" to listen on a tcp address.
+func Start(network string, addr string) (err error) {
+	if listener != nil {
+		return fmt.Errorf("Already started")
+	}
+
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return
+	}
+
+	listener = ln
+
+	server := &nbd.Server{Open: open}
+	go server.Serve(listener)
+	return
+}
+
+// Stop stops the NBD server.
+//
+// This does not affect connected clients. When the ticket is removed, the
+// connection is not closed, but later requests fail with EPERM.
+func Stop() error {
+	if listener == nil {
+		return fmt.Errorf("Not running")
+	}
+	ln := listener
+	listener = nil
+	return ln.Close()
+}
+
+// Addr returns the address the server is listening on. For testing a server on
+// a random port.
+func Addr() string {
+	return listener.Addr().String()
+}
+
+// export is an image authorized by a ticket. A client connection is tracked
+// as a single ticket task, so removing the ticket cancels it.
+//
+// Requests are served while holding the mutex, so when the task is canceled
+// we can wait for the current request before ending the task.
+type export struct {
+	mutex       sync.Mutex
+	uuid        string
+	size        int64
+	readOnly    bool
+	backend     backend.Backend
+	task        *auth.Task
+	transferred int64
+}
+
+// dirtyExport is an export providing the ticket dirty bitmap.
+type dirtyExport struct {
+	*export
+	bitmap string
+}
+
+func open(name string) (nbd.Export, error) {
+	ticket, err := auth.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	url, err := auth.MayRead(name, 0, 0)
+	if err != nil {
+		url, err = auth.MayWrite(name, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	writable := strings.Contains(ticket.Mode, "w")
+	b, err := backend.Open(url, backend.OpenOptions{
+		Writable:    writable,
+		DirtyBitmap: ticket.DirtyBitmap,
+		Format:      ticket.Format,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	task, err := auth.Begin(context.Background(), name)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	e := &export{
+		uuid:     name,
+		size:     int64(ticket.Size),
+		readOnly: !writable,
+		backend:  b,
+		task:     task,
+	}
+	go e.watch()
+
+	if _, ok := b.(backend.DirtyBackend); ok && ticket.DirtyBitmap != "" {
+		return &dirtyExport{e, ticket.DirtyBitmap}, nil
+	}
+	return e, nil
+}
+
+func (e *export) ReadAt(p []byte, off int64) (int, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := e.mayRead(off, int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := e.backend.ReadAt(p, off)
+	e.add(int64(n))
+	return n, err
+}
+
+func (e *export) WriteAt(p []byte, off int64) (int, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := e.mayWrite(off, int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := e.backend.WriteAt(p, off)
+	e.add(int64(n))
+	return n, err
+}
+
+func (e *export) Zero(offset int64, length int64) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := e.mayWrite(offset, length); err != nil {
+		return err
+	}
+	if err := e.backend.Zero(e.task.Context(), offset, length); err != nil {
+		return err
+	}
+	e.add(length)
+	return nil
+}
+
+func (e *export) Flush() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.readOnly {
+		return nil
+	}
+	if err := e.mayWrite(0, 0); err != nil {
+		return err
+	}
+	return e.backend.Flush(e.task.Context())
+}
+
+// Extents returns the allocation extents. The last extent reported by the
+// backend may extend after the requested range, so extents are clipped.
+func (e *export) Extents(offset int64, length int64) ([]nbd.Extent, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := e.mayRead(offset, length); err != nil {
+		return nil, err
+	}
+	end := offset + length
+	extents, err := e.backend.Extents(e.task.Context(), offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []nbd.Extent
+	for _, x := range extents {
+		start, stop := clip(x.Start, x.Length, offset, end)
+		if start >= stop {
+			continue
+		}
+		var flags uint32
+		if x.Hole {
+			flags |= nbd.StateHole
+		}
+		if x.Zero {
+			flags |= nbd.StateZero
+		}
+		res = append(res, nbd.Extent{Start: start, Length: stop - start, Flags: flags})
+	}
+	return res, nil
+}
+
+func (e *export) Size() int64 {
+	return e.size
+}
+
+func (e *export) ReadOnly() bool {
+	return e.readOnly
+}
+
+func (e *export) Close() error {
+	e.task.Done()
+	return e.backend.Close()
+}
+
+// watch ends the task when the ticket is removed, after the current request
+// was completed. Later requests fail since the task context is canceled.
+func (e *export) watch() {
+	<-e.task.Context().Done()
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.task.Done()
+}
+
+func (e *dirtyExport) Bitmaps() []string {
+	return []string{e.bitmap}
+}
+
+func (e *dirtyExport) BitmapExtents(bitmap string, offset int64, length int64) ([]nbd.Extent, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := e.mayRead(offset, length); err != nil {
+		return nil, err
+	}
+	end := offset + length
+	db := e.backend.(backend.DirtyBackend)
+	extents, err := db.DirtyExtents(e.task.Context(), offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []nbd.Extent
+	for _, x := range extents {
+		start, stop := clip(x.Start, x.Length, offset, end)
+		if start >= stop {
+			continue
+		}
+		var flags uint32
+		if x.Dirty {
+			flags = nbd.StateDirty
+		}
+		res = append(res, nbd.Extent{Start: start, Length: stop - start, Flags: flags})
+	}
+	return res, nil
+}
+
+// mayRead checks that the ticket allows reading length bytes at offset, and
+// that the ticket was not removed since the client connected.
+func (e *export) mayRead(offset int64, length int64) error {
+	if e.task.Context().Err() != nil {
+		return syscall.EPERM
+	}
+	if !validRange(offset, length) {
+		return syscall.EINVAL
+	}
+	if _, err := auth.MayRead(e.uuid, offset, length); err != nil {
+		return syscall.EPERM
+	}
+	return nil
+}
+
+// mayWrite is like mayRead, for writing.
+func (e *export) mayWrite(offset int64, length int64) error {
+	if e.task.Context().Err() != nil {
+		return syscall.EPERM
+	}
+	if !validRange(offset, length) {
+		return syscall.EINVAL
+	}
+	if _, err := auth.MayWrite(e.uuid, offset, length); err != nil {
+		return syscall.EPERM
+	}
+	return nil
+}
+
+// validRange checks that offset and length are not negative, and that offset +
+// length does not overflow.
+func validRange(offset int64, length int64) bool {
+	return offset >= 0 && length >= 0 && length <= math.MaxInt64-offset
+}
+
+// add adds n bytes to the bytes transferred by the task. Like the images
+// server, zeroing is counted as transferred.
+func (e *export) add(n int64) {
+	e.transferred += n
+	e.task.Set(e.transferred)
+}
+
+// clip returns the part of the range start, length inside offset, end.
+func clip(start int64, length int64, offset int64, end int64) (int64, int64) {
+	stop := start + length
+	if start < offset {
+		start = offset
+	}
+	if stop > end {
+		stop = end
+	}
+	return start, stop
+}
@@ -0,0 +1,308 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package nbdserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"ovirt/imageio/auth"
+	"ovirt/imageio/nbd"
+	"ovirt/imageio/testutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const ticketUuid = "3facfbc1-68e0-4b77-b0c6-87e66fcabcc2"
+
+// startUnix starts the server on a unix socket in a temporary directory.
+// The caller should remove the directory and stop the server.
+func startUnix(t *testing.T) string {
+	dir, err := ioutil.TempDir("/var/tmp", "nbdserver.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Start("unix", filepath.Join(dir, "sock")); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func addTicket(t *testing.T, mode string, size int64, path string) {
+	ticket := &auth.Ticket{
+		Mode:    mode,
+		Size:    auth.Bytes(size),
+		Timeout: 10,
+		Url:     "file://" + path,
+		Uuid:    ticketUuid,
+	}
+	if err := auth.Add(ticket); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func dial(t *testing.T) *nbd.Client {
+	c, err := nbd.Dial("unix", Addr(), nbd.DialOptions{Export: ticketUuid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestReadWrite(t *testing.T) {
+	dir := startUnix(t)
+	defer os.RemoveAll(dir)
+	defer Stop()
+
+	const size = 1024 * 1024
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	addTicket(t, "rw", size, path)
+	defer auth.Remove(ticketUuid)
+
+	c := dial(t)
+	defer c.Close()
+
+	if c.Size() != size {
+		t.Fatalf("Size %v, expected %v", c.Size(), size)
+	}
+	if c.ReadOnly() {
+		t.Fatal("Export is read only")
+	}
+
+	buf := testutil.Buffer(100000)
+	if _, err = c.WriteAt(buf, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content[1000:101000], buf) {
+		t.Fatal("File content does not match data written")
+	}
+
+	res := make([]byte, len(buf))
+	if _, err = c.ReadAt(res, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, buf) {
+		t.Fatal("Data read does not match data written")
+	}
+
+	if err = c.Zero(0, 4096); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.ReadAt(res[:4096], 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res[:4096], make([]byte, 4096)) {
+		t.Fatal("Range was not zeroed")
+	}
+
+	status, err := auth.GetStatus(ticketUuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Ongoing != 1 || status.Transferred != 2*100000+2*4096 {
+		t.Fatalf("Unexpected status: %+v", status)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := startUnix(t)
+	defer os.RemoveAll(dir)
+	defer Stop()
+
+	path, err := testutil.CreateFile(4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	addTicket(t, "r", 4096, path)
+	defer auth.Remove(ticketUuid)
+
+	c := dial(t)
+	defer c.Close()
+
+	if !c.ReadOnly() {
+		t.Fatal("Export is not read only")
+	}
+	_, err = c.WriteAt(make([]byte, 512), 0)
+	if nerr, ok := err.(*nbd.Error); !ok || nerr.Errno != syscall.EPERM {
+		t.Fatalf("Expected EPERM, got %v", err)
+	}
+}
+
+func TestNoTicket(t *testing.T) {
+	dir := startUnix(t)
+	defer os.RemoveAll(dir)
+	defer Stop()
+
+	_, err := nbd.Dial("unix", Addr(), nbd.DialOptions{Export: ticketUuid})
+	if err == nil {
+		t.Fatal("Connecting without a ticket did not fail")
+	}
+}
+
+func TestOutOfTicketRange(t *testing.T) {
+	dir := startUnix(t)
+	defer os.RemoveAll(dir)
+	defer Stop()
+
+	path, err := testutil.CreateFile(8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	// The ticket allows access only to the first half of the file.
+	addTicket(t, "r", 4096, path)
+	defer auth.Remove(ticketUuid)
+
+	c := dial(t)
+	defer c.Close()
+
+	if c.Size() != 4096 {
+		t.Fatalf("Size %v, expected 4096", c.Size())
+	}
+	_, err = c.ReadAt(make([]byte, 4096), 4096)
+	if err == nil {
+		t.Fatal("Reading after ticket size did not fail")
+	}
+	_, err = c.ReadAt(make([]byte, 256), -256)
+	if err == nil {
+		t.Fatal("Reading at negative offset did not fail")
+	}
+	if _, err = c.ReadAt(make([]byte, 4096), 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportInvalidRange(t *testing.T) {
+	path, err := testutil.CreateFile(4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	addTicket(t, "rw", 4096, path)
+	defer auth.Remove(ticketUuid)
+
+	e, err := open(ticketUuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	// Ranges wrapping around must not pass the ticket size check.
+	if _, err := e.ReadAt(make([]byte, 256), -256); err != syscall.EINVAL {
+		t.Fatalf("Expected EINVAL, got %v", err)
+	}
+	if _, err := e.WriteAt(make([]byte, 256), -256); err != syscall.EINVAL {
+		t.Fatalf("Expected EINVAL, got %v", err)
+	}
+	if err := e.Zero(math.MaxInt64, 2); err != syscall.EINVAL {
+		t.Fatalf("Expected EINVAL, got %v", err)
+	}
+	if _, err := e.Extents(-256, 512); err != syscall.EINVAL {
+		t.Fatalf("Expected EINVAL, got %v", err)
+	}
+}
+
+func TestExtents(t *testing.T) {
+	dir := startUnix(t)
+	defer os.RemoveAll(dir)
+	defer Stop()
+
+	const size = 1024 * 1024
+	path, err := testutil.CreateFile(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	addTicket(t, "r", size, path)
+	defer auth.Remove(ticketUuid)
+
+	c := dial(t)
+	defer c.Close()
+
+	extents, err := c.BlockStatus(4096, size-4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := int64(4096)
+	for _, e := range extents {
+		if e.Start != pos {
+			t.Fatalf("Expected extent at %v, got %+v", pos, e)
+		}
+		pos += e.Length
+	}
+	if pos != size {
+		t.Fatalf("Extents end at %v, expected %v: %+v", pos, size, extents)
+	}
+}
+
+func TestRemoveTicket(t *testing.T) {
+	dir := startUnix(t)
+	defer os.RemoveAll(dir)
+	defer Stop()
+
+	path, err := testutil.CreateFile(4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	addTicket(t, "rw", 4096, path)
+	defer auth.Remove(ticketUuid)
+
+	c := dial(t)
+	defer c.Close()
+
+	// Removing the ticket does not wait for the client to disconnect.
+	if err = auth.RemoveWait(ticketUuid, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.ReadAt(make([]byte, 512), 0)
+	if nerr, ok := err.(*nbd.Error); !ok || nerr.Errno != syscall.EPERM {
+		t.Fatalf("Expected EPERM, got %v", err)
+	}
+}
+
+func TestAlreadyRunning(t *testing.T) {
+	dir := startUnix(t)
+	defer os.RemoveAll(dir)
+	defer Stop()
+
+	if err := Start("unix", filepath.Join(dir, "sock2")); err == nil {
+		t.Fatal("Starting running server did not fail")
+	}
+}
+
+func TestNotRunning(t *testing.T) {
+	if err := Stop(); err == nil {
+		t.Fatal("Stopping server not running did not fail")
+	}
+}
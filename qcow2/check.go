@@ -0,0 +1,140 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// Refcount table entries.
+	refcountOffsetMask = 0xfffffffffffffe00
+)
+
+// refcount returns the reference count of the host cluster at index cluster.
+func (img *Image) refcount(cluster int64) (uint64, error) {
+	bits := int64(1) << img.header.RefcountOrder
+	blockEntries := img.clusterSize * 8 / bits
+
+	tableIndex := cluster / blockEntries
+	if tableIndex >= int64(len(img.refcountTable)) {
+		return 0, nil
+	}
+	offset := img.refcountTable[tableIndex] & refcountOffsetMask
+	if offset == 0 {
+		return 0, nil
+	}
+	if offset%uint64(img.clusterSize) != 0 {
+		return 0, fmt.Errorf("unaligned refcount block offset: %d", offset)
+	}
+
+	// Read only the bytes holding the entry.
+	index := cluster % blockEntries
+	width := (bits + 7) / 8
+	buf := make([]byte, 8)
+	pos := int64(offset) + index*bits/8
+	if _, err := img.file.ReadAt(buf[8-width:], pos); err != nil {
+		return 0, fmt.Errorf("error reading refcount block at offset %d: %v",
+			offset, err)
+	}
+	value := binary.BigEndian.Uint64(buf)
+
+	// Refcounts smaller than a byte are stored starting at the least
+	// significant bits.
+	if bits < 8 {
+		value = value >> uint64(index*bits%8) & (1<<uint64(bits) - 1)
+	}
+	return value, nil
+}
+
+// Check verifies that the refcount of every host cluster matches the number
+// of references to the cluster from the image metadata. Images with internal
+// snapshots or persistent bitmaps are not supported.
+func (img *Image) Check() error {
+	img.mutex.Lock()
+	defer img.mutex.Unlock()
+
+	if img.header.NbSnapshots != 0 {
+		return fmt.Errorf("checking images with snapshots is not supported")
+	}
+	if img.ext.bitmaps {
+		return fmt.Errorf("checking images with bitmaps is not supported")
+	}
+
+	expected := map[int64]uint64{}
+	ref := func(offset uint64, length int64) {
+		first := int64(offset) / img.clusterSize
+		last := (int64(offset) + length - 1) / img.clusterSize
+		for c := first; c <= last; c++ {
+			expected[c]++
+		}
+	}
+
+	// The header cluster, including the header extensions and the backing
+	// file name.
+	ref(0, 1)
+
+	ref(img.header.L1TableOffset, int64(img.header.L1Size)*8)
+	ref(img.header.RefcountTableOffset,
+		int64(img.header.RefcountTableClusters)*img.clusterSize)
+	for _, entry := range img.refcountTable {
+		if offset := entry & refcountOffsetMask; offset != 0 {
+			ref(offset, img.clusterSize)
+		}
+	}
+
+	shift := 62 - (img.header.ClusterBits - 8)
+	for _, l1Entry := range img.l1 {
+		l2Offset := l1Entry & entryOffsetMask
+		if l2Offset == 0 {
+			continue
+		}
+		ref(l2Offset, img.clusterSize)
+		table, err := img.l2Table(l2Offset)
+		if err != nil {
+			return err
+		}
+		for _, entry := range table {
+			if entry&entryCompressed != 0 {
+				offset := entry & (1<<shift - 1)
+				sectors := int64((entry&^(entryCompressed|entryCopied))>>shift) + 1
+				start := offset &^ (sectorSize - 1)
+				ref(start, sectors*sectorSize)
+			} else if offset := entry & entryOffsetMask; offset != 0 {
+				ref(offset, img.clusterSize)
+			}
+		}
+	}
+
+	// Block devices report zero size in Stat.
+	size, err := img.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	clusters := (size + img.clusterSize - 1) / img.clusterSize
+
+	for c := range expected {
+		if c >= clusters {
+			return fmt.Errorf("cluster %d is after the end of the image", c)
+		}
+	}
+	for c := int64(0); c < clusters; c++ {
+		refcount, err := img.refcount(c)
+		if err != nil {
+			return err
+		}
+		if refcount != expected[c] {
+			return fmt.Errorf("cluster %d refcount %d, expected %d",
+				c, refcount, expected[c])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package qcow2
+
+import (
+	"os"
+	"ovirt/imageio/testutil"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	path := createImage(t, testutil.Qcow2Options{
+		Size:        testSize,
+		BackingFile: "base.qcow2",
+		Data:        map[int64][]byte{0: cluster(1), 9: cluster(1)},
+		Compressed:  map[int64][]byte{3: cluster(2), 4: testutil.Buffer(testCluster)},
+	})
+	defer os.Remove(path)
+
+	// Open without the backing file; checking does not read guest data.
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := newImage(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	if err := img.Check(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckRefcountOrders(t *testing.T) {
+	path := createImage(t, testutil.Qcow2Options{Size: testSize})
+	defer os.Remove(path)
+	img := openImage(t, path)
+	defer img.Close()
+
+	// Refcount block entries of cluster 0 for all refcount widths.
+	for order := uint32(0); order <= 6; order++ {
+		img.header.RefcountOrder = order
+		refcount, err := img.refcount(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The image uses 16 bits refcounts; cluster 0 refcount is 0x0001.
+		var expected uint64
+		switch order {
+		case 4:
+			expected = 1
+		case 5:
+			expected = 0x00010001
+		case 6:
+			expected = 0x0001000100010001
+		}
+		if refcount != expected {
+			t.Fatalf("Refcount order %d: expected %#x, got %#x", order, expected, refcount)
+		}
+	}
+}
+
+func TestCheckLeak(t *testing.T) {
+	path := createImage(t, testutil.Qcow2Options{
+		Size: testSize,
+		Data: map[int64][]byte{0: cluster(1)},
+	})
+	defer os.Remove(path)
+
+	// Add an unused cluster at the end of the image with refcount 1.
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := f.Stat()
+	clusters := info.Size() / testCluster
+	f.WriteAt([]byte{0, 1}, 2*testCluster+clusters*2)
+	f.WriteAt(cluster(0), info.Size())
+	f.Close()
+
+	img := openImage(t, path)
+	defer img.Close()
+	if err := img.Check(); err == nil {
+		t.Fatal("Leaked cluster not detected")
+	}
+}
+
+func TestCheckMissingRefcount(t *testing.T) {
+	path := createImage(t, testutil.Qcow2Options{
+		Size: testSize,
+		Data: map[int64][]byte{0: cluster(1)},
+	})
+	defer os.Remove(path)
+
+	// Clear the refcount of the last cluster, the l2 table.
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := f.Stat()
+	last := info.Size()/testCluster - 1
+	f.WriteAt([]byte{0, 0}, 2*testCluster+last*2)
+	f.Close()
+
+	img := openImage(t, path)
+	defer img.Close()
+	if err := img.Check(); err == nil {
+		t.Fatal("Missing refcount not detected")
+	}
+}
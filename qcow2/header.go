@@ -0,0 +1,246 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	magic = 0x514649fb // "QFI\xfb"
+
+	// Size of version 2 header, and of version 3 header without optional
+	// fields.
+	headerSizeV2 = 72
+	headerSizeV3 = 104
+
+	minClusterBits = 9
+	maxClusterBits = 21
+
+	// Limit the size of tables loaded into memory.
+	maxTableSize = 32 * 1024 * 1024
+
+	// Incompatible features.
+	incompatDirty       = 1 << 0
+	incompatCorrupt     = 1 << 1
+	incompatDataFile    = 1 << 2
+	incompatCompression = 1 << 3
+	incompatExtendedL2  = 1 << 4
+	incompatKnown       = 1<<5 - 1
+
+	// Header extensions.
+	extEnd           = 0x00000000
+	extBackingFormat = 0xe2792aca
+	extFeatureTable  = 0x6803f857
+	extBitmaps       = 0x23852875
+	extDataFile      = 0x44415441
+)
+
+// header is the qcow2 header, stored at the start of the image.
+type header struct {
+	Magic                 uint32
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+
+	// Version 3 fields.
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
+}
+
+// readHeader reads and validates the header of image r.
+func readHeader(r io.ReaderAt) (*header, error) {
+	buf := make([]byte, headerSizeV3)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n < headerSizeV2 {
+		return nil, fmt.Errorf("not a qcow2 image: header truncated")
+	}
+
+	h := &header{}
+	if err := binary.Read(bytes.NewReader(buf), binary.BigEndian, h); err != nil {
+		return nil, err
+	}
+	if h.Magic != magic {
+		return nil, fmt.Errorf("not a qcow2 image: invalid magic %#x", h.Magic)
+	}
+
+	switch h.Version {
+	case 2:
+		// Version 2 images have no version 3 fields, and use 16 bits
+		// refcounts.
+		h.IncompatibleFeatures = 0
+		h.CompatibleFeatures = 0
+		h.AutoclearFeatures = 0
+		h.RefcountOrder = 4
+		h.HeaderLength = headerSizeV2
+	case 3:
+		if n < headerSizeV3 {
+			return nil, fmt.Errorf("header truncated")
+		}
+		if h.HeaderLength < headerSizeV3 {
+			return nil, fmt.Errorf("invalid header length: %d", h.HeaderLength)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported version: %d", h.Version)
+	}
+
+	if h.ClusterBits < minClusterBits || h.ClusterBits > maxClusterBits {
+		return nil, fmt.Errorf("invalid cluster bits: %d", h.ClusterBits)
+	}
+	if h.HeaderLength > 1<<h.ClusterBits {
+		return nil, fmt.Errorf("invalid header length: %d", h.HeaderLength)
+	}
+	if h.CryptMethod != 0 {
+		return nil, fmt.Errorf("encrypted images are not supported")
+	}
+	if h.RefcountOrder > 6 {
+		return nil, fmt.Errorf("invalid refcount order: %d", h.RefcountOrder)
+	}
+	if err := h.checkFeatures(r); err != nil {
+		return nil, err
+	}
+	if int64(h.L1Size)*8 > maxTableSize {
+		return nil, fmt.Errorf("l1 table too large: %d entries", h.L1Size)
+	}
+	if int64(h.RefcountTableClusters)<<h.ClusterBits > maxTableSize {
+		return nil, fmt.Errorf("refcount table too large: %d clusters",
+			h.RefcountTableClusters)
+	}
+
+	clusterSize := uint64(1) << h.ClusterBits
+	if h.L1TableOffset%clusterSize != 0 {
+		return nil, fmt.Errorf("unaligned l1 table offset: %d", h.L1TableOffset)
+	}
+	if h.RefcountTableOffset%clusterSize != 0 {
+		return nil, fmt.Errorf("unaligned refcount table offset: %d",
+			h.RefcountTableOffset)
+	}
+
+	// The L1 table must be large enough to map the entire image.
+	l2Size := clusterSize / 8
+	needed := (h.Size + clusterSize*l2Size - 1) / (clusterSize * l2Size)
+	if uint64(h.L1Size) < needed {
+		return nil, fmt.Errorf("l1 table too small: %d entries, need %d",
+			h.L1Size, needed)
+	}
+
+	return h, nil
+}
+
+// checkFeatures fails if the image uses an incompatible feature we do not
+// support.
+func (h *header) checkFeatures(r io.ReaderAt) error {
+	features := h.IncompatibleFeatures
+	if features&^incompatKnown != 0 {
+		return fmt.Errorf("unsupported incompatible features: %#x", features)
+	}
+	if features&incompatCorrupt != 0 {
+		return fmt.Errorf("image is corrupt")
+	}
+	if features&incompatDataFile != 0 {
+		return fmt.Errorf("external data files are not supported")
+	}
+	if features&incompatExtendedL2 != 0 {
+		return fmt.Errorf("extended l2 entries are not supported")
+	}
+	if features&incompatCompression != 0 {
+		// Compression type is an optional header field, 0 means zlib.
+		if h.HeaderLength <= headerSizeV3 {
+			return fmt.Errorf("compression type missing")
+		}
+		buf := make([]byte, 1)
+		if _, err := r.ReadAt(buf, headerSizeV3); err != nil {
+			return err
+		}
+		if buf[0] != 0 {
+			return fmt.Errorf("unsupported compression type: %d", buf[0])
+		}
+	}
+	return nil
+}
+
+// extensions holds the header extensions we care about.
+type extensions struct {
+	backingFormat string
+	bitmaps       bool
+}
+
+// readExtensions reads the header extensions following the header.
+func readExtensions(r io.ReaderAt, h *header) (*extensions, error) {
+	ext := &extensions{}
+	clusterSize := int64(1) << h.ClusterBits
+	offset := int64(h.HeaderLength)
+	buf := make([]byte, 8)
+
+	for offset+8 <= clusterSize {
+		if _, err := r.ReadAt(buf, offset); err != nil {
+			return nil, fmt.Errorf("error reading header extension: %v", err)
+		}
+		typ := binary.BigEndian.Uint32(buf)
+		length := int64(binary.BigEndian.Uint32(buf[4:]))
+		offset += 8
+
+		if typ == extEnd {
+			return ext, nil
+		}
+		if offset+length > clusterSize {
+			return nil, fmt.Errorf("header extension %#x too large: %d", typ, length)
+		}
+
+		switch typ {
+		case extBackingFormat:
+			data := make([]byte, length)
+			if _, err := r.ReadAt(data, offset); err != nil {
+				return nil, fmt.Errorf("error reading backing format: %v", err)
+			}
+			ext.backingFormat = string(data)
+		case extBitmaps:
+			ext.bitmaps = true
+		}
+
+		// Extension data is padded to 8 bytes.
+		offset += (length + 7) &^ 7
+	}
+
+	return nil, fmt.Errorf("header extensions not terminated")
+}
+
+// readBackingFile returns the name of the backing file, or an empty string
+// if the image has no backing file.
+func readBackingFile(r io.ReaderAt, h *header) (string, error) {
+	if h.BackingFileOffset == 0 {
+		return "", nil
+	}
+	if h.BackingFileSize == 0 || h.BackingFileSize > 1023 {
+		return "", fmt.Errorf("invalid backing file size: %d", h.BackingFileSize)
+	}
+	buf := make([]byte, h.BackingFileSize)
+	if _, err := r.ReadAt(buf, int64(h.BackingFileOffset)); err != nil {
+		return "", fmt.Errorf("error reading backing file: %v", err)
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,117 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package qcow2
+
+import (
+	"encoding/binary"
+	"os"
+	"ovirt/imageio/testutil"
+	"testing"
+)
+
+// patchHeader creates a valid image and modifies the header at offset.
+func patchHeader(t *testing.T, offset int64, value interface{}) string {
+	path := createImage(t, testutil.Qcow2Options{Size: testSize})
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		os.Remove(path)
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := &offsetWriter{f, offset}
+	if err := binary.Write(w, binary.BigEndian, value); err != nil {
+		os.Remove(path)
+		t.Fatal(err)
+	}
+	return path
+}
+
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+func TestHeaderValid(t *testing.T) {
+	path := createImage(t, testutil.Qcow2Options{
+		Size:          testSize,
+		BackingFile:   "base.raw",
+		BackingFormat: "raw",
+	})
+	defer os.Remove(path)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	h, err := readHeader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != 3 || h.ClusterBits != 16 || h.Size != testSize || h.RefcountOrder != 4 {
+		t.Fatalf("Unexpected header: %+v", h)
+	}
+	ext, err := readExtensions(f, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext.backingFormat != "raw" {
+		t.Fatalf("Expected backing format raw, got %q", ext.backingFormat)
+	}
+	name, err := readBackingFile(f, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "base.raw" {
+		t.Fatalf("Expected backing file base.raw, got %q", name)
+	}
+}
+
+func TestHeaderInvalid(t *testing.T) {
+	cases := []struct {
+		name   string
+		offset int64
+		value  interface{}
+	}{
+		{"magic", 0, uint32(0x12345678)},
+		{"version", 4, uint32(4)},
+		{"cluster bits", 20, uint32(22)},
+		{"encryption", 32, uint32(1)},
+		{"l1 size", 36, uint32(0)},
+		{"l1 offset", 40, uint64(1000)},
+		{"corrupt", 72, uint64(incompatCorrupt)},
+		{"data file", 72, uint64(incompatDataFile)},
+		{"extended l2", 72, uint64(incompatExtendedL2)},
+		{"unknown feature", 72, uint64(1 << 10)},
+		{"refcount order", 96, uint32(7)},
+	}
+	for _, c := range cases {
+		path := patchHeader(t, c.offset, c.value)
+		img, err := Open(path, false)
+		os.Remove(path)
+		if err == nil {
+			img.Close()
+			t.Fatalf("Opening image with invalid %s did not fail", c.name)
+		}
+	}
+}
+
+func TestHeaderDirty(t *testing.T) {
+	// Dirty images have inaccurate refcounts, but can be read.
+	path := patchHeader(t, 72, uint64(incompatDirty))
+	defer os.Remove(path)
+	img := openImage(t, path)
+	img.Close()
+}
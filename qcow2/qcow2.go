@@ -0,0 +1,558 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+// Package qcow2 provides access to the guest visible data of qcow2 images.
+//
+// See https://gitlab.com/qemu-project/qemu/-/blob/master/docs/interop/qcow2.txt
+// for the image format specification.
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// L1 and L2 table entries.
+	entryOffsetMask = 0x00fffffffffffe00
+	entryCompressed = 1 << 62
+	entryCopied     = 1 << 63
+	entryZero       = 1 << 0
+
+	// Compressed clusters size is stored in 512 bytes sectors.
+	sectorSize = 512
+
+	// Number of L2 tables cached in memory.
+	l2CacheSize = 32
+
+	// Limit backing chain length, avoiding endless loop with a backing
+	// file pointing to itself.
+	maxBackingChain = 64
+)
+
+// Extent describes a range of guest visible data.
+type Extent struct {
+	Start  int64
+	Length int64
+
+	// Zero is true if the range reads as zeros.
+	Zero bool
+
+	// Hole is true if the range is not allocated in the image or in its
+	// backing chain.
+	Hole bool
+}
+
+// backingImage is an image in the backing chain, either a qcow2 or a raw
+// image.
+type backingImage interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// Image is an open qcow2 image. Reading from the image returns the guest
+// visible data, including data from the backing chain.
+//
+// When writing, new clusters are allocated at the end of the image. Metadata
+// is written when clusters are allocated, and new clusters get their refcount
+// before they are referenced, so the image is consistent after Flush, and an
+// interrupted write can only leak clusters.
+type Image struct {
+	file        *os.File
+	header      *header
+	ext         *extensions
+	clusterSize int64
+	l2Size      int64
+	backing     backingImage
+
+	mutex         sync.Mutex
+	writable      bool
+	end           int64 // Offset of the next allocated host cluster.
+	l1            []uint64
+	refcountTable []uint64
+	l2Cache       map[uint64][]uint64
+
+	// Last decompressed cluster.
+	compressedEntry uint64
+	compressedData  []byte
+}
+
+// Open opens the qcow2 image at path, and its backing chain. If writable is
+// true, the image is opened for writing; the backing chain is always opened
+// read only.
+func Open(path string, writable bool) (*Image, error) {
+	return open(path, writable, 0)
+}
+
+func open(path string, writable bool, depth int) (*Image, error) {
+	flag := os.O_RDONLY
+	if writable {
+		flag = os.O_RDWR
+	}
+	file, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	img, err := newImage(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := img.openBacking(path, depth); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if writable {
+		if err := img.prepareWrite(); err != nil {
+			img.Close()
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return img, nil
+}
+
+func newImage(file *os.File) (*Image, error) {
+	h, err := readHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	ext, err := readExtensions(file, h)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{
+		file:        file,
+		header:      h,
+		ext:         ext,
+		clusterSize: int64(1) << h.ClusterBits,
+		l2Size:      int64(1) << h.ClusterBits / 8,
+		l2Cache:     map[uint64][]uint64{},
+	}
+
+	img.l1, err = img.readTable(h.L1TableOffset, int64(h.L1Size))
+	if err != nil {
+		return nil, fmt.Errorf("error reading l1 table: %v", err)
+	}
+	refcountEntries := int64(h.RefcountTableClusters) * img.clusterSize / 8
+	img.refcountTable, err = img.readTable(h.RefcountTableOffset, refcountEntries)
+	if err != nil {
+		return nil, fmt.Errorf("error reading refcount table: %v", err)
+	}
+
+	return img, nil
+}
+
+// openBacking opens the backing file of image at path, if any. Backing file
+// names are relative to the image directory, and must not refer to files
+// outside of the image directory, so an uploaded image cannot expose other
+// files on the host.
+func (img *Image) openBacking(path string, depth int) error {
+	name, err := readBackingFile(img.file, img.header)
+	if err != nil || name == "" {
+		return err
+	}
+	if depth >= maxBackingChain {
+		return fmt.Errorf("backing chain too long")
+	}
+	if strings.Contains(name, ":") {
+		return fmt.Errorf("unsupported backing file: %q", name)
+	}
+	if filepath.IsAbs(name) || hasDotDot(name) {
+		return fmt.Errorf("backing file outside of image directory: %q", name)
+	}
+	name = filepath.Join(filepath.Dir(path), name)
+
+	format := img.ext.backingFormat
+	if format == "" {
+		format, err = probe(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch format {
+	case "qcow2":
+		img.backing, err = open(name, false, depth+1)
+	case "raw":
+		img.backing, err = openRaw(name)
+	default:
+		err = fmt.Errorf("unsupported backing format: %q", format)
+	}
+	return err
+}
+
+// hasDotDot returns true if name has a ".." element.
+func hasDotDot(name string) bool {
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// probe returns the format of the image at path.
+func probe(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	buf := make([]byte, 4)
+	if _, err := file.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return "", err
+	}
+	if binary.BigEndian.Uint32(buf) == magic {
+		return "qcow2", nil
+	}
+	return "raw", nil
+}
+
+// Size returns the virtual size of the image.
+func (img *Image) Size() int64 {
+	return int64(img.header.Size)
+}
+
+// ClusterSize returns the image cluster size.
+func (img *Image) ClusterSize() int64 {
+	return img.clusterSize
+}
+
+// ReadAt reads guest visible data at offset off. Unallocated clusters are
+// read from the backing chain, or as zeros if the image has no backing file.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	img.mutex.Lock()
+	defer img.mutex.Unlock()
+
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+	size := img.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	end := size
+	if int64(len(p)) < size-off {
+		end = off + int64(len(p))
+	}
+
+	for pos := off; pos < end; {
+		n := img.clusterSize - pos%img.clusterSize
+		if end-pos < n {
+			n = end - pos
+		}
+		if err := img.readCluster(p[pos-off:pos-off+n], pos); err != nil {
+			return int(pos - off), err
+		}
+		pos += n
+	}
+
+	if n := int(end - off); n < len(p) {
+		return n, io.EOF
+	}
+	return len(p), nil
+}
+
+// readCluster reads buf at guest offset pos. buf must not cross a cluster
+// boundary.
+func (img *Image) readCluster(buf []byte, pos int64) error {
+	entry, err := img.l2Entry(pos)
+	if err != nil {
+		return err
+	}
+	inner := pos % img.clusterSize
+
+	switch {
+	case entry&entryCompressed != 0:
+		data, err := img.readCompressed(entry)
+		if err != nil {
+			return err
+		}
+		copy(buf, data[inner:])
+	case img.isZero(entry):
+		zero(buf)
+	case entry&entryOffsetMask != 0:
+		offset := int64(entry&entryOffsetMask) + inner
+		if _, err := img.file.ReadAt(buf, offset); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("cluster at offset %d truncated", offset-inner)
+			}
+			return err
+		}
+	case img.backing != nil:
+		return img.readBacking(buf, pos)
+	default:
+		zero(buf)
+	}
+	return nil
+}
+
+// readBacking reads buf from the backing image. The backing image may be
+// smaller than the image; data after the end of the backing image reads as
+// zeros.
+func (img *Image) readBacking(buf []byte, pos int64) error {
+	n := img.backing.Size() - pos
+	if n < 0 {
+		n = 0
+	} else if n > int64(len(buf)) {
+		n = int64(len(buf))
+	}
+	if n > 0 {
+		if _, err := img.backing.ReadAt(buf[:n], pos); err != nil && err != io.EOF {
+			return err
+		}
+	}
+	zero(buf[n:])
+	return nil
+}
+
+// readCompressed returns the decompressed cluster described by L2 entry.
+func (img *Image) readCompressed(entry uint64) ([]byte, error) {
+	if entry == img.compressedEntry && img.compressedData != nil {
+		return img.compressedData, nil
+	}
+
+	// The host offset is stored in the low bits of the entry, and the
+	// number of additional sectors in the remaining bits.
+	shift := 62 - (img.header.ClusterBits - 8)
+	offset := int64(entry & (1<<shift - 1))
+	sectors := int64((entry&^(entryCompressed|entryCopied))>>shift) + 1
+	length := sectors*sectorSize - offset%sectorSize
+
+	compressed := make([]byte, length)
+	// Compressed data may end before the last sector, at the end of the file.
+	n, err := img.file.ReadAt(compressed, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	data := make([]byte, img.clusterSize)
+	r := flate.NewReader(bytes.NewReader(compressed[:n]))
+	defer r.Close()
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("error decompressing cluster at offset %d: %v",
+			offset, err)
+	}
+
+	img.compressedEntry = entry
+	img.compressedData = data
+	return data, nil
+}
+
+// isZero returns true if L2 entry has the zero flag. Version 2 images do not
+// support the zero flag.
+func (img *Image) isZero(entry uint64) bool {
+	return img.header.Version >= 3 && entry&entryZero != 0
+}
+
+// l2Entry returns the L2 entry mapping guest offset pos, or 0 if the L2
+// table is not allocated.
+func (img *Image) l2Entry(pos int64) (uint64, error) {
+	cluster := pos / img.clusterSize
+	l1Index := cluster / img.l2Size
+	if l1Index >= int64(len(img.l1)) {
+		return 0, nil
+	}
+	l2Offset := img.l1[l1Index] & entryOffsetMask
+	if l2Offset == 0 {
+		return 0, nil
+	}
+	table, err := img.l2Table(l2Offset)
+	if err != nil {
+		return 0, err
+	}
+	return table[cluster%img.l2Size], nil
+}
+
+// l2Table returns the L2 table at host offset, using the cache.
+func (img *Image) l2Table(offset uint64) ([]uint64, error) {
+	if table, ok := img.l2Cache[offset]; ok {
+		return table, nil
+	}
+	if offset%uint64(img.clusterSize) != 0 {
+		return nil, fmt.Errorf("unaligned l2 table offset: %d", offset)
+	}
+	table, err := img.readTable(offset, img.l2Size)
+	if err != nil {
+		return nil, fmt.Errorf("error reading l2 table at offset %d: %v", offset, err)
+	}
+	if len(img.l2Cache) >= l2CacheSize {
+		img.l2Cache = map[uint64][]uint64{}
+	}
+	img.l2Cache[offset] = table
+	return table, nil
+}
+
+// readTable reads a table of entries big endian 64 bits entries at host
+// offset.
+func (img *Image) readTable(offset uint64, entries int64) ([]uint64, error) {
+	buf := make([]byte, entries*8)
+	if _, err := img.file.ReadAt(buf, int64(offset)); err != nil {
+		return nil, err
+	}
+	table := make([]uint64, entries)
+	for i := range table {
+		table[i] = binary.BigEndian.Uint64(buf[i*8:])
+	}
+	return table, nil
+}
+
+// Extents returns the extents of length bytes at offset. Unallocated
+// clusters are reported using the backing chain extents, or as zero holes if
+// the image has no backing file.
+func (img *Image) Extents(offset int64, length int64) ([]Extent, error) {
+	img.mutex.Lock()
+	defer img.mutex.Unlock()
+
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("invalid range: offset %d length %d", offset, length)
+	}
+	end := img.Size()
+	if offset < end && length < end-offset {
+		end = offset + length
+	}
+
+	extents := []Extent{}
+	add := func(start int64, length int64, zero bool, hole bool) {
+		if n := len(extents); n > 0 {
+			last := &extents[n-1]
+			if last.Zero == zero && last.Hole == hole && last.Start+last.Length == start {
+				last.Length += length
+				return
+			}
+		}
+		extents = append(extents, Extent{start, length, zero, hole})
+	}
+
+	l1Range := img.clusterSize * img.l2Size
+
+	for pos := offset; pos < end; {
+		// Skip entire unallocated L2 tables quickly.
+		l1Index := pos / l1Range
+		if img.backing == nil && (l1Index >= int64(len(img.l1)) ||
+			img.l1[l1Index]&entryOffsetMask == 0) {
+			n := (l1Index+1)*l1Range - pos
+			if end-pos < n {
+				n = end - pos
+			}
+			add(pos, n, true, true)
+			pos += n
+			continue
+		}
+
+		n := img.clusterSize - pos%img.clusterSize
+		if end-pos < n {
+			n = end - pos
+		}
+		entry, err := img.l2Entry(pos)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case entry&entryCompressed != 0:
+			add(pos, n, false, false)
+		case img.isZero(entry):
+			add(pos, n, true, entry&entryOffsetMask == 0)
+		case entry&entryOffsetMask != 0:
+			add(pos, n, false, false)
+		case img.backing != nil:
+			backing, err := img.backingExtents(pos, n)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range backing {
+				add(e.Start, e.Length, e.Zero, e.Hole)
+			}
+		default:
+			add(pos, n, true, true)
+		}
+		pos += n
+	}
+
+	return extents, nil
+}
+
+// backingExtents returns the extents of the backing image. The range after
+// the end of the backing image is reported as a zero hole.
+func (img *Image) backingExtents(offset int64, length int64) ([]Extent, error) {
+	var extents []Extent
+	if b, ok := img.backing.(*Image); ok {
+		var err error
+		extents, err = b.Extents(offset, length)
+		if err != nil {
+			return nil, err
+		}
+	} else if n := img.backing.Size() - offset; n > 0 {
+		// Raw images do not report extents; assume all data.
+		if n > length {
+			n = length
+		}
+		extents = []Extent{{Start: offset, Length: n}}
+	}
+
+	pos := offset
+	if n := len(extents); n > 0 {
+		pos = extents[n-1].Start + extents[n-1].Length
+	}
+	if end := offset + length; pos < end {
+		extents = append(extents, Extent{pos, end - pos, true, true})
+	}
+	return extents, nil
+}
+
+// Close closes the image and its backing chain.
+func (img *Image) Close() error {
+	var err error
+	if img.backing != nil {
+		err = img.backing.Close()
+	}
+	if cerr := img.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// rawImage is a raw image in the backing chain.
+type rawImage struct {
+	*os.File
+	size int64
+}
+
+func openRaw(path string) (*rawImage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// Stat reports size 0 for block devices.
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &rawImage{File: file, size: size}, nil
+}
+
+func (r *rawImage) Size() int64 {
+	return r.size
+}
+
+func zero(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
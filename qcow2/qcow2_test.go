@@ -0,0 +1,375 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package qcow2
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"ovirt/imageio/testutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const (
+	testCluster = 64 * 1024
+	testSize    = 16 * testCluster
+)
+
+// cluster returns a cluster full of byte b.
+func cluster(b byte) []byte {
+	return bytes.Repeat([]byte{b}, testCluster)
+}
+
+func createImage(t *testing.T, opts testutil.Qcow2Options) string {
+	path, err := testutil.CreateQcow2(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func openImage(t *testing.T, path string) *Image {
+	img, err := Open(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// checkContent reads the entire image and compares it to the expected clusters.
+// Clusters not in expected must read as zeros.
+func checkContent(t *testing.T, img *Image, expected map[int64][]byte) {
+	data := make([]byte, img.Size())
+	if n, err := img.ReadAt(data, 0); err != nil || n != len(data) {
+		t.Fatalf("Read failed: n=%v err=%v", n, err)
+	}
+	for c := int64(0); c < img.Size()/testCluster; c++ {
+		want, ok := expected[c]
+		if !ok {
+			want = make([]byte, testCluster)
+		}
+		if !bytes.Equal(data[c*testCluster:(c+1)*testCluster], want) {
+			t.Fatalf("Cluster %d does not match", c)
+		}
+	}
+}
+
+func TestOpenRaw(t *testing.T) {
+	path, err := testutil.CreateFile(testSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	if _, err := Open(path, false); err == nil {
+		t.Fatal("Opening raw image did not fail")
+	}
+}
+
+func TestReadEmpty(t *testing.T) {
+	path := createImage(t, testutil.Qcow2Options{Size: testSize})
+	defer os.Remove(path)
+	img := openImage(t, path)
+	defer img.Close()
+
+	if img.Size() != testSize {
+		t.Fatalf("Expected size %v, got %v", testSize, img.Size())
+	}
+	checkContent(t, img, nil)
+}
+
+func TestReadData(t *testing.T) {
+	data := map[int64][]byte{
+		0:  cluster(1),
+		3:  testutil.Buffer(testCluster),
+		15: cluster(2),
+	}
+	path := createImage(t, testutil.Qcow2Options{
+		Size: testSize,
+		Data: data,
+		Zero: []int64{4},
+	})
+	defer os.Remove(path)
+	img := openImage(t, path)
+	defer img.Close()
+
+	checkContent(t, img, data)
+
+	// Unaligned read crossing clusters.
+	buf := make([]byte, 1000)
+	if _, err := img.ReadAt(buf, 4*testCluster-500); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:500], data[3][testCluster-500:]) {
+		t.Fatal("Data from allocated cluster does not match")
+	}
+	if !bytes.Equal(buf[500:], make([]byte, 500)) {
+		t.Fatal("Data from zero cluster is not zero")
+	}
+}
+
+func TestReadEOF(t *testing.T) {
+	path := createImage(t, testutil.Qcow2Options{Size: testSize})
+	defer os.Remove(path)
+	img := openImage(t, path)
+	defer img.Close()
+
+	buf := make([]byte, 8192)
+	n, err := img.ReadAt(buf, testSize-4096)
+	if err != io.EOF || n != 4096 {
+		t.Fatalf("Expected 4096 bytes and EOF, got %v (err=%v)", n, err)
+	}
+	if _, err := img.ReadAt(buf, testSize); err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+}
+
+func TestReadNegativeOffset(t *testing.T) {
+	path := createImage(t, testutil.Qcow2Options{Size: testSize})
+	defer os.Remove(path)
+	img := openImage(t, path)
+	defer img.Close()
+
+	if _, err := img.ReadAt(make([]byte, 256), -256); err == nil {
+		t.Fatal("Reading at negative offset did not fail")
+	}
+	if _, err := img.Extents(-256, 512); err == nil {
+		t.Fatal("Extents at negative offset did not fail")
+	}
+}
+
+func TestReadCompressed(t *testing.T) {
+	compressed := map[int64][]byte{
+		1: cluster(7),
+		2: testutil.Buffer(testCluster),
+	}
+	path := createImage(t, testutil.Qcow2Options{
+		Size:       testSize,
+		Data:       map[int64][]byte{0: cluster(1)},
+		Compressed: compressed,
+	})
+	defer os.Remove(path)
+	img := openImage(t, path)
+	defer img.Close()
+
+	compressed[0] = cluster(1)
+	checkContent(t, img, compressed)
+}
+
+func TestReadVersion2(t *testing.T) {
+	data := map[int64][]byte{1: cluster(1)}
+	path := createImage(t, testutil.Qcow2Options{
+		Version: 2,
+		Size:    testSize,
+		Data:    data,
+	})
+	defer os.Remove(path)
+	img := openImage(t, path)
+	defer img.Close()
+
+	checkContent(t, img, data)
+}
+
+func TestReadSmallClusters(t *testing.T) {
+	// With 512 bytes clusters, every L2 table maps 32 KiB, so the image
+	// uses multiple L2 tables.
+	const size = 128 * 1024
+	path := createImage(t, testutil.Qcow2Options{
+		ClusterBits: 9,
+		Size:        size,
+		Data: map[int64][]byte{
+			1:   bytes.Repeat([]byte{1}, 512),
+			100: bytes.Repeat([]byte{2}, 512),
+		},
+	})
+	defer os.Remove(path)
+	img := openImage(t, path)
+	defer img.Close()
+
+	buf := make([]byte, size)
+	if _, err := img.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	expected := make([]byte, size)
+	copy(expected[512:], bytes.Repeat([]byte{1}, 512))
+	copy(expected[100*512:], bytes.Repeat([]byte{2}, 512))
+	if !bytes.Equal(buf, expected) {
+		t.Fatal("Data does not match")
+	}
+}
+
+func TestReadBackingChain(t *testing.T) {
+	base := createImage(t, testutil.Qcow2Options{
+		Size: testSize,
+		Data: map[int64][]byte{0: cluster(1), 1: cluster(1), 2: cluster(1)},
+	})
+	defer os.Remove(base)
+
+	// Relative backing file name, without backing format.
+	middle := createImage(t, testutil.Qcow2Options{
+		Size:        testSize,
+		BackingFile: filepath.Base(base),
+		Data:        map[int64][]byte{1: cluster(2)},
+	})
+	defer os.Remove(middle)
+
+	top := createImage(t, testutil.Qcow2Options{
+		Size:          testSize,
+		BackingFile:   filepath.Base(middle),
+		BackingFormat: "qcow2",
+		Data:          map[int64][]byte{3: cluster(3)},
+		Zero:          []int64{2},
+	})
+	defer os.Remove(top)
+
+	img := openImage(t, top)
+	defer img.Close()
+
+	checkContent(t, img, map[int64][]byte{
+		0: cluster(1),
+		1: cluster(2),
+		3: cluster(3),
+	})
+}
+
+func TestReadRawBacking(t *testing.T) {
+	// Raw backing file smaller than the image.
+	base, err := testutil.CreateFile(2 * testCluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(base)
+	f, err := os.OpenFile(base, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt(cluster(1), 0)
+	f.WriteAt(cluster(1), testCluster)
+	f.Close()
+
+	top := createImage(t, testutil.Qcow2Options{
+		Size:          testSize,
+		BackingFile:   filepath.Base(base),
+		BackingFormat: "raw",
+		Data:          map[int64][]byte{1: cluster(2)},
+	})
+	defer os.Remove(top)
+
+	img := openImage(t, top)
+	defer img.Close()
+
+	checkContent(t, img, map[int64][]byte{
+		0: cluster(1),
+		1: cluster(2),
+	})
+}
+
+func TestReadBackingMissing(t *testing.T) {
+	top := createImage(t, testutil.Qcow2Options{
+		Size:          testSize,
+		BackingFile:   "no-such-image",
+		BackingFormat: "qcow2",
+	})
+	defer os.Remove(top)
+	if _, err := Open(top, false); err == nil {
+		t.Fatal("Opening image with missing backing file did not fail")
+	}
+}
+
+func TestBackingOutsideImageDir(t *testing.T) {
+	// Backing files must not expose other files on the host.
+	for _, name := range []string{
+		"/etc/passwd",
+		"../image",
+		"dir/../../image",
+	} {
+		top := createImage(t, testutil.Qcow2Options{
+			Size:          testSize,
+			BackingFile:   name,
+			BackingFormat: "raw",
+		})
+		defer os.Remove(top)
+		if img, err := Open(top, false); err == nil {
+			img.Close()
+			t.Fatalf("Opening image with backing file %q did not fail", name)
+		}
+	}
+}
+
+func TestExtents(t *testing.T) {
+	path := createImage(t, testutil.Qcow2Options{
+		Size:       testSize,
+		Data:       map[int64][]byte{1: cluster(1), 2: cluster(1)},
+		Compressed: map[int64][]byte{3: cluster(1)},
+		Zero:       []int64{5},
+	})
+	defer os.Remove(path)
+	img := openImage(t, path)
+	defer img.Close()
+
+	extents, err := img.Extents(0, testSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Extent{
+		{Start: 0, Length: testCluster, Zero: true, Hole: true},
+		{Start: testCluster, Length: 3 * testCluster},
+		{Start: 4 * testCluster, Length: 12 * testCluster, Zero: true, Hole: true},
+	}
+	if !reflect.DeepEqual(extents, expected) {
+		t.Fatalf("Expected extents %v, got %v", expected, extents)
+	}
+
+	// Partial range, clipped to the image size.
+	extents, err = img.Extents(testCluster+100, testSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []Extent{
+		{Start: testCluster + 100, Length: 3*testCluster - 100},
+		{Start: 4 * testCluster, Length: 12 * testCluster, Zero: true, Hole: true},
+	}
+	if !reflect.DeepEqual(extents, expected) {
+		t.Fatalf("Expected extents %v, got %v", expected, extents)
+	}
+}
+
+func TestExtentsBacking(t *testing.T) {
+	// Backing file smaller than the image.
+	base := createImage(t, testutil.Qcow2Options{
+		Size: 4 * testCluster,
+		Data: map[int64][]byte{0: cluster(1), 3: cluster(1)},
+	})
+	defer os.Remove(base)
+
+	top := createImage(t, testutil.Qcow2Options{
+		Size:          testSize,
+		BackingFile:   filepath.Base(base),
+		BackingFormat: "qcow2",
+		Data:          map[int64][]byte{1: cluster(2)},
+		Zero:          []int64{3},
+	})
+	defer os.Remove(top)
+
+	img := openImage(t, top)
+	defer img.Close()
+
+	extents, err := img.Extents(0, testSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Extent{
+		{Start: 0, Length: 2 * testCluster},
+		{Start: 2 * testCluster, Length: 14 * testCluster, Zero: true, Hole: true},
+	}
+	if !reflect.DeepEqual(extents, expected) {
+		t.Fatalf("Expected extents %v, got %v", expected, extents)
+	}
+}
@@ -0,0 +1,473 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrReadOnly is returned when modifying an image opened read only.
+var ErrReadOnly = errors.New("image is read only")
+
+// Header fields modified when writing.
+const (
+	refcountTableOffsetField = 48
+	autoclearFeaturesField   = 88
+)
+
+// prepareWrite checks that we can modify the image, and clears the autoclear
+// features, invalidating extensions we do not update, like bitmaps.
+func (img *Image) prepareWrite() error {
+	h := img.header
+	if h.IncompatibleFeatures&incompatDirty != 0 {
+		return fmt.Errorf("image is dirty, refcounts must be repaired")
+	}
+	if h.NbSnapshots != 0 {
+		return fmt.Errorf("writing images with snapshots is not supported")
+	}
+	if h.AutoclearFeatures != 0 {
+		if err := img.writeUint64(autoclearFeaturesField, 0); err != nil {
+			return err
+		}
+		h.AutoclearFeatures = 0
+	}
+
+	end, err := img.allocatedEnd()
+	if err != nil {
+		return err
+	}
+	img.end = end
+	img.writable = true
+	return nil
+}
+
+// allocatedEnd returns the offset after the last host cluster with a non-zero
+// refcount. We cannot use the file size, since block devices report zero
+// size, and a file may have unused space after the last cluster.
+func (img *Image) allocatedEnd() (int64, error) {
+	bits := int64(1) << img.header.RefcountOrder
+	blockEntries := img.clusterSize * 8 / bits
+	block := make([]byte, img.clusterSize)
+
+	for i := len(img.refcountTable) - 1; i >= 0; i-- {
+		offset := img.refcountTable[i] & refcountOffsetMask
+		if offset == 0 {
+			continue
+		}
+		if _, err := img.file.ReadAt(block, int64(offset)); err != nil {
+			return 0, fmt.Errorf("error reading refcount block at offset %d: %v",
+				offset, err)
+		}
+		for index := blockEntries - 1; index >= 0; index-- {
+			if refcountEntry(block, index, bits) != 0 {
+				cluster := int64(i)*blockEntries + index
+				return (cluster + 1) * img.clusterSize, nil
+			}
+		}
+	}
+
+	// The header cluster is always allocated.
+	return 0, fmt.Errorf("no allocated clusters")
+}
+
+// refcountEntry returns the refcount entry at index in a refcount block with
+// entries of bits width.
+func refcountEntry(block []byte, index int64, bits int64) uint64 {
+	if bits < 8 {
+		shift := uint64(index * bits % 8)
+		return uint64(block[index*bits/8]>>shift) & (1<<uint64(bits) - 1)
+	}
+	var value uint64
+	width := bits / 8
+	for _, b := range block[index*width : (index+1)*width] {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// WriteAt writes guest data at offset off. Clusters are allocated as needed,
+// copying unmodified data in the cluster from the backing chain. Writing
+// zeros to unallocated clusters does not allocate them.
+func (img *Image) WriteAt(p []byte, off int64) (int, error) {
+	if !img.writable {
+		return 0, ErrReadOnly
+	}
+	img.mutex.Lock()
+	defer img.mutex.Unlock()
+
+	if off < 0 || int64(len(p)) > img.Size()-off {
+		return 0, fmt.Errorf("write out of range: offset %d length %d", off, len(p))
+	}
+	end := off + int64(len(p))
+
+	for pos := off; pos < end; {
+		n := img.clusterSize - pos%img.clusterSize
+		if end-pos < n {
+			n = end - pos
+		}
+		if err := img.writeCluster(p[pos-off:pos-off+n], pos); err != nil {
+			return int(pos - off), err
+		}
+		pos += n
+	}
+	return len(p), nil
+}
+
+// Zero zeroes length bytes at offset. Entire clusters are deallocated, or
+// marked as zero if the image has a backing file.
+func (img *Image) Zero(offset int64, length int64) error {
+	if !img.writable {
+		return ErrReadOnly
+	}
+	img.mutex.Lock()
+	defer img.mutex.Unlock()
+
+	size := img.Size()
+	if offset < 0 || length < 0 || length > size-offset {
+		return fmt.Errorf("zero out of range: offset %d length %d", offset, length)
+	}
+	end := offset + length
+
+	var zeros []byte
+	for pos := offset; pos < end; {
+		n := img.clusterSize - pos%img.clusterSize
+		if end-pos < n {
+			n = end - pos
+		}
+		var err error
+		if pos%img.clusterSize == 0 && (n == img.clusterSize || pos+n == size) {
+			err = img.zeroCluster(pos)
+		} else {
+			if zeros == nil {
+				zeros = make([]byte, img.clusterSize)
+			}
+			err = img.writeCluster(zeros[:n], pos)
+		}
+		if err != nil {
+			return err
+		}
+		pos += n
+	}
+	return nil
+}
+
+// Flush flushes data and metadata to storage.
+func (img *Image) Flush() error {
+	if !img.writable {
+		return nil
+	}
+	img.mutex.Lock()
+	defer img.mutex.Unlock()
+	return img.file.Sync()
+}
+
+// writeCluster writes buf at guest offset pos. buf must not cross a cluster
+// boundary.
+func (img *Image) writeCluster(buf []byte, pos int64) error {
+	entry, err := img.l2Entry(pos)
+	if err != nil {
+		return err
+	}
+	inner := pos % img.clusterSize
+	hostOffset := int64(entry & entryOffsetMask)
+	owned := entry&entryCopied != 0 && entry&entryCompressed == 0 && hostOffset != 0
+
+	// Allocated data cluster; write in place.
+	if owned && !img.isZero(entry) {
+		_, err := img.file.WriteAt(buf, hostOffset+inner)
+		return err
+	}
+
+	if img.readsZero(entry) && allZero(buf) {
+		return nil
+	}
+
+	// Build the new cluster from the current guest data.
+	start := pos - inner
+	data := make([]byte, img.clusterSize)
+	if int64(len(buf)) < img.clusterSize {
+		length := img.clusterSize
+		if size := img.Size(); start+length > size {
+			length = size - start
+		}
+		if err := img.readCluster(data[:length], start); err != nil {
+			return err
+		}
+	}
+	copy(data[inner:], buf)
+
+	// Preallocated zero cluster; reuse the host cluster.
+	if owned {
+		if _, err := img.file.WriteAt(data, hostOffset); err != nil {
+			return err
+		}
+		return img.setL2Entry(pos, uint64(hostOffset)|entryCopied)
+	}
+
+	newOffset, err := img.allocate()
+	if err != nil {
+		return err
+	}
+	if _, err := img.file.WriteAt(data, newOffset); err != nil {
+		return err
+	}
+	if err := img.setL2Entry(pos, uint64(newOffset)|entryCopied); err != nil {
+		return err
+	}
+	return img.release(entry)
+}
+
+// zeroCluster zeroes the entire cluster at guest offset pos.
+func (img *Image) zeroCluster(pos int64) error {
+	entry, err := img.l2Entry(pos)
+	if err != nil {
+		return err
+	}
+
+	var zeroEntry uint64
+	switch {
+	case img.backing == nil:
+		zeroEntry = 0
+	case img.header.Version >= 3:
+		zeroEntry = entryZero
+	default:
+		// Version 2 images cannot hide backing data without allocating.
+		length := img.clusterSize
+		if size := img.Size(); pos+length > size {
+			length = size - pos
+		}
+		return img.writeCluster(make([]byte, length), pos)
+	}
+
+	if entry == zeroEntry {
+		return nil
+	}
+	if err := img.setL2Entry(pos, zeroEntry); err != nil {
+		return err
+	}
+	return img.release(entry)
+}
+
+// readsZero returns true if the cluster described by L2 entry reads as
+// zeros.
+func (img *Image) readsZero(entry uint64) bool {
+	return img.isZero(entry) || (entry == 0 && img.backing == nil)
+}
+
+// setL2Entry sets the L2 entry mapping guest offset pos, allocating a new L2
+// table if needed.
+func (img *Image) setL2Entry(pos int64, entry uint64) error {
+	cluster := pos / img.clusterSize
+	l1Index := cluster / img.l2Size
+	l2Offset := img.l1[l1Index] & entryOffsetMask
+
+	if l2Offset == 0 {
+		if entry == 0 {
+			return nil
+		}
+		offset, err := img.allocate()
+		if err != nil {
+			return err
+		}
+		if _, err := img.file.WriteAt(make([]byte, img.clusterSize), offset); err != nil {
+			return err
+		}
+		l1Entry := uint64(offset) | entryCopied
+		if err := img.writeUint64(int64(img.header.L1TableOffset)+l1Index*8, l1Entry); err != nil {
+			return err
+		}
+		img.l1[l1Index] = l1Entry
+		l2Offset = uint64(offset)
+	} else if img.l1[l1Index]&entryCopied == 0 {
+		return fmt.Errorf("shared l2 table at offset %d", l2Offset)
+	}
+
+	table, err := img.l2Table(l2Offset)
+	if err != nil {
+		return err
+	}
+	index := cluster % img.l2Size
+	if err := img.writeUint64(int64(l2Offset)+index*8, entry); err != nil {
+		return err
+	}
+	table[index] = entry
+	return nil
+}
+
+// release drops the references to host clusters used by an L2 entry that is
+// no longer used.
+func (img *Image) release(entry uint64) error {
+	var offset, length int64
+	switch {
+	case entry&entryCompressed != 0:
+		shift := 62 - (img.header.ClusterBits - 8)
+		sectors := int64((entry&^(entryCompressed|entryCopied))>>shift) + 1
+		offset = int64(entry&(1<<shift-1)) &^ (sectorSize - 1)
+		length = sectors * sectorSize
+	case entry&entryOffsetMask != 0:
+		offset = int64(entry & entryOffsetMask)
+		length = img.clusterSize
+	default:
+		return nil
+	}
+
+	for c := offset / img.clusterSize; c <= (offset+length-1)/img.clusterSize; c++ {
+		refcount, err := img.refcount(c)
+		if err != nil {
+			return err
+		}
+		if refcount == 0 {
+			return fmt.Errorf("cluster %d refcount underflow", c)
+		}
+		if err := img.setRefcount(c, refcount-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allocate allocates a new host cluster at the end of the image, and returns
+// its offset.
+func (img *Image) allocate() (int64, error) {
+	offset := img.end
+	img.end += img.clusterSize
+	if err := img.setRefcount(offset/img.clusterSize, 1); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// setRefcount sets the reference count of the host cluster at index
+// cluster, allocating refcount blocks and growing the refcount table as
+// needed.
+func (img *Image) setRefcount(cluster int64, value uint64) error {
+	bits := int64(1) << img.header.RefcountOrder
+	if bits < 64 && value >= 1<<uint64(bits) {
+		return fmt.Errorf("cluster %d refcount overflow", cluster)
+	}
+	blockEntries := img.clusterSize * 8 / bits
+
+	tableIndex := cluster / blockEntries
+	if tableIndex >= int64(len(img.refcountTable)) {
+		if err := img.growRefcountTable(tableIndex); err != nil {
+			return err
+		}
+	}
+
+	block := int64(img.refcountTable[tableIndex] & refcountOffsetMask)
+	if block == 0 {
+		block = img.end
+		img.end += img.clusterSize
+		if _, err := img.file.WriteAt(make([]byte, img.clusterSize), block); err != nil {
+			return err
+		}
+		tableOffset := int64(img.header.RefcountTableOffset) + tableIndex*8
+		if err := img.writeUint64(tableOffset, uint64(block)); err != nil {
+			return err
+		}
+		img.refcountTable[tableIndex] = uint64(block)
+		// The new block may be covered by itself, or need another block.
+		if err := img.setRefcount(block/img.clusterSize, 1); err != nil {
+			return err
+		}
+	}
+
+	index := cluster % blockEntries
+	pos := block + index*bits/8
+	if bits < 8 {
+		buf := make([]byte, 1)
+		if _, err := img.file.ReadAt(buf, pos); err != nil {
+			return err
+		}
+		shift := uint64(index * bits % 8)
+		mask := byte(1<<uint64(bits)-1) << shift
+		buf[0] = buf[0]&^mask | byte(value)<<shift
+		_, err := img.file.WriteAt(buf, pos)
+		return err
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, value)
+	_, err := img.file.WriteAt(buf[8-bits/8:], pos)
+	return err
+}
+
+// growRefcountTable moves the refcount table to a new larger location at the
+// end of the image, so it has an entry for index.
+func (img *Image) growRefcountTable(index int64) error {
+	oldTable := img.refcountTable
+	oldOffset := int64(img.header.RefcountTableOffset)
+	oldClusters := int64(img.header.RefcountTableClusters)
+
+	entries := int64(len(oldTable)) * 2
+	for entries <= index {
+		entries *= 2
+	}
+	clusters := entries * 8 / img.clusterSize
+	if clusters<<img.header.ClusterBits > maxTableSize {
+		return fmt.Errorf("refcount table too large: %d clusters", clusters)
+	}
+
+	// Switch to the new table in memory, so refcount blocks allocated for
+	// the new table clusters are added to the new table.
+	offset := img.end
+	img.end += clusters * img.clusterSize
+	img.refcountTable = make([]uint64, entries)
+	copy(img.refcountTable, oldTable)
+	img.header.RefcountTableOffset = uint64(offset)
+	img.header.RefcountTableClusters = uint32(clusters)
+
+	for c := offset / img.clusterSize; c < offset/img.clusterSize+clusters; c++ {
+		if err := img.setRefcount(c, 1); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, clusters*img.clusterSize)
+	for i, entry := range img.refcountTable {
+		binary.BigEndian.PutUint64(buf[i*8:], entry)
+	}
+	if _, err := img.file.WriteAt(buf, offset); err != nil {
+		return err
+	}
+
+	// Refcount table offset is followed by the refcount table clusters.
+	header := make([]byte, 12)
+	binary.BigEndian.PutUint64(header, uint64(offset))
+	binary.BigEndian.PutUint32(header[8:], uint32(clusters))
+	if _, err := img.file.WriteAt(header, refcountTableOffsetField); err != nil {
+		return err
+	}
+
+	for c := oldOffset / img.clusterSize; c < oldOffset/img.clusterSize+oldClusters; c++ {
+		if err := img.setRefcount(c, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeUint64 writes a big endian 64 bits value at host offset.
+func (img *Image) writeUint64(offset int64, value uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, value)
+	_, err := img.file.WriteAt(buf, offset)
+	return err
+}
+
+func allZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
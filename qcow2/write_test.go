@@ -0,0 +1,395 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package qcow2
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"ovirt/imageio/testutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func openWritable(t *testing.T, path string) *Image {
+	img, err := Open(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// checkImage flushes and closes img, and checks the image refcounts.
+func checkImage(t *testing.T, img *Image, path string) {
+	if err := img.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check, err := newImage(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check.Close()
+	if err := check.Check(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteReadOnly(t *testing.T) {
+	path := createImage(t, testutil.Qcow2Options{Size: testSize})
+	defer os.Remove(path)
+	img := openImage(t, path)
+	defer img.Close()
+
+	if _, err := img.WriteAt([]byte("data"), 0); err != ErrReadOnly {
+		t.Fatalf("Expected %v, got %v", ErrReadOnly, err)
+	}
+	if err := img.Zero(0, 4096); err != ErrReadOnly {
+		t.Fatalf("Expected %v, got %v", ErrReadOnly, err)
+	}
+}
+
+func TestWriteUnsupported(t *testing.T) {
+	path := patchHeader(t, 72, uint64(incompatDirty))
+	defer os.Remove(path)
+	if _, err := Open(path, true); err == nil {
+		t.Fatal("Opening dirty image for writing did not fail")
+	}
+
+	path = patchHeader(t, 60, uint32(1))
+	defer os.Remove(path)
+	if _, err := Open(path, true); err == nil {
+		t.Fatal("Opening image with snapshots for writing did not fail")
+	}
+}
+
+func TestWriteOutOfRange(t *testing.T) {
+	path := createImage(t, testutil.Qcow2Options{Size: testSize})
+	defer os.Remove(path)
+	img := openWritable(t, path)
+	defer img.Close()
+
+	if _, err := img.WriteAt([]byte("data"), testSize-2); err == nil {
+		t.Fatal("Writing after end of image did not fail")
+	}
+	if err := img.Zero(testSize-2, 4); err == nil {
+		t.Fatal("Zeroing after end of image did not fail")
+	}
+	// offset + length wraps around.
+	if _, err := img.WriteAt([]byte("data"), math.MaxInt64-2); err == nil {
+		t.Fatal("Writing after maximum offset did not fail")
+	}
+	if err := img.Zero(testCluster, math.MaxInt64-10); err == nil {
+		t.Fatal("Zeroing after maximum offset did not fail")
+	}
+}
+
+func TestWriteNewImage(t *testing.T) {
+	path := createImage(t, testutil.Qcow2Options{Size: testSize})
+	defer os.Remove(path)
+	img := openWritable(t, path)
+
+	data := testutil.Buffer(testSize)
+	// Partial cluster, crossing clusters, and entire clusters.
+	for _, r := range [][2]int64{
+		{100, 1000},
+		{testCluster - 500, 1000},
+		{2 * testCluster, 3 * testCluster},
+		{8 * testCluster, 8 * testCluster},
+	} {
+		if _, err := img.WriteAt(data[r[0]:r[0]+r[1]], r[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkImage(t, img, path)
+
+	img = openImage(t, path)
+	defer img.Close()
+
+	expected := make([]byte, testSize)
+	copy(expected[100:1100], data[100:1100])
+	copy(expected[testCluster-500:testCluster+500], data[testCluster-500:testCluster+500])
+	copy(expected[2*testCluster:5*testCluster], data[2*testCluster:5*testCluster])
+	copy(expected[8*testCluster:], data[8*testCluster:])
+
+	buf := make([]byte, testSize)
+	if _, err := img.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, expected) {
+		t.Fatal("Data read does not match data written")
+	}
+
+	extents, err := img.Extents(0, testSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedExtents := []Extent{
+		{Start: 0, Length: 5 * testCluster},
+		{Start: 5 * testCluster, Length: 3 * testCluster, Zero: true, Hole: true},
+		{Start: 8 * testCluster, Length: 8 * testCluster},
+	}
+	if !reflect.DeepEqual(extents, expectedExtents) {
+		t.Fatalf("Expected extents %v, got %v", expectedExtents, extents)
+	}
+}
+
+func TestWriteTrailingSpace(t *testing.T) {
+	path := createImage(t, testutil.Qcow2Options{
+		Size: testSize,
+		Data: map[int64][]byte{0: cluster(1)},
+	})
+	defer os.Remove(path)
+
+	// Unused space after the last cluster, like a qcow2 image on a block
+	// device. New clusters must be allocated after the last cluster with a
+	// non-zero refcount, not after the end of the file.
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(bytes.Repeat([]byte{0xab}, 8*testCluster), info.Size())
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := openWritable(t, path)
+	if img.end != info.Size() {
+		t.Fatalf("Expected end %v, got %v", info.Size(), img.end)
+	}
+	if _, err := img.WriteAt(cluster(2), testCluster); err != nil {
+		t.Fatal(err)
+	}
+	checkImage(t, img, path)
+
+	img = openImage(t, path)
+	defer img.Close()
+	checkContent(t, img, map[int64][]byte{0: cluster(1), 1: cluster(2)})
+
+	info2, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info2.Size() != info.Size()+8*testCluster {
+		t.Fatalf("File size changed from %v to %v", info.Size()+8*testCluster, info2.Size())
+	}
+}
+
+func TestWriteZerosKeepsSparse(t *testing.T) {
+	path := createImage(t, testutil.Qcow2Options{Size: testSize})
+	defer os.Remove(path)
+	img := openWritable(t, path)
+
+	if _, err := img.WriteAt(make([]byte, testSize), 0); err != nil {
+		t.Fatal(err)
+	}
+	extents, err := img.Extents(0, testSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Extent{{Start: 0, Length: testSize, Zero: true, Hole: true}}
+	if !reflect.DeepEqual(extents, expected) {
+		t.Fatalf("Expected extents %v, got %v", expected, extents)
+	}
+	checkImage(t, img, path)
+}
+
+func TestWriteGrowRefcounts(t *testing.T) {
+	// With 512 bytes clusters and 16 bits refcounts, every refcount block
+	// covers 128 KiB, and the initial refcount table covers 8 MiB, so
+	// writing 10 MiB allocates new refcount blocks and grows the refcount
+	// table.
+	const size = 10 * 1024 * 1024
+	path := createImage(t, testutil.Qcow2Options{ClusterBits: 9, Size: size})
+	defer os.Remove(path)
+	img := openWritable(t, path)
+
+	data := testutil.Buffer(size)
+	data[0] = 1 // Avoid an all zero first cluster.
+	if _, err := img.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	checkImage(t, img, path)
+
+	img = openImage(t, path)
+	defer img.Close()
+	if img.header.RefcountTableClusters == 1 {
+		t.Fatal("Refcount table did not grow")
+	}
+	buf := make([]byte, size)
+	if _, err := img.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("Data read does not match data written")
+	}
+}
+
+func TestWriteBacking(t *testing.T) {
+	base := createImage(t, testutil.Qcow2Options{
+		Size: testSize,
+		Data: map[int64][]byte{0: cluster(1), 1: cluster(1)},
+	})
+	defer os.Remove(base)
+
+	top := createImage(t, testutil.Qcow2Options{
+		Size:          testSize,
+		BackingFile:   filepath.Base(base),
+		BackingFormat: "qcow2",
+	})
+	defer os.Remove(top)
+
+	img := openWritable(t, top)
+	// Copy on write the rest of the cluster from the backing file.
+	if _, err := img.WriteAt(bytes.Repeat([]byte{2}, 100), 1000); err != nil {
+		t.Fatal(err)
+	}
+	// Zeroing an entire cluster hides the backing data.
+	if err := img.Zero(testCluster, testCluster); err != nil {
+		t.Fatal(err)
+	}
+	checkImage(t, img, top)
+
+	img = openImage(t, top)
+	defer img.Close()
+
+	expected := cluster(1)
+	copy(expected[1000:], bytes.Repeat([]byte{2}, 100))
+	checkContent(t, img, map[int64][]byte{0: expected})
+
+	// The base image is not modified.
+	baseImg := openImage(t, base)
+	defer baseImg.Close()
+	checkContent(t, baseImg, map[int64][]byte{0: cluster(1), 1: cluster(1)})
+}
+
+func TestWriteBackingVersion2(t *testing.T) {
+	base := createImage(t, testutil.Qcow2Options{
+		Size: testSize,
+		Data: map[int64][]byte{0: cluster(1)},
+	})
+	defer os.Remove(base)
+
+	top := createImage(t, testutil.Qcow2Options{
+		Version:     2,
+		Size:        testSize,
+		BackingFile: filepath.Base(base),
+	})
+	defer os.Remove(top)
+
+	// Version 2 images have no zero flag; zeroing allocates a zero cluster.
+	img := openWritable(t, top)
+	if err := img.Zero(0, testCluster); err != nil {
+		t.Fatal(err)
+	}
+	checkImage(t, img, top)
+
+	img = openImage(t, top)
+	defer img.Close()
+	checkContent(t, img, nil)
+}
+
+func TestWriteCompressed(t *testing.T) {
+	path := createImage(t, testutil.Qcow2Options{
+		Size:       testSize,
+		Compressed: map[int64][]byte{0: cluster(1), 1: cluster(2)},
+	})
+	defer os.Remove(path)
+
+	img := openWritable(t, path)
+	if _, err := img.WriteAt([]byte("data"), 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Zero(testCluster, testCluster); err != nil {
+		t.Fatal(err)
+	}
+	checkImage(t, img, path)
+
+	img = openImage(t, path)
+	defer img.Close()
+	expected := cluster(1)
+	copy(expected[100:], "data")
+	checkContent(t, img, map[int64][]byte{0: expected})
+}
+
+func TestZero(t *testing.T) {
+	data := map[int64][]byte{
+		0: cluster(1),
+		1: cluster(1),
+		2: cluster(1),
+	}
+	path := createImage(t, testutil.Qcow2Options{
+		Size: testSize,
+		Data: data,
+		Zero: []int64{3},
+	})
+	defer os.Remove(path)
+
+	img := openWritable(t, path)
+	// Partial cluster, entire clusters, and a zero cluster.
+	if err := img.Zero(1000, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Zero(testCluster, 3*testCluster); err != nil {
+		t.Fatal(err)
+	}
+	// Writing to a zero cluster.
+	if _, err := img.WriteAt([]byte("data"), 5*testCluster+10); err != nil {
+		t.Fatal(err)
+	}
+	checkImage(t, img, path)
+
+	img = openImage(t, path)
+	defer img.Close()
+
+	first := cluster(1)
+	copy(first[1000:1100], make([]byte, 100))
+	last := make([]byte, testCluster)
+	copy(last[10:], "data")
+	checkContent(t, img, map[int64][]byte{0: first, 5: last})
+
+	extents, err := img.Extents(0, testSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Extent{
+		{Start: 0, Length: testCluster},
+		{Start: testCluster, Length: 4 * testCluster, Zero: true, Hole: true},
+		{Start: 5 * testCluster, Length: testCluster},
+		{Start: 6 * testCluster, Length: 10 * testCluster, Zero: true, Hole: true},
+	}
+	if !reflect.DeepEqual(extents, expected) {
+		t.Fatalf("Expected extents %v, got %v", expected, extents)
+	}
+}
+
+func TestWriteClearsAutoclear(t *testing.T) {
+	path := patchHeader(t, 88, uint64(1))
+	defer os.Remove(path)
+
+	img := openWritable(t, path)
+	img.Close()
+
+	img = openImage(t, path)
+	defer img.Close()
+	if img.header.AutoclearFeatures != 0 {
+		t.Fatalf("Autoclear features not cleared: %#x", img.header.AutoclearFeatures)
+	}
+}
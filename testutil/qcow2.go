@@ -0,0 +1,191 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package testutil
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io/ioutil"
+	"sort"
+)
+
+// Qcow2Options describes a qcow2 image created by CreateQcow2.
+type Qcow2Options struct {
+	// Version is the image version, 2 or 3 (default 3).
+	Version uint32
+
+	// ClusterBits is the log2 of the cluster size (default 16).
+	ClusterBits uint32
+
+	// Size is the virtual size of the image.
+	Size int64
+
+	// BackingFile and BackingFormat describe the image backing file.
+	BackingFile   string
+	BackingFormat string
+
+	// Data maps guest cluster index to cluster data.
+	Data map[int64][]byte
+
+	// Compressed maps guest cluster index to cluster data, stored as
+	// compressed cluster.
+	Compressed map[int64][]byte
+
+	// Zero lists guest clusters with the zero flag.
+	Zero []int64
+}
+
+// CreateQcow2 creates a temporary qcow2 image described by opts, without
+// depending on qemu-img. Every cluster has refcount 1.
+//
+// Caller is responsible for removing the temporary file.
+func CreateQcow2(opts Qcow2Options) (string, error) {
+	if opts.Version == 0 {
+		opts.Version = 3
+	}
+	if opts.ClusterBits == 0 {
+		opts.ClusterBits = 16
+	}
+
+	clusterSize := int64(1) << opts.ClusterBits
+	l2Size := clusterSize / 8
+	l1Size := (opts.Size + clusterSize*l2Size - 1) / (clusterSize * l2Size)
+	l1Clusters := (l1Size*8 + clusterSize - 1) / clusterSize
+	if l1Clusters == 0 {
+		l1Clusters = 1
+	}
+
+	// Layout: header, refcount table, refcount block, l1 table, and then l2
+	// tables and data clusters as needed.
+	const refcountTableOffset = 1
+	const refcountBlockOffset = 2
+	const l1Offset = 3
+	image := make([]byte, (l1Offset+l1Clusters)*clusterSize)
+
+	alloc := func(length int64) int64 {
+		offset := int64(len(image))
+		clusters := (length + clusterSize - 1) / clusterSize
+		image = append(image, make([]byte, clusters*clusterSize)...)
+		return offset
+	}
+
+	l1 := make([]uint64, l1Size)
+	setEntry := func(cluster int64, entry uint64) {
+		i := cluster / l2Size
+		if l1[i] == 0 {
+			l1[i] = uint64(alloc(clusterSize)) | 1<<63
+		}
+		offset := int64(l1[i]&^(1<<63)) + cluster%l2Size*8
+		binary.BigEndian.PutUint64(image[offset:], entry)
+	}
+
+	for _, cluster := range sortedClusters(opts.Data) {
+		offset := alloc(clusterSize)
+		copy(image[offset:offset+clusterSize], opts.Data[cluster])
+		setEntry(cluster, uint64(offset)|1<<63)
+	}
+
+	shift := 62 - (opts.ClusterBits - 8)
+	for _, cluster := range sortedClusters(opts.Compressed) {
+		data := make([]byte, clusterSize)
+		copy(data, opts.Compressed[cluster])
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.BestCompression)
+		if err != nil {
+			return "", err
+		}
+		w.Write(data)
+		w.Close()
+		offset := alloc(int64(buf.Len()))
+		copy(image[offset:], buf.Bytes())
+		sectors := uint64(buf.Len()+511) / 512
+		setEntry(cluster, 1<<62|(sectors-1)<<shift|uint64(offset))
+	}
+
+	for _, cluster := range opts.Zero {
+		setEntry(cluster, 1)
+	}
+
+	for i, entry := range l1 {
+		binary.BigEndian.PutUint64(image[l1Offset*clusterSize+int64(i)*8:], entry)
+	}
+
+	// 16 bits refcount for every cluster.
+	binary.BigEndian.PutUint64(image[refcountTableOffset*clusterSize:],
+		uint64(refcountBlockOffset*clusterSize))
+	for i := int64(0); i < int64(len(image))/clusterSize; i++ {
+		binary.BigEndian.PutUint16(image[refcountBlockOffset*clusterSize+i*2:], 1)
+	}
+
+	headerLength := 104
+	if opts.Version == 2 {
+		headerLength = 72
+	}
+	header := []interface{}{
+		uint32(0x514649fb),
+		opts.Version,
+		uint64(0), // backing file offset
+		uint32(len(opts.BackingFile)),
+		opts.ClusterBits,
+		uint64(opts.Size),
+		uint32(0), // crypt method
+		uint32(l1Size),
+		uint64(l1Offset * clusterSize),
+		uint64(refcountTableOffset * clusterSize),
+		uint32(1), // refcount table clusters
+		uint32(0), // snapshots
+		uint64(0), // snapshots offset
+	}
+	if opts.Version == 3 {
+		header = append(header,
+			uint64(0), // incompatible features
+			uint64(0), // compatible features
+			uint64(0), // autoclear features
+			uint32(4), // refcount order
+			uint32(headerLength))
+	}
+	if opts.BackingFile != "" {
+		// Store the backing file name in the second half of the header
+		// cluster, after the header extensions.
+		header[2] = uint64(clusterSize / 2)
+		copy(image[clusterSize/2:], opts.BackingFile)
+	}
+
+	var buf bytes.Buffer
+	for _, v := range header {
+		binary.Write(&buf, binary.BigEndian, v)
+	}
+	if opts.BackingFormat != "" {
+		binary.Write(&buf, binary.BigEndian, uint32(0xe2792aca))
+		binary.Write(&buf, binary.BigEndian, uint32(len(opts.BackingFormat)))
+		buf.WriteString(opts.BackingFormat)
+		buf.Write(make([]byte, (8-len(opts.BackingFormat)%8)%8))
+	}
+	copy(image, buf.Bytes())
+
+	file, err := ioutil.TempFile("/var/tmp", "testutil.")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := file.Write(image); err != nil {
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+func sortedClusters(m map[int64][]byte) []int64 {
+	clusters := make([]int64, 0, len(m))
+	for c := range m {
+		clusters = append(clusters, c)
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i] < clusters[j] })
+	return clusters
+}
@@ -10,6 +10,7 @@ package testutil
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io"
 	"io/ioutil"
 	"os"
@@ -86,3 +87,29 @@ func TestBufferRepeat(t *testing.T) {
 		t.Fatalf("Expected %v, got %v", expected, buf)
 	}
 }
+
+func TestCreateQcow2(t *testing.T) {
+	path, err := CreateQcow2(Qcow2Options{
+		Size: 1024 * 1024,
+		Data: map[int64][]byte{0: []byte("data")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if magic := binary.BigEndian.Uint32(buf); magic != 0x514649fb {
+		t.Fatalf("Unexpected magic: %#x", magic)
+	}
+	if size := binary.BigEndian.Uint64(buf[24:]); size != 1024*1024 {
+		t.Fatalf("Unexpected size: %v", size)
+	}
+	// Header, refcount table, refcount block, l1 table, data, l2 table.
+	if len(buf) != 6*64*1024 {
+		t.Fatalf("Unexpected image size: %v", len(buf))
+	}
+}
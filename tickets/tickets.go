@@ -0,0 +1,197 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package tickets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"ovirt/imageio/auth"
+	"strconv"
+	"time"
+)
+
+const (
+	ROOT = "/tickets/"
+
+	// Tickets are small json messages, no need to read more.
+	maxTicketSize = 4096
+)
+
+var (
+	listener net.Listener
+
+	// How long to wait for ongoing operations when removing a ticket.
+	removeTimeout = 60 * time.Second
+)
+
+// Start starts the tickets web server.
+//
+// The tickets server controls access to images, so it should not listen on
+// the same address as the images server. Use network "unix" to listen on a
+// unix socket at addr, or "tcp" to listen on a tcp address.
+func Start(network string, addr string) (err error) {
+	if listener != nil {
+		return fmt.Errorf("Already started")
+	}
+
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return
+	}
+
+	listener = ln
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(ROOT, handle)
+	server := &http.Server{Handler: mux}
+
+	go server.Serve(listener)
+	return
+}
+
+// Stop stops the tickets web server.
+//
+// This does not effect ongoing requests, and does not wait for their
+// completion.
+func Stop() error {
+	if listener == nil {
+		return fmt.Errorf("Not running")
+	}
+	ln := listener
+	listener = nil
+	return ln.Close()
+}
+
+// Addr returns the address the server is listening on. For testing a server on
+// a random port.
+func Addr() string {
+	return listener.Addr().String()
+}
+
+func handle(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "PUT":
+		put(w, r)
+	case "GET":
+		get(w, r)
+	case "PATCH":
+		patch(w, r)
+	case "DELETE":
+		remove(w, r)
+	default:
+		http.Error(w, "You are not allowed to "+r.Method, http.StatusMethodNotAllowed)
+		return
+	}
+}
+
+func put(w http.ResponseWriter, r *http.Request) {
+	ticketUuid := r.URL.Path[len(ROOT):]
+
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, maxTicketSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ticket, err := auth.ParseTicket(buf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if ticket.Uuid != ticketUuid {
+		msg := fmt.Sprintf("Ticket uuid %v does not match request uuid %v",
+			ticket.Uuid, ticketUuid)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	if err = auth.Add(ticket); err != nil {
+		status := http.StatusBadRequest
+		if err == auth.ErrExists {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+}
+
+// get returns the ticket status, including the progress of ongoing
+// operations.
+func get(w http.ResponseWriter, r *http.Request) {
+	ticketUuid := r.URL.Path[len(ROOT):]
+
+	status, err := auth.GetStatus(ticketUuid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	buf, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	w.Write(buf)
+}
+
+// patchRequest modifies an existing ticket.
+//
+// Example:
+//
+//	{"timeout": 300}
+type patchRequest struct {
+	Timeout *auth.Seconds `json:"timeout"`
+}
+
+// patch extends a ticket, so it expires timeout seconds from now.
+func patch(w http.ResponseWriter, r *http.Request) {
+	ticketUuid := r.URL.Path[len(ROOT):]
+
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, maxTicketSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req patchRequest
+	if err = json.Unmarshal(buf, &req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid json: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Timeout == nil {
+		http.Error(w, "Timeout is required", http.StatusBadRequest)
+		return
+	}
+
+	if err = auth.Extend(ticketUuid, *req.Timeout); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+}
+
+// remove removes a ticket, canceling ongoing operations and waiting until
+// they finish. If the operations did not finish in time, the ticket remains
+// in canceled state and the request fails with a conflict; the engine should
+// retry the request later. Removing a missing ticket succeeds.
+func remove(w http.ResponseWriter, r *http.Request) {
+	ticketUuid := r.URL.Path[len(ROOT):]
+	if err := auth.RemoveWait(ticketUuid, removeTimeout); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
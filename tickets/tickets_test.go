@@ -0,0 +1,379 @@
+// ovirt-imageio
+// Copyright (C) 2016 Red Hat, Inc.
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+
+package tickets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"ovirt/imageio/auth"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const ticketUuid = "3facfbc1-68e0-4b77-b0c6-87e66fcabcc2"
+
+var ticketJson = []byte(`{
+	"mode": "rw",
+	"size": 1024,
+	"timeout": 300,
+	"url": "file:///path",
+	"uuid": "3facfbc1-68e0-4b77-b0c6-87e66fcabcc2"
+}`)
+
+func TestPutGetDelete(t *testing.T) {
+	dir := startUnix(t)
+	defer os.RemoveAll(dir)
+	defer Stop()
+	defer auth.Remove(ticketUuid)
+
+	resp, err := request("PUT", "/tickets/"+ticketUuid, ticketJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	if _, err = auth.MayWrite(ticketUuid, 0, 1024); err != nil {
+		t.Fatalf("Ticket not added: %v", err)
+	}
+
+	resp, err = request("GET", "/tickets/"+ticketUuid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+	var status auth.Status
+	if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Uuid != ticketUuid || status.Mode != "rw" || status.Size != 1024 {
+		t.Fatalf("Unexpected ticket: %+v", status.Ticket)
+	}
+	if status.Active || status.Ongoing != 0 || status.Transferred != 0 {
+		t.Fatalf("Unexpected status: %+v", status)
+	}
+
+	resp, err = request("DELETE", "/tickets/"+ticketUuid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected %v, got %v", http.StatusNoContent, resp.StatusCode)
+	}
+
+	if _, err = auth.MayWrite(ticketUuid, 0, 1024); err == nil {
+		t.Fatal("Ticket not removed")
+	}
+}
+
+func TestPutExisting(t *testing.T) {
+	dir := startUnix(t)
+	defer os.RemoveAll(dir)
+	defer Stop()
+	defer auth.Remove(ticketUuid)
+
+	resp, err := request("PUT", "/tickets/"+ticketUuid, ticketJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	// Replacing a ticket would orphan tasks using the old ticket.
+	resp, err = request("PUT", "/tickets/"+ticketUuid, ticketJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected %v, got %v", http.StatusConflict, resp.StatusCode)
+	}
+
+	// After removing the ticket, it can be added again.
+	auth.Remove(ticketUuid)
+	resp, err = request("PUT", "/tickets/"+ticketUuid, ticketJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestPutInvalid(t *testing.T) {
+	dir := startUnix(t)
+	defer os.RemoveAll(dir)
+	defer Stop()
+
+	resp, err := request("PUT", "/tickets/"+ticketUuid, []byte(`{"mode": "x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected %v, got %v", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestPutUuidMismatch(t *testing.T) {
+	dir := startUnix(t)
+	defer os.RemoveAll(dir)
+	defer Stop()
+
+	resp, err := request("PUT", "/tickets/other-uuid", ticketJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected %v, got %v", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	if _, err = auth.Get(ticketUuid); err == nil {
+		auth.Remove(ticketUuid)
+		t.Fatal("Ticket added with mismatching uuid")
+	}
+}
+
+func TestPatch(t *testing.T) {
+	dir := startUnix(t)
+	defer os.RemoveAll(dir)
+	defer Stop()
+
+	ticket := &auth.Ticket{
+		Mode:    "rw",
+		Size:    1024,
+		Timeout: 0,
+		Url:     "file:///path",
+		Uuid:    ticketUuid,
+	}
+	if err := auth.Add(ticket); err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(ticketUuid)
+
+	if _, err := auth.MayRead(ticketUuid, 0, 1024); err == nil {
+		t.Fatal("Read allowed with expired ticket")
+	}
+
+	resp, err := request("PATCH", "/tickets/"+ticketUuid, []byte(`{"timeout": 300}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	if _, err := auth.MayRead(ticketUuid, 0, 1024); err != nil {
+		t.Fatalf("Read not allowed after extending ticket: %v", err)
+	}
+}
+
+var invalidPatches = []string{
+	``,
+	`not json`,
+	`{}`,
+	`{"timeout": -1}`,
+	`{"timeout": "300"}`,
+}
+
+func TestPatchInvalid(t *testing.T) {
+	dir := startUnix(t)
+	defer os.RemoveAll(dir)
+	defer Stop()
+
+	for _, msg := range invalidPatches {
+		resp, err := request("PATCH", "/tickets/"+ticketUuid, []byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Patch %q: expected %v, got %v", msg, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+}
+
+func TestPatchMissing(t *testing.T) {
+	dir := startUnix(t)
+	defer os.RemoveAll(dir)
+	defer Stop()
+
+	resp, err := request("PATCH", "/tickets/no-such-ticket", []byte(`{"timeout": 300}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected %v, got %v", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestGetMissing(t *testing.T) {
+	dir := startUnix(t)
+	defer os.RemoveAll(dir)
+	defer Stop()
+
+	resp, err := request("GET", "/tickets/no-such-ticket", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected %v, got %v", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestDeleteMissing(t *testing.T) {
+	dir := startUnix(t)
+	defer os.RemoveAll(dir)
+	defer Stop()
+
+	resp, err := request("DELETE", "/tickets/no-such-ticket", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected %v, got %v", http.StatusNoContent, resp.StatusCode)
+	}
+}
+
+func TestDeleteTimeout(t *testing.T) {
+	dir := startUnix(t)
+	defer os.RemoveAll(dir)
+	defer Stop()
+
+	ticket, err := auth.ParseTicket(ticketJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = auth.Add(ticket); err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Remove(ticketUuid)
+
+	task, err := auth.Begin(context.Background(), ticketUuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := removeTimeout
+	removeTimeout = 10 * time.Millisecond
+	defer func() { removeTimeout = saved }()
+
+	resp, err := request("DELETE", "/tickets/"+ticketUuid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected %v, got %v", http.StatusConflict, resp.StatusCode)
+	}
+
+	task.Done()
+
+	resp, err = request("DELETE", "/tickets/"+ticketUuid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected %v, got %v", http.StatusNoContent, resp.StatusCode)
+	}
+}
+
+func TestTcp(t *testing.T) {
+	err := Start("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	url := fmt.Sprintf("http://%s/tickets/no-such-ticket", Addr())
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected %v, got %v", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestAlreadyRunning(t *testing.T) {
+	err := Stop()
+	if err == nil {
+		t.Fatal("Stop did not fail on stopped server")
+	}
+}
+
+func TestNotRunning(t *testing.T) {
+	dir := startUnix(t)
+	defer os.RemoveAll(dir)
+	defer Stop()
+
+	err := Start("unix", "ignored")
+	if err == nil {
+		t.Fatal("Start did not fail on running server")
+	}
+}
+
+// startUnix starts the server on a unix socket in a temporary directory.
+//
+// Caller is responsible for stopping the server and removing the directory.
+func startUnix(t *testing.T) string {
+	dir, err := ioutil.TempDir("/var/tmp", "tickets.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Start("unix", filepath.Join(dir, "sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// request sends http request to the tickets server over a unix socket.
+func request(method string, path string, buf []byte) (*http.Response, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", Addr())
+			},
+		},
+	}
+	req, err := http.NewRequest(method, "http://localhost"+path, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	if buf != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return client.Do(req)
+}